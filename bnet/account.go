@@ -3,8 +3,10 @@ package bnet
 import (
 	"github.com/HearthSim/hs-proto-go/bnet/account_service"
 	"github.com/HearthSim/hs-proto-go/bnet/account_types"
+	"github.com/HearthSim/hs-proto-go/bnet/entity"
 	"github.com/golang/protobuf/proto"
 	"log"
+	"time"
 )
 
 type AccountServiceBinder struct{}
@@ -89,21 +91,185 @@ func (s *AccountService) Invoke(method int, body []byte) (resp []byte, err error
 	case 36:
 		return []byte{}, s.ForwardCacheExpire(body)
 	default:
-		log.Panicf("error: AccountService.Invoke: unknown method %v", method)
-		return
+		return nil, Errorf(ErrorRPCInvalidMethod, "AccountService.Invoke: unknown method %v", method)
+	}
+}
+
+// How long the client may cache account and game account blobs.
+const accountCacheExpiration = 5 * time.Minute
+
+// ownAccount checks that an entity id, if given, is the session's own bnet
+// account.  Clients may only look up their own account.
+func (s *AccountService) ownAccount(id *entity.EntityId) error {
+	if s.sess.State() != StateReady {
+		return Errorf(ErrorNoAuth, "AccountService: not logged on")
+	}
+	if id != nil && (id.GetHigh() != BnetAccountEntityIDHi || id.GetLow() != s.sess.account.ID) {
+		return Errorf(ErrorDenied, "AccountService: not the session's account: %s", id.String())
+	}
+	return nil
+}
+
+// ownGameAccount returns one of the session's game accounts by its id.
+func (s *AccountService) ownGameAccount(id uint64) (*GameAccount, error) {
+	if s.sess.State() != StateReady {
+		return nil, Errorf(ErrorNoAuth, "AccountService: not logged on")
+	}
+	for _, gameAccount := range gameAccountsFor(s.sess.account.ID, "") {
+		if uint64(gameAccount.ID) == id {
+			return &gameAccount, nil
+		}
+	}
+	return nil, Errorf(ErrorNotExists, "AccountService: account %d has no game account %d",
+		s.sess.account.ID, id)
+}
+
+// ownGameAccountByEntityId is ownGameAccount for a game account entity id.
+func (s *AccountService) ownGameAccountByEntityId(id *entity.EntityId) (*GameAccount, error) {
+	if id.GetHigh() != BnetGameAccountEntityIDHi {
+		return nil, Errorf(ErrorInvalidArgs, "AccountService: bad game account id: %s", id.String())
 	}
+	return s.ownGameAccount(id.GetLow())
+}
+
+// resolve checks that an account reference is to the session's own account, and
+// returns the game account it refers to, if any.
+func (s *AccountService) resolve(ref *account_types.AccountReference) (*GameAccount, error) {
+	err := s.ownAccount(nil)
+	if err != nil {
+		return nil, err
+	}
+	if ref.Handle != nil {
+		return s.ownGameAccount(uint64(ref.Handle.GetId()))
+	}
+	account := &s.sess.account
+	if (ref.Id != nil && uint64(ref.GetId()) != account.ID) ||
+		(ref.Email != nil && ref.GetEmail() != account.Email) ||
+		(ref.BattleTag != nil && ref.GetBattleTag() != account.BattleTag) {
+		return nil, Errorf(ErrorDenied, "AccountService: not the session's account: %s", ref.String())
+	}
+	return nil, nil
 }
 
 func (s *AccountService) GetGameAccount(body []byte) ([]byte, error) {
-	return nil, nyi
+	req := account_service.GameAccountBlobRequest{}
+	err := proto.Unmarshal(body, &req)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("req = %s", req.String())
+	gameAccount, err := s.ownGameAccount(uint64(req.GetGameAccount().GetId()))
+	if err != nil {
+		return nil, err
+	}
+	res := account_service.GetGameAccountResponse{
+		Blob: &account_types.GameAccountBlob{
+			GameAccount:     gameAccountHandle(gameAccount),
+			Name:            proto.String(s.sess.account.BattleTag),
+			Status:          proto.Uint32(0),
+			Flags:           proto.Uint64(uint64(gameAccount.Flags)),
+			CacheExpiration: proto.Uint64(Timestamp(time.Now().Add(accountCacheExpiration))),
+			Licenses:        licenses(licensesFor(s.sess.account.ID, gameAccount.ID)),
+		},
+	}
+	return proto.Marshal(&res)
 }
 
 func (s *AccountService) GetAccount(body []byte) ([]byte, error) {
-	return nil, nyi
+	req := account_service.GetAccountRequest{}
+	err := proto.Unmarshal(body, &req)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("req = %s", req.String())
+	_, err = s.resolve(req.GetRef())
+	if err != nil {
+		return nil, err
+	}
+	account := accountByID(s.sess.account.ID)
+	if account == nil {
+		return nil, Errorf(ErrorNotExists, "GetAccount: account %d is gone", s.sess.account.ID)
+	}
+	all := req.GetFetchAll()
+	res := account_service.GetAccountResponse{}
+	links := []*account_types.GameAccountLink{}
+	for _, gameAccount := range gameAccountsFor(account.ID, "") {
+		links = append(links, &account_types.GameAccountLink{
+			GameAccount: gameAccountHandle(&gameAccount),
+			Name:        proto.String(account.BattleTag),
+		})
+	}
+	if all || req.GetFetchBlob() {
+		res.Blob = &account_types.AccountBlob{
+			Id:              proto.Uint32(uint32(account.ID)),
+			Region:          proto.Uint32(account.PreferredRegion),
+			Email:           []string{account.Email},
+			Flags:           proto.Uint64(uint64(account.Flags)),
+			FullName:        proto.String(account.FullName),
+			Licenses:        licenses(licensesFor(account.ID, 0)),
+			AccountLinks:    links,
+			BattleTag:       proto.String(account.BattleTag),
+			CacheExpiration: proto.Uint64(Timestamp(time.Now().Add(accountCacheExpiration))),
+			Country:         proto.String(account.Country),
+			PreferredRegion: proto.Uint32(account.PreferredRegion),
+		}
+	}
+	if all || req.GetFetchId() {
+		res.Id = &account_types.AccountId{Id: proto.Uint32(uint32(account.ID))}
+	}
+	if all || req.GetFetchEmail() {
+		res.Email = []string{account.Email}
+	}
+	if all || req.GetFetchBattleTag() {
+		res.BattleTag = proto.String(account.BattleTag)
+	}
+	if all || req.GetFetchFullName() {
+		res.FullName = proto.String(account.FullName)
+	}
+	if all || req.GetFetchLinks() {
+		res.Links = links
+	}
+	return proto.Marshal(&res)
 }
 
+// CreateGameAccount gives the session's account another game account of a
+// program it hosts, in the region asked for or else the account's preferred
+// one.
 func (s *AccountService) CreateGameAccount(body []byte) ([]byte, error) {
-	return nil, nyi
+	req := account_service.CreateGameAccountRequest{}
+	err := proto.Unmarshal(body, &req)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("req = %s", req.String())
+	err = s.ownAccount(nil)
+	if err != nil {
+		return nil, err
+	}
+	account := &s.sess.account
+	if req.Account != nil && uint64(req.GetAccount().GetId()) != account.ID {
+		return nil, Errorf(ErrorDenied, "CreateGameAccount: not the session's account: %s", req.Account.String())
+	}
+	program := s.sess.program
+	if req.Program != nil {
+		program = FourCCString(req.GetProgram())
+	}
+	if _, ok := s.sess.server.gameServers[program]; !ok {
+		return nil, Errorf(ErrorInvalidArgs, "CreateGameAccount: unknown program %q", program)
+	}
+	region := account.preferredRegion()
+	if req.Region != nil {
+		region = regionName(req.GetRegion())
+		if len(region) == 0 {
+			return nil, Errorf(ErrorInvalidArgs, "CreateGameAccount: unknown region %d", req.GetRegion())
+		}
+	}
+	gameAccount := createGameAccount(account.ID, program, region)
+	log.Printf("account %d created %s game account %d", account.ID, program, gameAccount.ID)
+	if program == s.sess.program {
+		s.sess.gameAccounts = append(s.sess.gameAccounts, gameAccount)
+	}
+	return proto.Marshal(gameAccountHandle(&gameAccount))
 }
 
 func (s *AccountService) IsIgrAddress(body []byte) error {
@@ -130,12 +296,66 @@ func (s *AccountService) GetEBalance(body []byte) ([]byte, error) {
 	return nil, nyi
 }
 
+// Subscribe subscribes the client to state changes of its account or game
+// accounts.  The current state is sent to the client right after the response.
 func (s *AccountService) Subscribe(body []byte) ([]byte, error) {
-	return nil, nyi
+	req := account_service.SubscriptionUpdateRequest{}
+	err := proto.Unmarshal(body, &req)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("req = %s", req.String())
+	gameAccounts := []*GameAccount{}
+	subscribeAccount := false
+	for _, ref := range req.GetRef() {
+		gameAccount, err := s.resolve(ref)
+		if err != nil {
+			return nil, err
+		}
+		if gameAccount != nil {
+			gameAccounts = append(gameAccounts, gameAccount)
+		} else {
+			subscribeAccount = true
+		}
+	}
+	if subscribeAccount {
+		s.sess.accountSubscribed = true
+		s.sess.Post(func() {
+			s.sess.notifyAccountState(true)
+		})
+	}
+	for _, gameAccount := range gameAccounts {
+		gameAccount := gameAccount
+		s.sess.gameAccountSubscriptions[gameAccount.ID] = true
+		s.sess.Post(func() {
+			s.sess.notifyGameAccountState(gameAccount, true)
+		})
+	}
+	res := account_service.SubscriptionUpdateResponse{
+		Ref: req.GetRef(),
+	}
+	return proto.Marshal(&res)
 }
 
 func (s *AccountService) Unsubscribe(body []byte) error {
-	return nyi
+	req := account_service.SubscriptionUpdateRequest{}
+	err := proto.Unmarshal(body, &req)
+	if err != nil {
+		return err
+	}
+	log.Printf("req = %s", req.String())
+	for _, ref := range req.GetRef() {
+		gameAccount, err := s.resolve(ref)
+		if err != nil {
+			return err
+		}
+		if gameAccount != nil {
+			delete(s.sess.gameAccountSubscriptions, gameAccount.ID)
+		} else {
+			s.sess.accountSubscribed = false
+		}
+	}
+	return nil
 }
 
 func (s *AccountService) GetEBalanceRestrictions(body []byte) ([]byte, error) {
@@ -149,33 +369,93 @@ func (s *AccountService) GetAccountState(body []byte) ([]byte, error) {
 		return nil, err
 	}
 	log.Printf("req = %s", req.String())
-	opts := req.GetOptions()
-	res := account_service.GetAccountStateResponse{
-		State: &account_types.AccountState{},
+	err = s.ownAccount(req.EntityId)
+	if err != nil {
+		return nil, err
 	}
-	if opts.GetAllFields() || opts.GetFieldAccountLevelInfo() {
-		levelInfo := &account_types.AccountLevelInfo{}
-		levelInfo.PreferredRegion = proto.Uint32(1) // US
-		levelInfo.Country = proto.String("United States")
-		levelInfo.Licenses = make([]*account_types.AccountLicense, 1)
-		levelInfo.Licenses[0] = &account_types.AccountLicense{
-			Id: proto.Uint32(1),
-		}
-		res.State.AccountLevelInfo = levelInfo
+	account := accountByID(s.sess.account.ID)
+	if account == nil {
+		return nil, Errorf(ErrorNotExists, "GetAccountState: account %d is gone", s.sess.account.ID)
+	}
+	res := account_service.GetAccountStateResponse{
+		State: accountState(account, req.GetOptions()),
 	}
 	return proto.Marshal(&res)
 }
 
 func (s *AccountService) GetGameAccountState(body []byte) ([]byte, error) {
-	return nil, nyi
+	req := account_service.GetGameAccountStateRequest{}
+	err := proto.Unmarshal(body, &req)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("req = %s", req.String())
+	err = s.ownAccount(req.AccountId)
+	if err != nil {
+		return nil, err
+	}
+	gameAccount, err := s.ownGameAccountByEntityId(req.GetGameAccountId())
+	if err != nil {
+		return nil, err
+	}
+	res := account_service.GetGameAccountStateResponse{
+		State: gameAccountState(s.sess.account.ID, gameAccount, req.GetOptions()),
+	}
+	return proto.Marshal(&res)
 }
 
 func (s *AccountService) GetLicenses(body []byte) ([]byte, error) {
-	return nil, nyi
+	req := account_service.GetLicensesRequest{}
+	err := proto.Unmarshal(body, &req)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("req = %s", req.String())
+	res := account_service.GetLicensesResponse{}
+	target := req.GetTargetId()
+	if target.GetHigh() == BnetGameAccountEntityIDHi {
+		gameAccount, err := s.ownGameAccount(target.GetLow())
+		if err != nil {
+			return nil, err
+		}
+		if req.GetFetchGameAccountLicenses() {
+			res.Licenses = licenses(licensesFor(s.sess.account.ID, gameAccount.ID))
+		}
+	} else {
+		err = s.ownAccount(target)
+		if err != nil {
+			return nil, err
+		}
+		if req.GetFetchAccountLicenses() {
+			res.Licenses = licenses(licensesFor(s.sess.account.ID, 0))
+		}
+	}
+	return proto.Marshal(&res)
 }
 
+// GetGameTimeRemainingInfo reports no limit on play time, since stove has no
+// subscriptions or parental controls.
 func (s *AccountService) GetGameTimeRemainingInfo(body []byte) ([]byte, error) {
-	return nil, nyi
+	req := account_service.GetGameTimeRemainingInfoRequest{}
+	err := proto.Unmarshal(body, &req)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("req = %s", req.String())
+	err = s.ownAccount(req.AccountId)
+	if err != nil {
+		return nil, err
+	}
+	if req.GameAccountId != nil {
+		_, err = s.ownGameAccountByEntityId(req.GetGameAccountId())
+		if err != nil {
+			return nil, err
+		}
+	}
+	res := account_service.GetGameTimeRemainingInfoResponse{
+		GameTimeRemainingInfo: &account_types.GameTimeRemainingInfo{},
+	}
+	return proto.Marshal(&res)
 }
 
 func (s *AccountService) GetGameSessionInfo(body []byte) ([]byte, error) {
@@ -191,10 +471,241 @@ func (s *AccountService) GetGameSessionInfo(body []byte) ([]byte, error) {
 	return proto.Marshal(&res)
 }
 
+// GetCAISInfo reports how long the session has been playing.  There are no play
+// time limits, so the client never needs to be told to rest.
 func (s *AccountService) GetCAISInfo(body []byte) ([]byte, error) {
-	return nil, nyi
+	req := account_service.GetCAISInfoRequest{}
+	err := proto.Unmarshal(body, &req)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("req = %s", req.String())
+	err = s.ownAccount(req.EntityId)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	res := account_service.GetCAISInfoResponse{
+		CaisInfo: &account_types.CAIS{
+			PlayedMinutes: proto.Uint32(uint32(now.Sub(s.sess.startedPlaying) / time.Minute)),
+			RestedMinutes: proto.Uint32(0),
+			LastHeardTime: proto.Uint64(Timestamp(now)),
+		},
+	}
+	return proto.Marshal(&res)
 }
 
 func (s *AccountService) ForwardCacheExpire(body []byte) error {
 	return nyi
 }
+
+func gameAccountHandle(gameAccount *GameAccount) *account_types.GameAccountHandle {
+	return &account_types.GameAccountHandle{
+		Id:      proto.Uint32(uint32(gameAccount.ID)),
+		Program: proto.Uint32(FourCC(gameAccount.Game)),
+		Region:  proto.Uint32(regionIDs[gameAccount.Region]),
+	}
+}
+
+func licenses(rows []AccountLicense) []*account_types.AccountLicense {
+	res := []*account_types.AccountLicense{}
+	for _, row := range rows {
+		license := &account_types.AccountLicense{
+			Id: proto.Uint32(row.LicenseID),
+		}
+		if !row.Expires.IsZero() {
+			license.Expires = proto.Uint64(Timestamp(row.Expires))
+		}
+		res = append(res, license)
+	}
+	return res
+}
+
+// accountState returns the fields of an account's state picked by opts.
+func accountState(account *Account, opts *account_types.AccountFieldOptions) *account_types.AccountState {
+	all := opts.GetAllFields()
+	res := &account_types.AccountState{}
+	if all || opts.GetFieldAccountLevelInfo() {
+		res.AccountLevelInfo = &account_types.AccountLevelInfo{
+			Licenses:        licenses(licensesFor(account.ID, 0)),
+			Country:         proto.String(account.Country),
+			PreferredRegion: proto.Uint32(account.PreferredRegion),
+			FullName:        proto.String(account.FullName),
+			BattleTag:       proto.String(account.BattleTag),
+			Email:           proto.String(account.Email),
+		}
+	}
+	if all || opts.GetFieldPrivacyInfo() {
+		res.PrivacyInfo = &account_types.PrivacyInfo{}
+	}
+	if all || opts.GetFieldParentalControlInfo() {
+		res.ParentalControlInfo = &account_types.ParentalControlInfo{}
+	}
+	gameAccounts := gameAccountsFor(account.ID, "")
+	if all || opts.GetFieldGameLevelInfo() || opts.GetFieldGameStatus() {
+		programs := map[string]bool{}
+		for _, gameAccount := range gameAccounts {
+			if programs[gameAccount.Game] {
+				continue
+			}
+			programs[gameAccount.Game] = true
+			state := gameAccountState(account.ID, &gameAccount, &account_types.GameAccountFieldOptions{
+				FieldGameLevelInfo: proto.Bool(all || opts.GetFieldGameLevelInfo()),
+				FieldGameStatus:    proto.Bool(all || opts.GetFieldGameStatus()),
+			})
+			if state.GameLevelInfo != nil {
+				res.GameLevelInfo = append(res.GameLevelInfo, state.GameLevelInfo)
+			}
+			if state.GameStatus != nil {
+				res.GameStatus = append(res.GameStatus, state.GameStatus)
+			}
+		}
+	}
+	if all || opts.GetFieldGameAccounts() {
+		byRegion := map[uint32]*account_types.GameAccountList{}
+		for _, gameAccount := range gameAccounts {
+			handle := gameAccountHandle(&gameAccount)
+			list, ok := byRegion[handle.GetRegion()]
+			if !ok {
+				list = &account_types.GameAccountList{Region: handle.Region}
+				byRegion[handle.GetRegion()] = list
+				res.GameAccounts = append(res.GameAccounts, list)
+			}
+			list.Handle = append(list.Handle, handle)
+		}
+	}
+	return res
+}
+
+// gameAccountState returns the fields of a game account's state picked by opts.
+func gameAccountState(accountID uint64, gameAccount *GameAccount, opts *account_types.GameAccountFieldOptions) *account_types.GameAccountState {
+	all := opts.GetAllFields()
+	program := proto.Uint32(FourCC(gameAccount.Game))
+	res := &account_types.GameAccountState{}
+	if all || opts.GetFieldGameLevelInfo() {
+		res.GameLevelInfo = &account_types.GameLevelInfo{
+			Program:  program,
+			Licenses: licenses(licensesFor(accountID, gameAccount.ID)),
+		}
+	}
+	if all || opts.GetFieldGameTimeInfo() {
+		res.GameTimeInfo = &account_types.GameTimeInfo{
+			IsUnlimitedPlayTime: proto.Bool(true),
+		}
+	}
+	if all || opts.GetFieldGameStatus() {
+		res.GameStatus = &account_types.GameStatus{
+			Program: program,
+		}
+		if suspension := activeSuspension(accountID, time.Now()); suspension != nil {
+			res.GameStatus.IsBanned = proto.Bool(suspension.Expires.IsZero())
+			res.GameStatus.IsSuspended = proto.Bool(!suspension.Expires.IsZero())
+			res.GameStatus.SuspensionExpires = proto.Uint64(Timestamp(suspension.Expires))
+		}
+	}
+	return res
+}
+
+// notifyAccountState sends the client the state of its account, if it's
+// subscribed.  It must be called on the event loop.
+func (s *Session) notifyAccountState(subscriptionCompleted bool) {
+	if !s.accountSubscribed {
+		return
+	}
+	account := accountByID(s.account.ID)
+	if account == nil {
+		return
+	}
+	notify := s.ImportedService("bnet.protocol.account.AccountNotify")
+	if notify == nil {
+		return
+	}
+	notify.(*AccountNotifyService).NotifyAccountStateUpdated(&account_service.AccountStateNotification{
+		State: accountState(account, &account_types.AccountFieldOptions{
+			AllFields: proto.Bool(true),
+		}),
+		SubscriptionCompleted: proto.Bool(subscriptionCompleted),
+	})
+}
+
+// notifyGameAccountState sends the client the state of one of its game
+// accounts, if it's subscribed.  It must be called on the event loop.
+func (s *Session) notifyGameAccountState(gameAccount *GameAccount, subscriptionCompleted bool) {
+	if !s.gameAccountSubscriptions[gameAccount.ID] {
+		return
+	}
+	notify := s.ImportedService("bnet.protocol.account.AccountNotify")
+	if notify == nil {
+		return
+	}
+	notify.(*AccountNotifyService).NotifyGameAccountStateUpdated(&account_service.GameAccountStateNotification{
+		State: gameAccountState(s.account.ID, gameAccount, &account_types.GameAccountFieldOptions{
+			AllFields: proto.Bool(true),
+		}),
+		SubscriptionCompleted: proto.Bool(subscriptionCompleted),
+	})
+}
+
+// NotifyAccountUpdated pushes the state of an account and its game accounts,
+// as now stored in the db, to the account's client if it's subscribed.  Call
+// it after changing the account in the db.
+func (s *Server) NotifyAccountUpdated(accountID uint64) {
+	sess := s.SessionForAccount(accountID)
+	if sess == nil {
+		return
+	}
+	sess.Post(func() {
+		sess.notifyAccountState(false)
+		for _, gameAccount := range gameAccountsFor(accountID, "") {
+			sess.notifyGameAccountState(&gameAccount, false)
+		}
+	})
+}
+
+type AccountNotifyServiceBinder struct{}
+
+func (AccountNotifyServiceBinder) Bind(sess *Session) Service {
+	return &AccountNotifyService{sess}
+}
+
+// The AccountNotify service sends account state changes to subscribed clients.
+type AccountNotifyService struct {
+	sess *Session
+}
+
+func (s *AccountNotifyService) Name() string {
+	return "bnet.protocol.account.AccountNotify"
+}
+
+func (s *AccountNotifyService) Methods() []string {
+	res := make([]string, 5)
+	res[1] = "NotifyAccountStateUpdated"
+	res[2] = "NotifyGameAccountStateUpdated"
+	res[3] = "NotifyGameAccountsUpdated"
+	res[4] = "NotifyGameSessionUpdated"
+	return res
+}
+
+func (s *AccountNotifyService) Invoke(method int, body []byte) (resp []byte, err error) {
+	return nil, Errorf(ErrorRPCInvalidService, "AccountNotify is a client export, not a server export")
+}
+
+func (s *AccountNotifyService) NotifyAccountStateUpdated(n *account_service.AccountStateNotification) {
+	s.notify(1, n)
+}
+
+func (s *AccountNotifyService) NotifyGameAccountStateUpdated(n *account_service.GameAccountStateNotification) {
+	s.notify(2, n)
+}
+
+func (s *AccountNotifyService) notify(method int, n proto.Message) {
+	buf, err := proto.Marshal(n)
+	if err != nil {
+		log.Panicf("error: AccountNotifyService: marshal: %v", err)
+	}
+	header := s.sess.MakeRequestHeader(s, method, len(buf))
+	err = s.sess.QueuePacket(header, buf)
+	if err != nil {
+		log.Printf("error: AccountNotifyService: %v", err)
+	}
+}
@@ -0,0 +1,191 @@
+package bnet
+
+import (
+	"github.com/HearthSim/hs-proto-go/bnet/account_service"
+	"github.com/HearthSim/hs-proto-go/bnet/account_types"
+	"github.com/golang/protobuf/proto"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestGameAccountHandle(t *testing.T) {
+	handle := gameAccountHandle(&GameAccount{ID: 42, Game: "WTCG", Region: "EU"})
+	if handle.GetId() != 42 || handle.GetProgram() != EntityIDGamePegasus || handle.GetRegion() != 2 {
+		t.Errorf("bad handle: %s", handle.String())
+	}
+}
+
+func TestLicenses(t *testing.T) {
+	expires := time.Unix(1500000000, 0)
+	res := licenses([]AccountLicense{
+		{LicenseID: 1},
+		{LicenseID: 2, Expires: expires},
+	})
+	if len(res) != 2 {
+		t.Fatalf("expected 2 licenses, got %d", len(res))
+	}
+	if res[0].GetId() != 1 || res[0].Expires != nil {
+		t.Errorf("bad license: %s", res[0].String())
+	}
+	if res[1].GetId() != 2 || res[1].GetExpires() != 1500000000*1000000 {
+		t.Errorf("bad expiring license: %s", res[1].String())
+	}
+}
+
+func TestAccountAccess(t *testing.T) {
+	serv := NewServer()
+	_, conn := net.Pipe()
+	sess := NewSession(serv, conn)
+	defer sess.Disconnect()
+	sess.account = Account{ID: 1, Email: "player@example.com", BattleTag: "Player#1234"}
+	service := &AccountService{sess}
+	marshal := func(req proto.Message) []byte {
+		buf, err := proto.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf
+	}
+	getAccount := func(ref *account_types.AccountReference) error {
+		_, err := service.GetAccount(marshal(&account_service.GetAccountRequest{Ref: ref}))
+		return err
+	}
+	getAccountState := func(id uint64) error {
+		_, err := service.GetAccountState(marshal(&account_service.GetAccountStateRequest{
+			EntityId: EntityId(BnetAccountEntityIDHi, id),
+		}))
+		return err
+	}
+	getGameAccountState := func(accountID uint64, gameAccountHi uint64) error {
+		_, err := service.GetGameAccountState(marshal(&account_service.GetGameAccountStateRequest{
+			AccountId:     EntityId(BnetAccountEntityIDHi, accountID),
+			GameAccountId: EntityId(gameAccountHi, 101),
+		}))
+		return err
+	}
+	getLicenses := func(target uint64) error {
+		_, err := service.GetLicenses(marshal(&account_service.GetLicensesRequest{
+			TargetId: EntityId(BnetAccountEntityIDHi, target),
+		}))
+		return err
+	}
+	subscribe := func(ref *account_types.AccountReference) error {
+		_, err := service.Subscribe(marshal(&account_service.SubscriptionUpdateRequest{
+			Ref: []*account_types.AccountReference{ref},
+		}))
+		return err
+	}
+	expectCode := func(what string, err error, code uint32) {
+		if e, ok := err.(*Error); !ok || e.Code != code {
+			t.Errorf("%s: expected error %d, got %v", what, code, err)
+		}
+	}
+
+	// Nothing may be looked up before logging on.
+	expectCode("GetAccount before logon", getAccount(&account_types.AccountReference{}), ErrorNoAuth)
+	expectCode("GetAccountState before logon", getAccountState(1), ErrorNoAuth)
+	expectCode("GetLicenses before logon", getLicenses(1), ErrorNoAuth)
+
+	for _, state := range []int{StateConnected, StateLoggingIn, StateReady} {
+		if err := sess.Transition(state); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Clients may only look up their own account and game accounts.
+	expectCode("GetAccount by another id", getAccount(&account_types.AccountReference{
+		Id: proto.Uint32(2),
+	}), ErrorDenied)
+	expectCode("GetAccount by another email", getAccount(&account_types.AccountReference{
+		Email: proto.String("other@example.com"),
+	}), ErrorDenied)
+	expectCode("GetAccount by another BattleTag", getAccount(&account_types.AccountReference{
+		BattleTag: proto.String("Other#1234"),
+	}), ErrorDenied)
+	expectCode("GetAccountState of another account", getAccountState(2), ErrorDenied)
+	expectCode("GetGameAccountState of another account",
+		getGameAccountState(2, BnetGameAccountEntityIDHi), ErrorDenied)
+	expectCode("GetGameAccountState of a bad game account id",
+		getGameAccountState(1, BnetAccountEntityIDHi), ErrorInvalidArgs)
+	expectCode("GetLicenses of another account", getLicenses(2), ErrorDenied)
+	expectCode("Subscribe to another account", subscribe(&account_types.AccountReference{
+		Id: proto.Uint32(2),
+	}), ErrorDenied)
+	expectCode("Subscribe to a game account the account doesn't own", subscribe(&account_types.AccountReference{
+		Handle: &account_types.GameAccountHandle{
+			Id:      proto.Uint32(999999),
+			Program: proto.Uint32(EntityIDGamePegasus),
+			Region:  proto.Uint32(1),
+		},
+	}), ErrorNotExists)
+	if sess.accountSubscribed || len(sess.gameAccountSubscriptions) != 0 {
+		t.Errorf("subscribed to another account's state")
+	}
+}
+
+func TestCreateGameAccount(t *testing.T) {
+	serv := NewServer()
+	serv.RegisterGameServer("WTCG", nil)
+	_, conn := net.Pipe()
+	sess := NewSession(serv, conn)
+	defer sess.Disconnect()
+	sess.account = *newFriendsAccount(t, "Creator")
+	sess.program = "WTCG"
+	for _, state := range []int{StateConnected, StateLoggingIn, StateReady} {
+		if err := sess.Transition(state); err != nil {
+			t.Fatal(err)
+		}
+	}
+	service := &AccountService{sess}
+	create := func(req *account_service.CreateGameAccountRequest) (*account_types.GameAccountHandle, error) {
+		body, err := service.CreateGameAccount(mustMarshal(t, req))
+		if err != nil {
+			return nil, err
+		}
+		res := &account_types.GameAccountHandle{}
+		if err := proto.Unmarshal(body, res); err != nil {
+			t.Fatal(err)
+		}
+		return res, nil
+	}
+
+	handle, err := create(&account_service.CreateGameAccountRequest{
+		Region:  proto.Uint32(regionIDs["EU"]),
+		Program: proto.Uint32(EntityIDGamePegasus),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if handle.GetRegion() != regionIDs["EU"] || handle.GetProgram() != EntityIDGamePegasus {
+		t.Errorf("bad handle: %s", handle.String())
+	}
+	// A game account created without a region is in the preferred one.
+	if handle, err = create(&account_service.CreateGameAccountRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if region := regionIDs[sess.account.preferredRegion()]; handle.GetRegion() != region {
+		t.Errorf("expected region %d, got %s", region, handle.String())
+	}
+	if n := len(gameAccountsFor(sess.account.ID, "WTCG")); n != 2 {
+		t.Errorf("expected 2 game accounts, got %d", n)
+	}
+	if len(sess.gameAccounts) != 2 {
+		t.Errorf("the session doesn't know about its new game accounts: %v", sess.gameAccounts)
+	}
+
+	if _, err = create(&account_service.CreateGameAccountRequest{
+		Region: proto.Uint32(99),
+	}); ErrorCode(err) != ErrorInvalidArgs {
+		t.Errorf("created a game account in an unknown region: %v", err)
+	}
+	if _, err = create(&account_service.CreateGameAccountRequest{
+		Program: proto.Uint32(FourCC("WoW")),
+	}); ErrorCode(err) != ErrorInvalidArgs {
+		t.Errorf("created a game account of an unknown program: %v", err)
+	}
+	if _, err = create(&account_service.CreateGameAccountRequest{
+		Account: &account_types.AccountId{Id: proto.Uint32(uint32(sess.account.ID + 1))},
+	}); ErrorCode(err) != ErrorDenied {
+		t.Errorf("created a game account for another account: %v", err)
+	}
+}
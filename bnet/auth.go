@@ -8,6 +8,10 @@ import (
 	"time"
 )
 
+// How long a session admitted by the logon queue has to finish logging on
+// before it is disconnected, so that it doesn't hold its slot forever.
+const logonTimeout = 2 * time.Minute
+
 type AuthServerServiceBinder struct{}
 
 func (AuthServerServiceBinder) Bind(sess *Session) Service {
@@ -17,15 +21,20 @@ func (AuthServerServiceBinder) Bind(sess *Session) Service {
 }
 
 // The AuthServer service handles Logon requests.  This implementation does not
-// use the Module system but instead relies on a pre-shared WebAuth token to
-// authenticate the client.
+// use the Module system but instead relies on WebAuth credentials, which are
+// checked by the server's Authenticator.
 type AuthServerService struct {
 	sess *Session
 
-	program  string
-	email    string
-	loggedIn bool
-	client   *AuthClientService
+	program string
+	email   string
+	// The error code of the logon result; ErrorOK once logged in.
+	logonError uint32
+	client     *AuthClientService
+	// The session's place in the logon queue, if it has joined it.
+	queueEntry *queuedLogon
+	// The game account chosen by the temp cookie logged on with, if any.
+	cookieGameAccountID uint64
 }
 
 func (s *AuthServerService) Name() string {
@@ -62,8 +71,7 @@ func (s *AuthServerService) Invoke(method int, body []byte) (resp []byte, err er
 	case 7:
 		return []byte{}, s.VerifyWebCredentials(body)
 	default:
-		log.Panicf("error: AuthServerService.Invoke: unknown method %v", method)
-		return
+		return nil, Errorf(ErrorRPCInvalidMethod, "AuthServerService.Invoke: unknown method %v", method)
 	}
 }
 
@@ -78,8 +86,13 @@ func (s *AuthServerService) Logon(body []byte) error {
 	log.Printf("logon request from %s", req.GetEmail())
 	s.email = string(req.GetEmail())
 	s.client = s.sess.ImportedService("bnet.protocol.authentication.AuthenticationClient").(*AuthClientService)
-	s.FinishQueue()
-	s.sess.Transition(StateLoggingIn)
+	if state := s.sess.State(); !CanTransition(state, StateLoggingIn) {
+		return Errorf(ErrorRPCProtocolError, "can't log on from state %s", stateName(state))
+	}
+	if s.queueEntry != nil {
+		return Errorf(ErrorRPCProtocolError, "Logon: already in the logon queue")
+	}
+	s.queueEntry = s.sess.server.logonQueue.join(s.sess, s.UpdateQueue, s.FinishQueue)
 	return nil
 }
 
@@ -98,15 +111,63 @@ func (s *AuthServerService) SelectGameAccount_DEPRECATED(body []byte) error {
 		return err
 	}
 	log.Printf("req = %s", req.String())
-	return nil
+	return s.selectGameAccount(&req)
 }
 
+// GenerateTempCookie returns a cookie which the client may log on with once,
+// in place of its WebCredentials, to play as the same game account.
 func (s *AuthServerService) GenerateTempCookie(body []byte) ([]byte, error) {
-	return nil, nyi
+	req := authentication_service.GenerateTempCookieRequest{}
+	err := proto.Unmarshal(body, &req)
+	if err != nil {
+		return nil, err
+	}
+	if s.sess.State() != StateReady {
+		return nil, Errorf(ErrorNoAuth, "GenerateTempCookie: not logged on")
+	}
+	cookie, err := s.sess.server.tempCookies.issue(s.sess.account, s.sess.GameAccountID())
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(&authentication_service.GenerateTempCookieResponse{
+		Cookie: []byte(cookie),
+	})
 }
 
 func (s *AuthServerService) SelectGameAccount(body []byte) error {
-	return nyi
+	req := authentication_service.SelectGameAccountRequest{}
+	err := proto.Unmarshal(body, &req)
+	if err != nil {
+		return err
+	}
+	log.Printf("req = %s", req.String())
+	return s.selectGameAccount(req.GetGameAccount())
+}
+
+// selectGameAccount switches the session to another of its account's game
+// accounts.  Once the game server is connected, the session is stuck with the
+// game account it's playing as.
+func (s *AuthServerService) selectGameAccount(id *entity.EntityId) error {
+	if s.sess.State() != StateReady {
+		return Errorf(ErrorNoAuth, "SelectGameAccount: not logged on")
+	}
+	if id.GetHigh() != BnetGameAccountEntityIDHi {
+		return Errorf(ErrorInvalidArgs, "SelectGameAccount: bad entity id %s", id.String())
+	}
+	for _, gameAccount := range s.sess.gameAccounts {
+		if uint64(gameAccount.ID) != id.GetLow() {
+			continue
+		}
+		if s.sess.gameServerConnected && s.sess.GameAccountID() != id.GetLow() {
+			return Errorf(ErrorInProgress, "SelectGameAccount: already playing as game account %d",
+				s.sess.GameAccountID())
+		}
+		s.sess.server.sessions.selectGameAccount(s.sess, id.GetLow())
+		log.Printf("account %d selected game account %d", s.sess.account.ID, id.GetLow())
+		return nil
+	}
+	return Errorf(ErrorNotExists, "SelectGameAccount: account %d has no game account %d",
+		s.sess.account.ID, id.GetLow())
 }
 
 func (s *AuthServerService) VerifyWebCredentials(body []byte) error {
@@ -116,35 +177,76 @@ func (s *AuthServerService) VerifyWebCredentials(body []byte) error {
 		return err
 	}
 	log.Printf("req = %s", req.String())
-	s.loggedIn = false
-	account := []Account{}
-	db.Where("email = ? and web_credential = ?", string(s.email), string(req.GetWebCredentials())).First(&account)
-	if len(account) != 0 {
-		s.sess.account = account[0]
+	var account *Account
+	if cookie, ok := s.sess.server.tempCookies.redeem(s.email, req.GetWebCredentials()); ok {
+		account = &cookie.account
+		s.cookieGameAccountID = cookie.gameAccountID
+	} else {
+		account, err = s.sess.server.authenticator.Authenticate(s.email, req.GetWebCredentials())
+	}
+	s.logonError = ErrorCode(err)
+	if err != nil {
+		log.Printf("logon failed for %s: %v", s.email, err)
+	} else {
+		s.sess.account = *account
+		s.sess.sessionKey = NewSessionKey()
 		log.Printf("account %s (BattleTag: %s) authorized", s.sess.account.Email, s.sess.account.BattleTag)
-		s.loggedIn = true
 	}
 	return s.CompleteLogin()
 }
 
 func (s *AuthServerService) CompleteLogin() error {
+	if s.logonError == ErrorOK {
+		if suspension := activeSuspension(s.sess.account.ID, time.Now()); suspension != nil {
+			log.Printf("logon refused: %s", suspension)
+			s.logonError = suspension.errorCode()
+		}
+	}
+	if s.logonError == ErrorOK {
+		s.sess.program = s.program
+		s.sess.gameAccounts = gameAccountsFor(s.sess.account.ID, s.program)
+		_, isGame := s.sess.server.gameServers[s.program]
+		if isGame && len(s.sess.gameAccounts) == 0 {
+			// Accounts added since the db was migrated start out without
+			// any.
+			log.Printf("creating a %s game account for account %d", s.program, s.sess.account.ID)
+			s.sess.gameAccounts = []GameAccount{createGameAccount(s.sess.account.ID, s.program,
+				s.sess.account.preferredRegion())}
+		}
+	}
+	state := StateAuthenticationFailed
+	if s.logonError == ErrorOK {
+		state = StateReady
+	} else {
+		// Don't make the sessions in line wait on a failed logon; another
+		// attempt has to queue again.
+		s.leaveQueue()
+	}
+	err := s.sess.Transition(state)
+	if err != nil {
+		return err
+	}
 	res := authentication_service.LogonResult{}
-	if !s.loggedIn {
-		res.ErrorCode = proto.Uint32(ErrorNoAuth)
+	if s.logonError != ErrorOK {
+		res.ErrorCode = proto.Uint32(s.logonError)
 	} else {
 		res.ErrorCode = proto.Uint32(ErrorOK)
-		// TODO: Make this data real.  ConnectGameServer needs to return the
-		// GameAccount EntityId.
 		res.Account = EntityId(BnetAccountEntityIDHi, s.sess.account.ID)
-		res.GameAccount = make([]*entity.EntityId, 1)
-		res.GameAccount[0] = EntityId(BnetGameAccountEntityIDHi, s.sess.account.ID)
+		for _, gameAccount := range s.sess.gameAccounts {
+			res.GameAccount = append(res.GameAccount,
+				EntityId(BnetGameAccountEntityIDHi, uint64(gameAccount.ID)))
+			// Play as the oldest game account unless told otherwise, either
+			// by a temp cookie or later by SelectGameAccount.
+			if s.sess.gameAccountID == 0 ||
+				uint64(gameAccount.ID) == s.cookieGameAccountID {
+				s.sess.gameAccountID = uint64(gameAccount.ID)
+			}
+		}
 		res.ConnectedRegion = proto.Uint32(0x5553) // 'US'
+		res.SessionKey = s.sess.sessionKey
 
-		if s.program == "WTCG" {
-			s.sess.server.ConnectGameServer(s.sess, s.program)
-			go s.sess.HandleNotifications()
-		}
 		s.sess.startedPlaying = time.Now()
+		s.sess.server.sessions.add(s.sess)
 	}
 	resBody, err := proto.Marshal(&res)
 	if err != nil {
@@ -158,20 +260,45 @@ func (s *AuthServerService) CompleteLogin() error {
 	return nil
 }
 
-func (s *AuthServerService) FinishQueue() {
+// UpdateQueue tells the client its position in the logon queue, and roughly
+// how long it will have to wait.
+func (s *AuthServerService) UpdateQueue(position int, eta time.Duration) {
 	update := authentication_service.LogonQueueUpdateRequest{}
-	update.Position = proto.Uint32(0)
-	update.EstimatedTime = proto.Uint64(0)
-	update.EtaDeviationInSec = proto.Uint64(0)
+	update.Position = proto.Uint32(uint32(position))
+	update.EstimatedTime = proto.Uint64(uint64(eta / time.Second))
+	update.EtaDeviationInSec = proto.Uint64(uint64(eta / time.Second / 2))
 	updateBody, err := proto.Marshal(&update)
 	if err != nil {
-		log.Panicf("FinishQueue: %v", err)
+		log.Panicf("UpdateQueue: %v", err)
 	}
 	updateHeader := s.sess.MakeRequestHeader(s.client, 12, len(updateBody))
 	s.sess.QueuePacket(updateHeader, updateBody)
+}
 
+// FinishQueue lets the client out of the logon queue once it has a slot, and
+// starts logging it in.
+func (s *AuthServerService) FinishQueue() {
+	s.UpdateQueue(0, 0)
 	endHeader := s.sess.MakeRequestHeader(s.client, 13, 0)
 	s.sess.QueuePacket(endHeader, nil)
+	err := s.sess.Transition(StateLoggingIn)
+	if err != nil {
+		log.Printf("error: FinishQueue: %v", err)
+	}
+	time.AfterFunc(logonTimeout, func() {
+		if s.sess.State() == StateLoggingIn {
+			log.Printf("logon of %s timed out", s.email)
+			s.sess.Disconnect()
+		}
+	})
+}
+
+// leaveQueue gives up the session's slot in the logon queue, if it holds one.
+func (s *AuthServerService) leaveQueue() {
+	if s.queueEntry != nil {
+		s.sess.server.logonQueue.leave(s.queueEntry)
+		s.queueEntry = nil
+	}
 }
 
 type AuthClientServiceBinder struct{}
@@ -208,6 +335,5 @@ func (s *AuthClientService) Methods() []string {
 }
 
 func (s *AuthClientService) Invoke(method int, body []byte) (resp []byte, err error) {
-	log.Panicf("AuthClientService is a client export, not a server export")
-	return
+	return nil, Errorf(ErrorRPCInvalidService, "AuthClientService is a client export, not a server export")
 }
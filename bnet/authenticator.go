@@ -0,0 +1,153 @@
+package bnet
+
+import (
+	"bufio"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"os"
+	"strings"
+)
+
+// An Authenticator checks the credentials a client logs on with.
+type Authenticator interface {
+	// Authenticate returns the account the credentials log on as.  A failed
+	// logon returns an *Error with the code to send in the LogonResult, such
+	// as ErrorNoAuth.
+	Authenticate(email string, credentials []byte) (*Account, error)
+}
+
+// NewAuthenticator returns the authenticator for a backend named in the config:
+// "token", "bcrypt" or "htpasswd".  Only htpasswd uses the password file.
+func NewAuthenticator(backend, passwordFile string) (Authenticator, error) {
+	switch backend {
+	case "", "token":
+		return TokenAuthenticator{}, nil
+	case "bcrypt":
+		return BcryptAuthenticator{}, nil
+	case "htpasswd":
+		return NewHtpasswdAuthenticator(passwordFile)
+	}
+	return nil, fmt.Errorf("unknown authenticator backend: %s", backend)
+}
+
+var errNoAuth = Errorf(ErrorNoAuth, "invalid credentials")
+
+func accountByEmail(email string) (*Account, error) {
+	account := []Account{}
+	db.Where("email = ?", email).First(&account)
+	if len(account) == 0 {
+		return nil, errNoAuth
+	}
+	return &account[0], nil
+}
+
+// A TokenAuthenticator accepts the web credential token stored with the account
+// in the bnet db.
+type TokenAuthenticator struct{}
+
+func (TokenAuthenticator) Authenticate(email string, credentials []byte) (*Account, error) {
+	account := []Account{}
+	db.Where("email = ? and web_credential = ?", email, string(credentials)).First(&account)
+	if len(account) == 0 {
+		return nil, errNoAuth
+	}
+	return &account[0], nil
+}
+
+// A BcryptAuthenticator accepts the account's password, checked against the
+// bcrypt hash stored with the account in the bnet db.
+type BcryptAuthenticator struct{}
+
+func (BcryptAuthenticator) Authenticate(email string, credentials []byte) (*Account, error) {
+	account, err := accountByEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	if len(account.PasswordHash) == 0 ||
+		bcrypt.CompareHashAndPassword([]byte(account.PasswordHash), credentials) != nil {
+		return nil, errNoAuth
+	}
+	return account, nil
+}
+
+// HashPassword returns the bcrypt hash to store as an account's PasswordHash.
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// SetPassword stores the hash of a new password with the account with the
+// given email, for BcryptAuthenticator to check.
+func SetPassword(email, password string) error {
+	if len(password) == 0 {
+		return fmt.Errorf("the password is empty")
+	}
+	account, err := accountByEmail(email)
+	if err != nil {
+		return fmt.Errorf("no account with email %s", email)
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	return db.Model(account).Update("password_hash", hash).Error
+}
+
+// An HtpasswdAuthenticator accepts passwords listed in a static file of
+// email:hash lines, as written by htpasswd -B.  Only bcrypt hashes are
+// supported.  The accounts themselves still come from the bnet db.
+type HtpasswdAuthenticator struct {
+	hashes map[string][]byte
+}
+
+func NewHtpasswdAuthenticator(path string) (*HtpasswdAuthenticator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	hashes, err := parseHtpasswd(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &HtpasswdAuthenticator{hashes}, nil
+}
+
+func parseHtpasswd(r io.Reader) (map[string][]byte, error) {
+	res := map[string][]byte{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || text[0] == '#' {
+			continue
+		}
+		i := strings.LastIndex(text, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("line %d: expected email:hash", line)
+		}
+		hash := []byte(text[i+1:])
+		if _, err := bcrypt.Cost(hash); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		res[text[:i]] = hash
+	}
+	return res, scanner.Err()
+}
+
+// verify checks a password against the file, without touching the db.
+func (a *HtpasswdAuthenticator) verify(email string, password []byte) error {
+	hash, ok := a.hashes[email]
+	if !ok || bcrypt.CompareHashAndPassword(hash, password) != nil {
+		return errNoAuth
+	}
+	return nil
+}
+
+func (a *HtpasswdAuthenticator) Authenticate(email string, credentials []byte) (*Account, error) {
+	err := a.verify(email, credentials)
+	if err != nil {
+		return nil, err
+	}
+	return accountByEmail(email)
+}
@@ -0,0 +1,73 @@
+package bnet
+
+import (
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+	"testing"
+)
+
+func TestHtpasswd(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := fmt.Sprintf("# stove users\n\nplayer@example.com:%s\n", hash)
+	hashes, err := parseHtpasswd(strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &HtpasswdAuthenticator{hashes}
+	for i, x := range []struct {
+		Email    string
+		Password string
+		Code     uint32
+	}{
+		{"player@example.com", "hunter2", ErrorOK},
+		{"player@example.com", "hunter3", ErrorNoAuth},
+		{"other@example.com", "hunter2", ErrorNoAuth},
+		{"", "", ErrorNoAuth},
+	} {
+		code := ErrorCode(a.verify(x.Email, []byte(x.Password)))
+		if code != x.Code {
+			t.Errorf("case %d: expected error code %d, got %d", i, x.Code, code)
+		}
+	}
+
+	for _, bad := range []string{
+		"no separator\n",
+		":" + string(hash) + "\n",
+		"player@example.com:{SHA}plaintext\n",
+	} {
+		if _, err := parseHtpasswd(strings.NewReader(bad)); err == nil {
+			t.Errorf("parsed bad htpasswd line %q", bad)
+		}
+	}
+}
+
+func TestNewAuthenticator(t *testing.T) {
+	for _, backend := range []string{"", "token", "bcrypt"} {
+		if _, err := NewAuthenticator(backend, ""); err != nil {
+			t.Errorf("%q: %v", backend, err)
+		}
+	}
+	if _, err := NewAuthenticator("plaintext", ""); err == nil {
+		t.Errorf("unknown backend accepted")
+	}
+	if _, err := NewAuthenticator("htpasswd", "does/not/exist"); err == nil {
+		t.Errorf("missing password file accepted")
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	hash, err := HashPassword("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte("hunter2")) != nil {
+		t.Errorf("hash doesn't match its password")
+	}
+	if err := SetPassword("player@example.com", ""); err == nil {
+		t.Errorf("set an empty password")
+	}
+}
@@ -37,16 +37,17 @@ func (s *ChallengeNotifyService) Methods() []string {
 }
 
 func (s *ChallengeNotifyService) Invoke(method int, body []byte) (resp []byte, err error) {
-	log.Panicf("ChallengeNotify is a client export, not a server export")
-	return
+	return nil, Errorf(ErrorRPCInvalidService, "ChallengeNotify is a client export, not a server export")
 }
 
 func (s *ChallengeNotifyService) Run() {
-	s.sess.WaitForTransition(StateLoggingIn)
+	if !s.sess.WaitForTransition(StateLoggingIn) {
+		return
+	}
 	log.Println("ChallengeNotify received LoggingIn event")
 	extChallengeReq, err := proto.Marshal(&challenge_service.ChallengeExternalRequest{
 		PayloadType: proto.String("web_auth_url"),
-		Payload:     []byte("http://hearthsim.info"),
+		Payload:     []byte(s.sess.server.webAuthURL),
 	})
 	if err != nil {
 		log.Panicf("error: ChallengeNotify.Run: %v", err)
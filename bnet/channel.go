@@ -2,6 +2,9 @@ package bnet
 
 import (
 	"github.com/HearthSim/hs-proto-go/bnet/channel_invitation_service"
+	"github.com/HearthSim/hs-proto-go/bnet/channel_invitation_types"
+	"github.com/HearthSim/hs-proto-go/bnet/channel_service"
+	"github.com/HearthSim/hs-proto-go/bnet/invitation_types"
 	"github.com/golang/protobuf/proto"
 	"log"
 )
@@ -65,11 +68,12 @@ func (s *ChannelInvitationService) Invoke(method int, body []byte) (resp []byte,
 	case 11:
 		return s.ListChannelCount(body)
 	default:
-		log.Panicf("error: ChannelInvitationService.Invoke: unknown method %v", method)
-		return
+		return nil, Errorf(ErrorRPCInvalidMethod, "ChannelInvitationService.Invoke: unknown method %v", method)
 	}
 }
 
+// Subscribe sends the client the channel invitations it has received, and
+// then each invitation it receives until it unsubscribes.
 func (s *ChannelInvitationService) Subscribe(body []byte) ([]byte, error) {
 	req := channel_invitation_service.SubscribeRequest{}
 	err := proto.Unmarshal(body, &req)
@@ -77,52 +81,219 @@ func (s *ChannelInvitationService) Subscribe(body []byte) ([]byte, error) {
 		return nil, err
 	}
 	log.Printf("req = %s", req.String())
-	res := channel_invitation_service.SubscribeResponse{}
-	resBuf, err := proto.Marshal(&res)
-	if err != nil {
-		return nil, err
+	if s.sess.State() != StateReady {
+		return nil, Errorf(ErrorNoAuth, "ChannelInvitationService: not logged on")
 	}
-	return resBuf, nil
+	s.sess.channelInvitationsSubscribed = true
+	res := channel_invitation_service.SubscribeResponse{
+		ReceivedInvitation: s.sess.server.channels.receivedInvitations(s.sess),
+	}
+	return proto.Marshal(&res)
 }
 
 func (s *ChannelInvitationService) Unsubscribe(body []byte) error {
-	return nyi
+	req := channel_invitation_service.UnsubscribeRequest{}
+	err := proto.Unmarshal(body, &req)
+	if err != nil {
+		return err
+	}
+	log.Printf("req = %s", req.String())
+	s.sess.channelInvitationsSubscribed = false
+	return nil
 }
 
+// SendInvitation invites an online friend to join a channel the client is a
+// member of.
 func (s *ChannelInvitationService) SendInvitation(body []byte) ([]byte, error) {
-	return nil, nyi
+	req := invitation_types.SendInvitationRequest{}
+	err := proto.Unmarshal(body, &req)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("req = %s", req.String())
+	if s.sess.State() != StateReady {
+		return nil, Errorf(ErrorNoAuth, "ChannelInvitationService: not logged on")
+	}
+	ext, err := proto.GetExtension(req.GetParams(), channel_invitation_types.E_ChannelInvitationParams_ChannelParams)
+	if err != nil {
+		return nil, Errorf(ErrorInvalidArgs, "SendInvitation: no channel params: %v", err)
+	}
+	params := ext.(*channel_invitation_types.ChannelInvitationParams)
+	targetAccountID := accountIDForEntity(req.GetTargetId())
+	if targetAccountID == 0 || !areFriends(s.sess.account.ID, targetAccountID) {
+		return nil, Errorf(ErrorFriendsFriendshipDoesNotExist, "SendInvitation: %d isn't friends with %s",
+			s.sess.account.ID, req.GetTargetId().String())
+	}
+	target := s.sess.server.sessionForEntity(req.GetTargetId())
+	if target == nil {
+		return nil, Errorf(ErrorNotExists, "SendInvitation: %s isn't online", req.GetTargetId().String())
+	}
+	invitation, err := s.sess.server.channels.invite(s.sess, target, params, req.GetParams().GetInvitationMessage())
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(&invitation_types.SendInvitationResponse{
+		Invitation: invitation,
+	})
 }
 
+// AcceptInvitation adds the client to the channel it was invited to.
 func (s *ChannelInvitationService) AcceptInvitation(body []byte) ([]byte, error) {
-	return nil, nyi
+	req := channel_invitation_service.AcceptInvitationRequest{}
+	err := proto.Unmarshal(body, &req)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("req = %s", req.String())
+	objectID, err := s.sess.server.channels.accept(s.sess, req.GetInvitationId(), req.GetMemberState(), req.GetObjectId())
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(&channel_invitation_service.AcceptInvitationResponse{
+		ObjectId: proto.Uint64(objectID),
+	})
 }
 
 func (s *ChannelInvitationService) DeclineInvitation(body []byte) error {
-	return nyi
+	req := invitation_types.GenericRequest{}
+	err := proto.Unmarshal(body, &req)
+	if err != nil {
+		return err
+	}
+	log.Printf("req = %s", req.String())
+	return s.sess.server.channels.decline(s.sess, req.GetInvitationId())
 }
 
 func (s *ChannelInvitationService) RevokeInvitation(body []byte) error {
-	return nyi
+	req := channel_invitation_service.RevokeInvitationRequest{}
+	err := proto.Unmarshal(body, &req)
+	if err != nil {
+		return err
+	}
+	log.Printf("req = %s", req.String())
+	return s.sess.server.channels.revoke(s.sess, req.GetChannelId(), req.GetInvitationId())
 }
 
+// SuggestInvitation asks the owner of a channel to invite someone to it.
 func (s *ChannelInvitationService) SuggestInvitation(body []byte) error {
-	return nyi
+	req := channel_invitation_service.SuggestInvitationRequest{}
+	err := proto.Unmarshal(body, &req)
+	if err != nil {
+		return err
+	}
+	log.Printf("req = %s", req.String())
+	channels := s.sess.server.channels
+	if !channels.isMember(s.sess, req.GetChannelId()) {
+		return Errorf(ErrorDenied, "SuggestInvitation: %d isn't a member of %s",
+			s.sess.account.ID, req.GetChannelId().String())
+	}
+	owner := channels.owner(req.GetChannelId())
+	if owner == nil || owner == s.sess {
+		return nil
+	}
+	suggestion := &invitation_types.Suggestion{
+		ChannelId:     req.GetChannelId(),
+		SuggesterId:   s.sess.identity().GameAccountId,
+		SuggesteeId:   req.GetTargetId(),
+		SuggesterName: proto.String(s.sess.account.BattleTag),
+	}
+	if suggestee := accountByID(accountIDForEntity(req.GetTargetId())); suggestee != nil {
+		suggestion.SuggesteeName = proto.String(suggestee.BattleTag)
+	}
+	owner.Post(func() {
+		if !owner.channelInvitationsSubscribed {
+			return
+		}
+		notify := owner.ImportedService("bnet.protocol.channel_invitation.ChannelInvitationNotify")
+		if notify == nil {
+			return
+		}
+		notify.(*ChannelInvitationNotifyService).NotifyReceivedSuggestionAdded(suggestion)
+	})
+	return nil
+}
+
+// A channel the client counts towards its limit of channels of a type, such
+// as one party at a time.
+type channelCount struct {
+	description *channel_invitation_types.ChannelCountDescription
 }
 
+// IncrementChannelCount reserves a place for each of the described channels
+// the client is about to join.
 func (s *ChannelInvitationService) IncrementChannelCount(body []byte) ([]byte, error) {
-	return nil, nyi
+	req := channel_invitation_service.IncrementChannelCountRequest{}
+	err := proto.Unmarshal(body, &req)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("req = %s", req.String())
+	res := channel_invitation_service.IncrementChannelCountResponse{}
+	for _, description := range req.GetDescriptions() {
+		s.sess.lastReservationToken++
+		s.sess.channelCounts[s.sess.lastReservationToken] = &channelCount{description}
+		res.ReservationTokens = append(res.ReservationTokens, s.sess.lastReservationToken)
+	}
+	return proto.Marshal(&res)
 }
 
+// DecrementChannelCount releases a reservation, given either its token or the
+// channel it was used for.
 func (s *ChannelInvitationService) DecrementChannelCount(body []byte) error {
-	return nyi
+	req := channel_invitation_service.DecrementChannelCountRequest{}
+	err := proto.Unmarshal(body, &req)
+	if err != nil {
+		return err
+	}
+	log.Printf("req = %s", req.String())
+	for token, count := range s.sess.channelCounts {
+		if token == req.GetReservationToken() ||
+			(req.ChannelId != nil && proto.Equal(count.description.ChannelId, req.ChannelId)) {
+			delete(s.sess.channelCounts, token)
+		}
+	}
+	return nil
 }
 
+// UpdateChannelCount records the channel a reservation was used for.
 func (s *ChannelInvitationService) UpdateChannelCount(body []byte) error {
-	return nyi
+	req := channel_invitation_service.UpdateChannelCountRequest{}
+	err := proto.Unmarshal(body, &req)
+	if err != nil {
+		return err
+	}
+	log.Printf("req = %s", req.String())
+	count := s.sess.channelCounts[req.GetReservationToken()]
+	if count == nil {
+		return Errorf(ErrorNotExists, "UpdateChannelCount: no reservation %d", req.GetReservationToken())
+	}
+	count.description.ChannelId = req.ChannelId
+	return nil
 }
 
 func (s *ChannelInvitationService) ListChannelCount(body []byte) ([]byte, error) {
-	return nil, nyi
+	req := channel_invitation_service.ListChannelCountRequest{}
+	err := proto.Unmarshal(body, &req)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("req = %s", req.String())
+	if !s.sess.isEntity(req.GetMemberId()) {
+		return nil, Errorf(ErrorDenied, "ListChannelCount: %s isn't the session's entity", req.GetMemberId().String())
+	}
+	res := channel_invitation_service.ListChannelCountResponse{}
+	for _, count := range s.sess.channelCounts {
+		description := count.description
+		if description.GetServiceType() != req.GetServiceType() ||
+			(req.Program != nil && description.GetProgram() != req.GetProgram()) {
+			continue
+		}
+		res.Channel = append(res.Channel, &channel_invitation_types.ChannelCount{
+			ChannelId:   description.ChannelId,
+			ChannelType: description.ChannelType,
+		})
+	}
+	return proto.Marshal(&res)
 }
 
 // implement ChannelInvitationNotifyServiceBinder (bnet.protocol.channel_invitation.ChannelInvitationNotify)
@@ -151,6 +322,108 @@ func (s *ChannelInvitationNotifyService) Methods() []string {
 }
 
 func (s *ChannelInvitationNotifyService) Invoke(method int, body []byte) (resp []byte, err error) {
-	log.Panicf("ChannelInvitationNotifyService is a client export, not a server export")
-	return
+	return nil, Errorf(ErrorRPCInvalidService, "ChannelInvitationNotifyService is a client export, not a server export")
+}
+
+func (s *ChannelInvitationNotifyService) NotifyReceivedInvitationAdded(invitation *invitation_types.Invitation) {
+	s.notify(1, &channel_invitation_service.InvitationAddedNotification{
+		Invitation: invitation,
+	})
+}
+
+func (s *ChannelInvitationNotifyService) NotifyReceivedInvitationRemoved(invitation *invitation_types.Invitation, reason uint32) {
+	s.notify(2, &channel_invitation_service.InvitationRemovedNotification{
+		Invitation: invitation,
+		Reason:     proto.Uint32(reason),
+	})
+}
+
+func (s *ChannelInvitationNotifyService) NotifyReceivedSuggestionAdded(suggestion *invitation_types.Suggestion) {
+	s.notify(3, &channel_invitation_service.SuggestionAddedNotification{
+		Suggestion: suggestion,
+	})
+}
+
+func (s *ChannelInvitationNotifyService) notify(method int, n proto.Message) {
+	buf, err := proto.Marshal(n)
+	if err != nil {
+		log.Panicf("error: ChannelInvitationNotifyService: marshal: %v", err)
+	}
+	header := s.sess.MakeRequestHeader(s, method, len(buf))
+	err = s.sess.QueuePacket(header, buf)
+	if err != nil {
+		log.Printf("error: ChannelInvitationNotifyService: %v", err)
+	}
+}
+
+type ChannelSubscriberServiceBinder struct{}
+
+func (ChannelSubscriberServiceBinder) Bind(sess *Session) Service {
+	return &ChannelSubscriberService{sess}
+}
+
+// The ChannelSubscriber service sends changes of subscribed channels, such as
+// presence, to the client.
+type ChannelSubscriberService struct {
+	sess *Session
+}
+
+func (s *ChannelSubscriberService) Name() string {
+	return "bnet.protocol.channel.ChannelSubscriber"
+}
+
+func (s *ChannelSubscriberService) Methods() []string {
+	return []string{
+		"",
+		"NotifyAdd",
+		"NotifyJoin",
+		"NotifyRemove",
+		"NotifyLeave",
+		"NotifySendMessage",
+		"NotifyUpdateChannelState",
+		"NotifyUpdateMemberState",
+	}
+}
+
+func (s *ChannelSubscriberService) Invoke(method int, body []byte) (resp []byte, err error) {
+	return nil, Errorf(ErrorRPCInvalidService, "ChannelSubscriber is a client export, not a server export")
+}
+
+func (s *ChannelSubscriberService) NotifyAdd(objectID uint64, n *channel_service.AddNotification) {
+	s.notify(1, objectID, n)
+}
+
+func (s *ChannelSubscriberService) NotifyJoin(objectID uint64, n *channel_service.JoinNotification) {
+	s.notify(2, objectID, n)
+}
+
+func (s *ChannelSubscriberService) NotifyRemove(objectID uint64, n *channel_service.RemoveNotification) {
+	s.notify(3, objectID, n)
+}
+
+func (s *ChannelSubscriberService) NotifyLeave(objectID uint64, n *channel_service.LeaveNotification) {
+	s.notify(4, objectID, n)
+}
+
+func (s *ChannelSubscriberService) NotifyUpdateChannelState(objectID uint64, n *channel_service.UpdateChannelStateNotification) {
+	s.notify(6, objectID, n)
+}
+
+func (s *ChannelSubscriberService) NotifyUpdateMemberState(objectID uint64, n *channel_service.UpdateMemberStateNotification) {
+	s.notify(7, objectID, n)
+}
+
+// notify sends a notification to the client's channel object with the given
+// id.
+func (s *ChannelSubscriberService) notify(method int, objectID uint64, n proto.Message) {
+	buf, err := proto.Marshal(n)
+	if err != nil {
+		log.Panicf("error: ChannelSubscriberService: marshal: %v", err)
+	}
+	header := s.sess.MakeRequestHeader(s, method, len(buf))
+	header.ObjectId = proto.Uint64(objectID)
+	err = s.sess.QueuePacket(header, buf)
+	if err != nil {
+		log.Printf("error: ChannelSubscriberService: %v", err)
+	}
 }
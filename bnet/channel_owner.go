@@ -0,0 +1,155 @@
+package bnet
+
+import (
+	"github.com/HearthSim/hs-proto-go/bnet/channel_owner"
+	"github.com/HearthSim/hs-proto-go/bnet/channel_service"
+	"github.com/golang/protobuf/proto"
+	"log"
+)
+
+type ChannelOwnerServiceBinder struct{}
+
+func (ChannelOwnerServiceBinder) Bind(sess *Session) Service {
+	res := &ChannelOwnerService{}
+	res.sess = sess
+	return res
+}
+
+// The ChannelOwner service creates channels, such as parties.
+type ChannelOwnerService struct {
+	sess *Session
+}
+
+func (s *ChannelOwnerService) Name() string {
+	return "bnet.protocol.channel.ChannelOwner"
+}
+
+func (s *ChannelOwnerService) Methods() []string {
+	return []string{
+		"",
+		"GetChannelId",
+		"CreateChannel",
+		"JoinChannel",
+		"FindChannel",
+		"GetChannelInfo",
+	}
+}
+
+func (s *ChannelOwnerService) Invoke(method int, body []byte) (resp []byte, err error) {
+	switch method {
+	case 2:
+		return s.CreateChannel(body)
+	case 1, 3, 4, 5:
+		return nil, nyi
+	default:
+		return nil, Errorf(ErrorRPCInvalidMethod, "ChannelOwnerService.Invoke: unknown method %v", method)
+	}
+}
+
+// CreateChannel makes a new channel owned by the client.  Its response names
+// the channel by the object id used for Channel service requests.
+func (s *ChannelOwnerService) CreateChannel(body []byte) ([]byte, error) {
+	req := channel_owner.CreateChannelRequest{}
+	err := proto.Unmarshal(body, &req)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("req = %s", req.String())
+	if s.sess.State() != StateReady {
+		return nil, Errorf(ErrorNoAuth, "ChannelOwnerService: not logged on")
+	}
+	id := s.sess.server.channels.create(s.sess, req.GetChannelState(), req.GetMemberState(), req.GetObjectId())
+	return proto.Marshal(&channel_owner.CreateChannelResponse{
+		ObjectId:  proto.Uint64(id.GetLow()),
+		ChannelId: id,
+	})
+}
+
+type ChannelServiceBinder struct{}
+
+func (ChannelServiceBinder) Bind(sess *Session) Service {
+	res := &ChannelService{}
+	res.sess = sess
+	return res
+}
+
+// The Channel service changes a channel the client is a member of.  Requests
+// name the channel by the object id in their header.
+type ChannelService struct {
+	sess *Session
+}
+
+func (s *ChannelService) Name() string {
+	return "bnet.protocol.channel.Channel"
+}
+
+func (s *ChannelService) Methods() []string {
+	return []string{
+		"",
+		"AddMember",
+		"RemoveMember",
+		"SendMessage",
+		"UpdateChannelState",
+		"UpdateMemberState",
+		"Dissolve",
+		"SetRoles",
+		"UnsubscribeMember",
+	}
+}
+
+func (s *ChannelService) Invoke(method int, body []byte) (resp []byte, err error) {
+	switch method {
+	case 2:
+		return []byte{}, s.RemoveMember(body)
+	case 4:
+		return []byte{}, s.UpdateChannelState(body)
+	case 5:
+		return []byte{}, s.UpdateMemberState(body)
+	case 6:
+		return []byte{}, s.Dissolve(body)
+	case 1, 3, 7, 8:
+		return nil, nyi
+	default:
+		return nil, Errorf(ErrorRPCInvalidMethod, "ChannelService.Invoke: unknown method %v", method)
+	}
+}
+
+func (s *ChannelService) RemoveMember(body []byte) error {
+	req := channel_service.RemoveMemberRequest{}
+	err := proto.Unmarshal(body, &req)
+	if err != nil {
+		return err
+	}
+	log.Printf("req = %s", req.String())
+	return s.sess.server.channels.removeMember(s.sess, s.sess.receivedObjectID, req.GetMemberId(), req.GetReason())
+}
+
+func (s *ChannelService) UpdateChannelState(body []byte) error {
+	req := channel_service.UpdateChannelStateRequest{}
+	err := proto.Unmarshal(body, &req)
+	if err != nil {
+		return err
+	}
+	log.Printf("req = %s", req.String())
+	return s.sess.server.channels.updateState(s.sess, s.sess.receivedObjectID, req.GetStateChange())
+}
+
+func (s *ChannelService) UpdateMemberState(body []byte) error {
+	req := channel_service.UpdateMemberStateRequest{}
+	err := proto.Unmarshal(body, &req)
+	if err != nil {
+		return err
+	}
+	log.Printf("req = %s", req.String())
+	return s.sess.server.channels.updateMemberState(s.sess, s.sess.receivedObjectID, req.GetStateChange())
+}
+
+func (s *ChannelService) Dissolve(body []byte) error {
+	req := channel_service.DissolveRequest{}
+	err := proto.Unmarshal(body, &req)
+	if err != nil {
+		return err
+	}
+	log.Printf("req = %s", req.String())
+	return s.sess.server.channels.dissolve(s.sess, s.sess.receivedObjectID, req.GetReason())
+}
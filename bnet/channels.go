@@ -0,0 +1,604 @@
+package bnet
+
+import (
+	"github.com/HearthSim/hs-proto-go/bnet/attribute"
+	"github.com/HearthSim/hs-proto-go/bnet/channel_invitation_types"
+	"github.com/HearthSim/hs-proto-go/bnet/channel_service"
+	"github.com/HearthSim/hs-proto-go/bnet/channel_types"
+	"github.com/HearthSim/hs-proto-go/bnet/entity"
+	"github.com/HearthSim/hs-proto-go/bnet/invitation_types"
+	"github.com/golang/protobuf/proto"
+	"log"
+	"sync"
+	"time"
+)
+
+// How long a channel invitation waits to be accepted.
+const channelInvitationLifetime = 5 * time.Minute
+
+// How often expired channel invitations are removed.
+const channelInvitationSweepInterval = 15 * time.Second
+
+// Reasons sent with RemoveNotifications when the server removes a member.
+const (
+	channelRemovedLeft = iota
+	channelRemovedKicked
+	channelRemovedDissolved
+	channelRemovedDisconnected
+)
+
+// A member of a channel.
+type channelMember struct {
+	sess     *Session
+	identity *entity.Identity
+	state    *channel_types.MemberState
+	// The client's object id for the channel, which notifications are sent
+	// to.
+	objectID uint64
+}
+
+// isEntity returns whether an entity id is the member's account or game
+// account.
+func (m *channelMember) isEntity(id *entity.EntityId) bool {
+	return proto.Equal(id, m.identity.AccountId) || proto.Equal(id, m.identity.GameAccountId)
+}
+
+func (m *channelMember) member() *channel_types.Member {
+	return &channel_types.Member{
+		Identity: m.identity,
+		State:    proto.Clone(m.state).(*channel_types.MemberState),
+	}
+}
+
+// notify calls f with the ChannelSubscriber export of the member's client and
+// its object id for the channel, on the client's event loop.
+func (m *channelMember) notify(f func(subscriber *ChannelSubscriberService, objectID uint64)) {
+	sess, objectID := m.sess, m.objectID
+	sess.Post(func() {
+		subscriber := sess.ImportedService("bnet.protocol.channel.ChannelSubscriber")
+		if subscriber == nil {
+			return
+		}
+		f(subscriber.(*ChannelSubscriberService), objectID)
+	})
+}
+
+// A channel is a group of members sharing attributes, such as a party.  The
+// first member owns the channel.
+type channel struct {
+	id      *entity.EntityId
+	state   *channel_types.ChannelState
+	members []*channelMember
+	// Pending invitations to join, by id.
+	invitations map[uint64]*channelInvitation
+}
+
+func (ch *channel) member(sess *Session) *channelMember {
+	for _, m := range ch.members {
+		if m.sess == sess {
+			return m
+		}
+	}
+	return nil
+}
+
+func (ch *channel) memberByID(id *entity.EntityId) *channelMember {
+	for _, m := range ch.members {
+		if m.isEntity(id) {
+			return m
+		}
+	}
+	return nil
+}
+
+// description returns the channel's id and state, including pending
+// invitations.
+func (ch *channel) description() *channel_types.ChannelDescription {
+	return &channel_types.ChannelDescription{
+		ChannelId:      ch.id,
+		CurrentMembers: proto.Uint32(uint32(len(ch.members))),
+		State:          ch.currentState(),
+	}
+}
+
+func (ch *channel) currentState() *channel_types.ChannelState {
+	state := proto.Clone(ch.state).(*channel_types.ChannelState)
+	for _, inv := range ch.invitations {
+		state.Invitation = append(state.Invitation, inv.invitation)
+	}
+	return state
+}
+
+// publish sends a state change to every member.
+func (ch *channel) publish(change *channel_types.ChannelState) {
+	for _, m := range ch.members {
+		m.notify(func(subscriber *ChannelSubscriberService, objectID uint64) {
+			subscriber.NotifyUpdateChannelState(objectID, &channel_service.UpdateChannelStateNotification{
+				StateChange: change,
+			})
+		})
+	}
+}
+
+// An invitation to join a channel.
+type channelInvitation struct {
+	invitation *invitation_types.Invitation
+	channel    *channel
+	inviter    *Session
+	invitee    *Session
+	expires    time.Time
+}
+
+// A channelStore holds every channel and channel invitation in memory.
+type channelStore struct {
+	sync.Mutex
+	lastChannelID    uint64
+	lastInvitationID uint64
+	// Channels by the low part of their id, which is also the object id
+	// clients use for them.
+	channels    map[uint64]*channel
+	invitations map[uint64]*channelInvitation
+}
+
+func newChannelStore() *channelStore {
+	return &channelStore{
+		channels:    map[uint64]*channel{},
+		invitations: map[uint64]*channelInvitation{},
+	}
+}
+
+// memberOf returns the channel with the given object id and the session's
+// membership of it.  The store must be locked.
+func (c *channelStore) memberOf(sess *Session, objectID uint64) (*channel, *channelMember, error) {
+	ch := c.channels[objectID]
+	if ch == nil {
+		return nil, nil, Errorf(ErrorNotExists, "no channel with object id %d", objectID)
+	}
+	m := ch.member(sess)
+	if m == nil {
+		return nil, nil, Errorf(ErrorDenied, "%d isn't a member of channel %d", sess.account.ID, objectID)
+	}
+	return ch, m, nil
+}
+
+// create makes a new channel with the session as its owner.
+func (c *channelStore) create(sess *Session, state *channel_types.ChannelState, memberState *channel_types.MemberState, objectID uint64) *entity.EntityId {
+	c.Lock()
+	defer c.Unlock()
+	sess.OnDisconnect(c, func() { c.disconnect(sess) })
+	c.lastChannelID++
+	if state == nil {
+		state = &channel_types.ChannelState{}
+	}
+	if memberState == nil {
+		memberState = &channel_types.MemberState{}
+	}
+	ch := &channel{
+		id:          EntityId(BnetChannelEntityIDHi, c.lastChannelID),
+		state:       state,
+		invitations: map[uint64]*channelInvitation{},
+	}
+	c.channels[c.lastChannelID] = ch
+	c.join(ch, sess, memberState, objectID)
+	return ch.id
+}
+
+// join adds a session to a channel, sending it the channel and the other
+// members the new member.  The store must be locked.
+func (c *channelStore) join(ch *channel, sess *Session, memberState *channel_types.MemberState, objectID uint64) {
+	m := &channelMember{sess, sess.identity(), memberState, objectID}
+	joined := m.member()
+	for _, other := range ch.members {
+		other.notify(func(subscriber *ChannelSubscriberService, objectID uint64) {
+			subscriber.NotifyJoin(objectID, &channel_service.JoinNotification{
+				Member: joined,
+			})
+		})
+	}
+	ch.members = append(ch.members, m)
+	add := &channel_service.AddNotification{
+		Self:         joined,
+		ChannelState: ch.currentState(),
+	}
+	for _, member := range ch.members {
+		add.Member = append(add.Member, member.member())
+	}
+	m.notify(func(subscriber *ChannelSubscriberService, objectID uint64) {
+		subscriber.NotifyAdd(objectID, add)
+	})
+}
+
+// invite sends an invitation to join a channel to the target's client.
+func (c *channelStore) invite(sess *Session, target *Session, params *channel_invitation_types.ChannelInvitationParams, message string) (*invitation_types.Invitation, error) {
+	c.Lock()
+	defer c.Unlock()
+	ch := c.channels[params.GetChannelId().GetLow()]
+	if ch == nil || !proto.Equal(ch.id, params.GetChannelId()) {
+		return nil, Errorf(ErrorNotExists, "no channel %s", params.GetChannelId().String())
+	}
+	if ch.member(sess) == nil {
+		return nil, Errorf(ErrorDenied, "%d isn't a member of channel %d", sess.account.ID, ch.id.GetLow())
+	}
+	if ch.member(target) != nil {
+		return nil, Errorf(ErrorInvalidArgs, "%d is already a member of channel %d", target.account.ID, ch.id.GetLow())
+	}
+	for _, inv := range ch.invitations {
+		if inv.invitee == target {
+			return nil, Errorf(ErrorInProgress, "%d is already invited to channel %d", target.account.ID, ch.id.GetLow())
+		}
+	}
+	target.OnDisconnect(c, func() { c.disconnect(target) })
+	c.lastInvitationID++
+	now := time.Now()
+	inv := &channelInvitation{
+		invitation: &invitation_types.Invitation{
+			Id:                proto.Uint64(c.lastInvitationID),
+			InviterIdentity:   sess.identity(),
+			InviteeIdentity:   target.identity(),
+			InviterName:       proto.String(sess.account.BattleTag),
+			InviteeName:       proto.String(target.account.BattleTag),
+			InvitationMessage: proto.String(message),
+			CreationTime:      proto.Uint64(Timestamp(now)),
+			ExpirationTime:    proto.Uint64(Timestamp(now.Add(channelInvitationLifetime))),
+		},
+		channel: ch,
+		inviter: sess,
+		invitee: target,
+		expires: now.Add(channelInvitationLifetime),
+	}
+	err := proto.SetExtension(inv.invitation, channel_invitation_types.E_ChannelInvitation_ChannelInvitation,
+		&channel_invitation_types.ChannelInvitation{
+			ChannelDescription: ch.description(),
+			Reserved:           params.Reserved,
+			Rejoin:             params.Rejoin,
+			ServiceType:        proto.Uint32(params.GetServiceType()),
+		})
+	if err != nil {
+		log.Panicf("error: channelStore.invite: %v", err)
+	}
+	ch.invitations[c.lastInvitationID] = inv
+	c.invitations[c.lastInvitationID] = inv
+
+	ch.publish(&channel_types.ChannelState{
+		Invitation: []*invitation_types.Invitation{inv.invitation},
+	})
+	target.Post(func() {
+		if !target.channelInvitationsSubscribed {
+			return
+		}
+		notify := target.ImportedService("bnet.protocol.channel_invitation.ChannelInvitationNotify")
+		if notify == nil {
+			return
+		}
+		notify.(*ChannelInvitationNotifyService).NotifyReceivedInvitationAdded(inv.invitation)
+	})
+	return inv.invitation, nil
+}
+
+// receivedInvitations returns the pending invitations sent to a session.
+func (c *channelStore) receivedInvitations(sess *Session) []*invitation_types.Invitation {
+	c.Lock()
+	defer c.Unlock()
+	res := []*invitation_types.Invitation{}
+	for _, inv := range c.invitations {
+		if inv.invitee == sess {
+			res = append(res, inv.invitation)
+		}
+	}
+	return res
+}
+
+// removeInvitation withdraws an invitation, telling the invitee and the
+// channel's members why.  The store must be locked.
+func (c *channelStore) removeInvitation(inv *channelInvitation, reason uint32) {
+	id := inv.invitation.GetId()
+	delete(c.invitations, id)
+	delete(inv.channel.invitations, id)
+	inv.channel.publish(&channel_types.ChannelState{
+		Invitation: []*invitation_types.Invitation{inv.invitation},
+		Reason:     proto.Uint32(reason),
+	})
+	invitee := inv.invitee
+	invitee.Post(func() {
+		if !invitee.channelInvitationsSubscribed {
+			return
+		}
+		notify := invitee.ImportedService("bnet.protocol.channel_invitation.ChannelInvitationNotify")
+		if notify == nil {
+			return
+		}
+		notify.(*ChannelInvitationNotifyService).NotifyReceivedInvitationRemoved(inv.invitation, reason)
+	})
+}
+
+// receivedInvitation returns a pending invitation sent to the session.  The
+// store must be locked.
+func (c *channelStore) receivedInvitation(sess *Session, id uint64) (*channelInvitation, error) {
+	inv := c.invitations[id]
+	if inv == nil || inv.invitee != sess {
+		return nil, Errorf(ErrorNotExists, "no channel invitation %d for %d", id, sess.account.ID)
+	}
+	if !time.Now().Before(inv.expires) {
+		c.removeInvitation(inv, invitationRemovedExpired)
+		return nil, Errorf(ErrorNotExists, "channel invitation %d expired", id)
+	}
+	return inv, nil
+}
+
+// accept adds the invitee to the channel it was invited to, and returns the
+// channel's object id.
+func (c *channelStore) accept(sess *Session, id uint64, memberState *channel_types.MemberState, objectID uint64) (uint64, error) {
+	c.Lock()
+	defer c.Unlock()
+	inv, err := c.receivedInvitation(sess, id)
+	if err != nil {
+		return 0, err
+	}
+	c.removeInvitation(inv, invitationRemovedAccepted)
+	if memberState == nil {
+		memberState = &channel_types.MemberState{}
+	}
+	c.join(inv.channel, sess, memberState, objectID)
+	return inv.channel.id.GetLow(), nil
+}
+
+func (c *channelStore) decline(sess *Session, id uint64) error {
+	c.Lock()
+	defer c.Unlock()
+	inv, err := c.receivedInvitation(sess, id)
+	if err != nil {
+		return err
+	}
+	c.removeInvitation(inv, invitationRemovedDeclined)
+	return nil
+}
+
+// revoke withdraws an invitation to a channel the session is a member of.
+func (c *channelStore) revoke(sess *Session, channelID *entity.EntityId, id uint64) error {
+	c.Lock()
+	defer c.Unlock()
+	inv := c.invitations[id]
+	if inv == nil || !proto.Equal(inv.channel.id, channelID) {
+		return Errorf(ErrorNotExists, "no invitation %d to channel %s", id, channelID.String())
+	}
+	if inv.channel.member(sess) == nil {
+		return Errorf(ErrorDenied, "%d isn't a member of channel %d", sess.account.ID, channelID.GetLow())
+	}
+	c.removeInvitation(inv, invitationRemovedRevoked)
+	return nil
+}
+
+// isMember returns whether the session is a member of a channel.
+func (c *channelStore) isMember(sess *Session, channelID *entity.EntityId) bool {
+	c.Lock()
+	defer c.Unlock()
+	ch := c.channels[channelID.GetLow()]
+	return ch != nil && proto.Equal(ch.id, channelID) && ch.member(sess) != nil
+}
+
+// shareChannel returns whether two sessions are members of the same channel.
+// Everyone but its owner joined a channel by accepting an invitation, so both
+// agreed to be in it.
+func (c *channelStore) shareChannel(a, b *Session) bool {
+	c.Lock()
+	defer c.Unlock()
+	for _, ch := range c.channels {
+		if ch.member(a) != nil && ch.member(b) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// owner returns the session of a channel's owner, or nil if there's no such
+// channel.
+func (c *channelStore) owner(channelID *entity.EntityId) *Session {
+	c.Lock()
+	defer c.Unlock()
+	ch := c.channels[channelID.GetLow()]
+	if ch == nil || !proto.Equal(ch.id, channelID) {
+		return nil
+	}
+	return ch.members[0].sess
+}
+
+// updateState changes a channel's attributes and settings, and sends the
+// change to its members.
+func (c *channelStore) updateState(sess *Session, objectID uint64, change *channel_types.ChannelState) error {
+	c.Lock()
+	defer c.Unlock()
+	ch, _, err := c.memberOf(sess, objectID)
+	if err != nil {
+		return err
+	}
+	settings := proto.Clone(change).(*channel_types.ChannelState)
+	settings.Attribute = nil
+	settings.Invitation = nil
+	proto.Merge(ch.state, settings)
+	ch.state.Attribute = mergeAttributes(ch.state.Attribute, change.Attribute)
+	ch.publish(change)
+	return nil
+}
+
+// updateMemberState changes the state of the session's own membership, and
+// sends the change to every member.
+func (c *channelStore) updateMemberState(sess *Session, objectID uint64, changes []*channel_types.Member) error {
+	c.Lock()
+	defer c.Unlock()
+	ch, _, err := c.memberOf(sess, objectID)
+	if err != nil {
+		return err
+	}
+	for _, change := range changes {
+		m := ch.memberByID(change.GetIdentity().GetGameAccountId())
+		if m == nil {
+			m = ch.memberByID(change.GetIdentity().GetAccountId())
+		}
+		if m == nil || m.sess != sess {
+			return Errorf(ErrorDenied, "%d may only change its own member state", sess.account.ID)
+		}
+	}
+	for _, change := range changes {
+		m := ch.member(sess)
+		state := m.state
+		if len(change.GetState().Role) != 0 {
+			state.Role = change.GetState().Role
+		}
+		if change.GetState().Privileges != nil {
+			state.Privileges = change.GetState().Privileges
+		}
+		state.Attribute = mergeAttributes(state.Attribute, change.GetState().Attribute)
+	}
+	for _, m := range ch.members {
+		m.notify(func(subscriber *ChannelSubscriberService, objectID uint64) {
+			subscriber.NotifyUpdateMemberState(objectID, &channel_service.UpdateMemberStateNotification{
+				StateChange: changes,
+			})
+		})
+	}
+	return nil
+}
+
+// removeMember removes a member from a channel.  Members may leave, and the
+// owner may remove anyone.
+func (c *channelStore) removeMember(sess *Session, objectID uint64, memberID *entity.EntityId, reason uint32) error {
+	c.Lock()
+	defer c.Unlock()
+	ch, m, err := c.memberOf(sess, objectID)
+	if err != nil {
+		return err
+	}
+	removed := ch.memberByID(memberID)
+	if removed == nil {
+		return Errorf(ErrorNotExists, "%s isn't a member of channel %d", memberID.String(), objectID)
+	}
+	if removed != m && ch.members[0] != m {
+		return Errorf(ErrorDenied, "only the owner of channel %d may remove members", objectID)
+	}
+	c.remove(ch, removed, reason)
+	return nil
+}
+
+// remove takes a member out of a channel, dissolving it once it's empty.  The
+// store must be locked.
+func (c *channelStore) remove(ch *channel, removed *channelMember, reason uint32) {
+	members := []*channelMember{}
+	for _, m := range ch.members {
+		if m != removed {
+			members = append(members, m)
+		}
+	}
+	ch.members = members
+	memberID := removed.identity.GameAccountId
+	removed.notify(func(subscriber *ChannelSubscriberService, objectID uint64) {
+		subscriber.NotifyRemove(objectID, &channel_service.RemoveNotification{
+			MemberId: memberID,
+			Reason:   proto.Uint32(reason),
+		})
+	})
+	for _, m := range ch.members {
+		m.notify(func(subscriber *ChannelSubscriberService, objectID uint64) {
+			subscriber.NotifyLeave(objectID, &channel_service.LeaveNotification{
+				MemberId: memberID,
+			})
+		})
+	}
+	if len(ch.members) == 0 {
+		c.dissolveChannel(ch, channelRemovedDissolved)
+	}
+}
+
+// dissolve removes every member of a channel the session owns.
+func (c *channelStore) dissolve(sess *Session, objectID uint64, reason uint32) error {
+	c.Lock()
+	defer c.Unlock()
+	ch, m, err := c.memberOf(sess, objectID)
+	if err != nil {
+		return err
+	}
+	if ch.members[0] != m {
+		return Errorf(ErrorDenied, "only the owner of channel %d may dissolve it", objectID)
+	}
+	c.dissolveChannel(ch, reason)
+	return nil
+}
+
+// dissolveChannel removes a channel, its members and its invitations.  The
+// store must be locked.
+func (c *channelStore) dissolveChannel(ch *channel, reason uint32) {
+	for _, inv := range ch.invitations {
+		c.removeInvitation(inv, invitationRemovedRevoked)
+	}
+	for _, m := range ch.members {
+		memberID := m.identity.GameAccountId
+		m.notify(func(subscriber *ChannelSubscriberService, objectID uint64) {
+			subscriber.NotifyRemove(objectID, &channel_service.RemoveNotification{
+				MemberId: memberID,
+				Reason:   proto.Uint32(reason),
+			})
+		})
+	}
+	ch.members = nil
+	delete(c.channels, ch.id.GetLow())
+}
+
+// expireInvitations removes invitations which weren't accepted in time.
+func (c *channelStore) expireInvitations(now time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	for _, inv := range c.invitations {
+		if !now.Before(inv.expires) {
+			c.removeInvitation(inv, invitationRemovedExpired)
+		}
+	}
+}
+
+// disconnect removes a session from every channel, and withdraws the
+// invitations sent to it.
+func (c *channelStore) disconnect(sess *Session) {
+	c.Lock()
+	defer c.Unlock()
+	for _, inv := range c.invitations {
+		if inv.invitee == sess {
+			c.removeInvitation(inv, invitationRemovedRevoked)
+		}
+	}
+	for _, ch := range c.channels {
+		if m := ch.member(sess); m != nil {
+			c.remove(ch, m, channelRemovedDisconnected)
+		}
+	}
+}
+
+// sweepChannelInvitations periodically removes expired channel invitations,
+// until stop is closed.
+func (s *Server) sweepChannelInvitations(stop <-chan struct{}) {
+	ticker := time.NewTicker(channelInvitationSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.channels.expireInvitations(now)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// mergeAttributes sets attributes to their changed values, removing those
+// changed to a variant with no value.
+func mergeAttributes(attrs, changes []*attribute.Attribute) []*attribute.Attribute {
+	for _, change := range changes {
+		res := []*attribute.Attribute{}
+		for _, attr := range attrs {
+			if attr.GetName() != change.GetName() {
+				res = append(res, attr)
+			}
+		}
+		if proto.Size(change.GetValue()) != 0 {
+			res = append(res, change)
+		}
+		attrs = res
+	}
+	return attrs
+}
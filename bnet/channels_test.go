@@ -0,0 +1,117 @@
+package bnet
+
+import (
+	"github.com/HearthSim/hs-proto-go/bnet/attribute"
+	"github.com/HearthSim/hs-proto-go/bnet/channel_invitation_types"
+	"github.com/HearthSim/hs-proto-go/bnet/channel_types"
+	"github.com/golang/protobuf/proto"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestChannelInvitations(t *testing.T) {
+	serv := NewServer()
+	newSession := func(accountID uint64) *Session {
+		_, conn := net.Pipe()
+		sess := NewSession(serv, conn)
+		sess.account.ID = accountID
+		sess.gameAccountID = 100 + accountID
+		return sess
+	}
+	owner := newSession(1)
+	defer owner.Disconnect()
+	invitee := newSession(2)
+	channels := serv.channels
+
+	id := channels.create(owner, nil, nil, 7)
+	params := &channel_invitation_types.ChannelInvitationParams{
+		ChannelId:   id,
+		ServiceType: proto.Uint32(1),
+	}
+	if _, err := channels.invite(invitee, owner, params, ""); ErrorCode(err) != ErrorDenied {
+		t.Errorf("non-member sent an invitation: %v", err)
+	}
+	invitation, err := channels.invite(owner, invitee, params, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = channels.invite(owner, invitee, params, ""); ErrorCode(err) != ErrorInProgress {
+		t.Errorf("expected a second invitation to be rejected, got %v", err)
+	}
+	if n := len(channels.receivedInvitations(invitee)); n != 1 {
+		t.Errorf("expected 1 received invitation, got %d", n)
+	}
+
+	objectID, err := channels.accept(invitee, invitation.GetId(), nil, 8)
+	if err != nil || objectID != id.GetLow() {
+		t.Fatalf("accept returned %d, %v", objectID, err)
+	}
+	if _, err = channels.accept(invitee, invitation.GetId(), nil, 8); ErrorCode(err) != ErrorNotExists {
+		t.Errorf("invitation accepted twice: %v", err)
+	}
+	if !channels.isMember(invitee, id) || channels.owner(id) != owner {
+		t.Errorf("invitee didn't join the channel")
+	}
+
+	// Both members share the channel's attributes.
+	err = channels.updateState(invitee, objectID, &channel_types.ChannelState{
+		Attribute: []*attribute.Attribute{{
+			Name:  proto.String("deck"),
+			Value: &attribute.Variant{IntValue: proto.Int64(3)},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	channels.Lock()
+	attrs := channels.channels[objectID].state.Attribute
+	channels.Unlock()
+	if len(attrs) != 1 || attrs[0].GetValue().GetIntValue() != 3 {
+		t.Errorf("expected the deck attribute to be set, got %v", attrs)
+	}
+
+	if err = channels.removeMember(invitee, objectID, owner.identity().GameAccountId, 0); ErrorCode(err) != ErrorDenied {
+		t.Errorf("member removed the owner: %v", err)
+	}
+	// The channel is dissolved once its last member disconnects.
+	invitee.Disconnect()
+	err = channels.removeMember(owner, objectID, owner.identity().GameAccountId, channelRemovedLeft)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		channels.Lock()
+		n := len(channels.channels)
+		channels.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d channels left after every member left", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMergeAttributes(t *testing.T) {
+	attr := func(name string, value int64) *attribute.Attribute {
+		variant := &attribute.Variant{}
+		if value != 0 {
+			variant.IntValue = proto.Int64(value)
+		}
+		return &attribute.Attribute{Name: proto.String(name), Value: variant}
+	}
+	attrs := mergeAttributes(
+		[]*attribute.Attribute{attr("a", 1), attr("b", 2)},
+		[]*attribute.Attribute{attr("a", 3), attr("b", 0), attr("c", 4)},
+	)
+	got := map[string]int64{}
+	for _, a := range attrs {
+		got[a.GetName()] = a.GetValue().GetIntValue()
+	}
+	if len(got) != 2 || got["a"] != 3 || got["c"] != 4 {
+		t.Errorf("unexpected attributes %v", got)
+	}
+}
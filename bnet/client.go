@@ -0,0 +1,271 @@
+package bnet
+
+import (
+	"context"
+	"github.com/HearthSim/hs-proto-go/bnet/connection_service"
+	"github.com/HearthSim/hs-proto-go/bnet/rpc"
+	"github.com/golang/protobuf/proto"
+	"log"
+	"net"
+	"sync"
+)
+
+// A Client is the other end of a Session.  It connects to a bnet server, binds
+// the services it imports and exports, calls the server's methods and answers
+// the server's calls.  Game hosts use one to link up with stove.
+type Client struct {
+	conn  net.Conn
+	codec *PacketCodec
+	// writeMutex protects writes to the codec.
+	writeMutex sync.Mutex
+
+	exports []*ClientExport
+	// The ids the server bound the imported services to, by name.
+	importIDs map[string]uint32
+
+	// callMutex protects lastToken and responses.
+	callMutex sync.Mutex
+	lastToken uint32
+	responses map[uint32]chan callResult
+
+	// err is why the client closed.  It's set before quit is closed.
+	closeOnce sync.Once
+	err       error
+	quit      chan struct{}
+}
+
+// A ClientExport is a service a Client exports to the server.  Invoke answers
+// the server's calls to it; a nil response with no error sends no response.
+// Calls are answered concurrently.
+type ClientExport struct {
+	Name   string
+	Invoke func(method int, body []byte) ([]byte, error)
+}
+
+// Dial connects to the bnet server at address.
+func Dial(address string, imports []string, exports []*ClientExport) (*Client, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn, imports, exports)
+}
+
+// NewClient binds services over a connection to a bnet server.  The
+// connection is closed if binding fails.
+func NewClient(conn net.Conn, imports []string, exports []*ClientExport) (*Client, error) {
+	c := &Client{
+		conn:      conn,
+		codec:     NewPacketCodec(conn, conn),
+		exports:   exports,
+		importIDs: map[string]uint32{},
+		responses: map[uint32]chan callResult{},
+		quit:      make(chan struct{}),
+	}
+	go c.readPackets()
+
+	bind := &connection_service.BindRequest{}
+	for _, name := range imports {
+		bind.ImportedServiceHash = append(bind.ImportedServiceHash, Hash(name))
+	}
+	// The connection service is bound at index 0 on both ends.
+	for i, export := range exports {
+		bind.ExportedService = append(bind.ExportedService, &connection_service.BoundService{
+			Hash: proto.Uint32(Hash(export.Name)),
+			Id:   proto.Uint32(uint32(i + 1)),
+		})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultCallTimeout)
+	defer cancel()
+	body, err := c.call(ctx, 0, 1, &connection_service.ConnectRequest{BindRequest: bind})
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	res := &connection_service.ConnectResponse{}
+	err = proto.Unmarshal(body, res)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	ids := res.GetBindResponse().GetImportedServiceId()
+	if len(ids) != len(imports) {
+		c.Close()
+		return nil, Errorf(ErrorRPCServiceNotBound, "server bound %d of %d imports",
+			len(ids), len(imports))
+	}
+	for i, name := range imports {
+		c.importIDs[name] = ids[i]
+	}
+	return c, nil
+}
+
+// Call invokes a method of an imported service and waits for the response
+// body until ctx is done.  An error status from the server is returned as an
+// *Error with that code.
+func (c *Client) Call(ctx context.Context, service string, methodId int, req proto.Message) ([]byte, error) {
+	id, ok := c.importIDs[service]
+	if !ok {
+		return nil, Errorf(ErrorRPCServiceNotBound, "%s wasn't imported", service)
+	}
+	return c.call(ctx, id, methodId, req)
+}
+
+// Notify invokes a method of an imported service which has no response.
+func (c *Client) Notify(service string, methodId int, req proto.Message) error {
+	id, ok := c.importIDs[service]
+	if !ok {
+		return Errorf(ErrorRPCServiceNotBound, "%s wasn't imported", service)
+	}
+	body, err := proto.Marshal(req)
+	if err != nil {
+		return err
+	}
+	return c.write(c.requestHeader(id, methodId), body)
+}
+
+func (c *Client) requestHeader(serviceId uint32, methodId int) *rpc.Header {
+	c.callMutex.Lock()
+	defer c.callMutex.Unlock()
+	token := c.lastToken
+	c.lastToken++
+	return &rpc.Header{
+		ServiceId: proto.Uint32(serviceId),
+		MethodId:  proto.Uint32(uint32(methodId)),
+		Token:     proto.Uint32(token),
+	}
+}
+
+func (c *Client) call(ctx context.Context, serviceId uint32, methodId int, req proto.Message) ([]byte, error) {
+	body, err := proto.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	header := c.requestHeader(serviceId, methodId)
+	token := header.GetToken()
+	ch := make(chan callResult, 1)
+	c.callMutex.Lock()
+	c.responses[token] = ch
+	c.callMutex.Unlock()
+	defer func() {
+		c.callMutex.Lock()
+		delete(c.responses, token)
+		c.callMutex.Unlock()
+	}()
+
+	err = c.write(header, body)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case res := <-ch:
+		if res.status != ErrorOK {
+			return nil, Errorf(res.status, "service %d method %d failed", serviceId, methodId)
+		}
+		return res.body, nil
+	case <-ctx.Done():
+		return nil, Errorf(ErrorRPCRequestTimedOut, "service %d method %d: %v",
+			serviceId, methodId, ctx.Err())
+	case <-c.quit:
+		return nil, Errorf(ErrorRPCPeerDisconnected, "service %d method %d: client closed",
+			serviceId, methodId)
+	}
+}
+
+func (c *Client) write(header *rpc.Header, body []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	err := c.codec.WritePacket(header, body)
+	if err != nil {
+		c.closeWithError(err)
+	}
+	return err
+}
+
+func (c *Client) respond(token, status uint32, body []byte) {
+	c.write(&rpc.Header{
+		ServiceId: proto.Uint32(254),
+		Token:     proto.Uint32(token),
+		Status:    proto.Uint32(status),
+	}, body)
+}
+
+// readPackets hands each packet from the server to the caller waiting for it,
+// or to the export it calls, until the connection fails.
+func (c *Client) readPackets() {
+	for {
+		header, body, err := c.codec.ReadPacket()
+		if err != nil {
+			c.closeWithError(err)
+			return
+		}
+		if header.GetServiceId() == 254 {
+			c.callMutex.Lock()
+			ch, ok := c.responses[header.GetToken()]
+			c.callMutex.Unlock()
+			if ok {
+				ch <- callResult{header.GetStatus(), body}
+			} else {
+				log.Printf(" warn: Client: response token not found: %v", header.GetToken())
+			}
+			continue
+		}
+		go c.handleRequest(header, body)
+	}
+}
+
+func (c *Client) handleRequest(header *rpc.Header, body []byte) {
+	serviceId := int(header.GetServiceId())
+	methodId := int(header.GetMethodId())
+	if serviceId == 0 {
+		// The server only calls the connection service to disconnect us.
+		if methodId == 4 {
+			req := &connection_service.DisconnectNotification{}
+			proto.Unmarshal(body, req)
+			log.Printf("Client: server disconnected us: %d %s",
+				req.GetErrorCode(), req.GetReason())
+			c.closeWithError(Errorf(req.GetErrorCode(), "%s", req.GetReason()))
+		}
+		return
+	}
+	if serviceId > len(c.exports) {
+		c.respond(header.GetToken(), ErrorRPCServiceNotBound, nil)
+		return
+	}
+	resp, err := c.exports[serviceId-1].Invoke(methodId, body)
+	if err != nil {
+		log.Printf("error: Client: %s method %d: %v", c.exports[serviceId-1].Name, methodId, err)
+		c.respond(header.GetToken(), ErrorCode(err), nil)
+	} else if resp != nil {
+		c.respond(header.GetToken(), ErrorOK, resp)
+	}
+}
+
+// Done returns a channel which is closed once the client is closed.
+func (c *Client) Done() <-chan struct{} {
+	return c.quit
+}
+
+// Err returns why the client closed, once it has.
+func (c *Client) Err() error {
+	select {
+	case <-c.quit:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+// Close disconnects from the server.
+func (c *Client) Close() error {
+	c.closeWithError(Errorf(ErrorRPCDisconnect, "client closed"))
+	return nil
+}
+
+func (c *Client) closeWithError(err error) {
+	c.closeOnce.Do(func() {
+		c.err = err
+		close(c.quit)
+		c.conn.Close()
+	})
+}
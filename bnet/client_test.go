@@ -0,0 +1,161 @@
+package bnet
+
+import (
+	"context"
+	"github.com/HearthSim/hs-proto-go/bnet/game_master_service"
+	"github.com/HearthSim/hs-proto-go/bnet/game_master_types"
+	"github.com/HearthSim/hs-proto-go/bnet/game_utilities_service"
+	"github.com/HearthSim/hs-proto-go/bnet/server_pool_types"
+	"github.com/golang/protobuf/proto"
+	"net"
+	"testing"
+	"time"
+)
+
+// A resultGameServer passes on the games its hosts report ended.
+type resultGameServer struct {
+	blockingGameServer
+	ended chan *game_master_types.GameHandle
+}
+
+func (s *resultGameServer) GameEnded(handle *game_master_types.GameHandle, reason uint32) {
+	s.ended <- handle
+}
+
+// gameHostExport is a GameUtilities export which reports a load of 3 games
+// and creates games by echoing their attributes.
+func gameHostExport(t *testing.T) *ClientExport {
+	return &ClientExport{
+		Name: "bnet.protocol.game_utilities.GameUtilities",
+		Invoke: func(method int, body []byte) ([]byte, error) {
+			var res proto.Message
+			switch method {
+			case 5:
+				res = &server_pool_types.ServerState{GameCount: proto.Int32(3)}
+			case 6:
+				req := &game_utilities_service.ServerRequest{}
+				err := proto.Unmarshal(body, req)
+				if err != nil {
+					return nil, err
+				}
+				if req.GetProgram() != FourCC("WTCG") {
+					t.Errorf("asked to create a game of program %x", req.GetProgram())
+				}
+				res = &game_utilities_service.ServerResponse{Attribute: req.Attribute}
+			default:
+				return nil, Errorf(ErrorRPCInvalidMethod, "unknown method %d", method)
+			}
+			return proto.Marshal(res)
+		},
+	}
+}
+
+func TestClient(t *testing.T) {
+	serv := NewServer()
+	results := &resultGameServer{ended: make(chan *game_master_types.GameHandle, 1)}
+	serv.RegisterGameServer("WTCG", results)
+	serv.SetGameHostPassword("secret")
+	client, conn := net.Pipe()
+	sess := NewSession(serv, conn)
+	go serv.serveSession(sess)
+	defer sess.Disconnect()
+
+	gameMaster := "bnet.protocol.game_master.GameMaster"
+	c, err := NewClient(client, []string{gameMaster}, []*ClientExport{gameHostExport(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = c.Call(ctx, "bnet.protocol.friends.FriendsService", 1, &game_master_service.UnregisterServerRequest{})
+	if e, ok := err.(*Error); !ok || e.Code != ErrorRPCServiceNotBound {
+		t.Errorf("expected ErrorRPCServiceNotBound calling a service which wasn't imported, got %v", err)
+	}
+
+	// Errors the server responds with are returned with their code.
+	req := &game_master_service.RegisterServerRequest{}
+	proto.Unmarshal(registerServerRequest("WTCG", "wrong"), req)
+	_, err = c.Call(ctx, gameMaster, 7, req)
+	if e, ok := err.(*Error); !ok || e.Code != ErrorDenied {
+		t.Errorf("expected ErrorDenied for a wrong password, got %v", err)
+	}
+	proto.Unmarshal(registerServerRequest("WTCG", "secret"), req)
+	_, err = c.Call(ctx, gameMaster, 7, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForHosts(t, serv.gameHosts, 1)
+
+	// The server calls the host's exports.
+	serv.gameHosts.poll()
+	deadline := time.Now().Add(time.Second)
+	for serv.gameHosts.load("WTCG").GetGameCount() != 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the host's load wasn't polled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	attrs := NewNotification("", map[string]interface{}{"game": "test"}).Attributes
+	created, err := serv.GameHostFor("WTCG").CreateGame(ctx, attrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(created) != 1 || !proto.Equal(created[0], attrs[0]) {
+		t.Errorf("bad attributes for the created game: %v", created)
+	}
+
+	// Ended games are passed on to the game server.
+	err = c.Notify(gameMaster, 5, &game_master_service.GameEndedNotification{
+		GameHandle: &game_master_types.GameHandle{
+			FactoryId: proto.Uint64(uint64(FourCC("WTCG"))),
+			GameId:    EntityId(0, 7),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case handle := <-results.ended:
+		if handle.GetGameId().GetLow() != 7 {
+			t.Errorf("expected game 7 to end, got %s", handle.String())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("the end of the game wasn't passed on")
+	}
+
+	// Closing the client unregisters the host.
+	c.Close()
+	<-c.Done()
+	if c.Err() == nil {
+		t.Errorf("no error once the client closed")
+	}
+	waitForHosts(t, serv.gameHosts, 0)
+	if _, err := c.Call(ctx, gameMaster, 8, &game_master_service.UnregisterServerRequest{}); err == nil {
+		t.Errorf("called the server after closing the client")
+	}
+}
+
+// Errors from exports are sent to the server as the response's status.
+func TestClientInvokeError(t *testing.T) {
+	serv := NewServer()
+	client, conn := net.Pipe()
+	sess := NewSession(serv, conn)
+	go serv.serveSession(sess)
+	defer sess.Disconnect()
+
+	c, err := NewClient(client, nil, []*ClientExport{gameHostExport(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	service := sess.ImportedService("bnet.protocol.game_utilities.GameUtilities")
+	if service == nil {
+		t.Fatalf("the client's export wasn't bound")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = sess.CallContext(ctx, service, 9, &server_pool_types.GetLoadRequest{})
+	if e, ok := err.(*Error); !ok || e.Code != ErrorRPCInvalidMethod {
+		t.Errorf("expected ErrorRPCInvalidMethod, got %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package bnet
+
+import (
+	"errors"
+	"github.com/HearthSim/hs-proto-go/bnet/rpc"
+	"github.com/golang/protobuf/proto"
+	"io"
+)
+
+// Default limits for packets read by a PacketCodec.  Headers can't be larger
+// than 0xffff bytes, as their length is sent as a 16-bit integer.
+const (
+	DefaultMaxHeaderSize = 0x1000
+	DefaultMaxBodySize   = 0x100000
+)
+
+var (
+	ErrHeaderTooLarge = errors.New("packet header exceeds size limit")
+	ErrBodyTooLarge   = errors.New("packet body exceeds size limit")
+)
+
+// A PacketCodec reads and writes RPC packets.  Each packet is a 16-bit
+// big-endian header length, followed by an encoded rpc.Header and then a body
+// of the size given in the header.
+type PacketCodec struct {
+	r io.Reader
+	w io.Writer
+
+	// Packets whose header or body are larger than these limits are rejected
+	// before anything is allocated for them.
+	MaxHeaderSize int
+	MaxBodySize   int
+
+	headerBuf []byte
+}
+
+func NewPacketCodec(r io.Reader, w io.Writer) *PacketCodec {
+	return &PacketCodec{
+		r:             r,
+		w:             w,
+		MaxHeaderSize: DefaultMaxHeaderSize,
+		MaxBodySize:   DefaultMaxBodySize,
+	}
+}
+
+// ReadPacket reads the next packet, blocking until all of it has arrived.  The
+// body is newly allocated on each call, so it may be retained by the caller.
+func (c *PacketCodec) ReadPacket() (*rpc.Header, []byte, error) {
+	var lenBuf [2]byte
+	_, err := io.ReadFull(c.r, lenBuf[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	headerLen := int(lenBuf[0])<<8 | int(lenBuf[1])
+	if headerLen > c.MaxHeaderSize {
+		return nil, nil, ErrHeaderTooLarge
+	}
+	if headerLen > len(c.headerBuf) {
+		c.headerBuf = make([]byte, headerLen)
+	}
+	headerBuf := c.headerBuf[:headerLen]
+	_, err = io.ReadFull(c.r, headerBuf)
+	if err != nil {
+		return nil, nil, unexpectedEOF(err)
+	}
+	header := &rpc.Header{}
+	err = proto.Unmarshal(headerBuf, header)
+	if err != nil {
+		return nil, nil, err
+	}
+	bodyLen := int64(header.GetSize())
+	if bodyLen > int64(c.MaxBodySize) {
+		return nil, nil, ErrBodyTooLarge
+	}
+	var body []byte
+	if bodyLen > 0 {
+		body = make([]byte, bodyLen)
+		_, err = io.ReadFull(c.r, body)
+		if err != nil {
+			return nil, nil, unexpectedEOF(err)
+		}
+	}
+	return header, body, nil
+}
+
+// WritePacket sets the header's size to the length of the body and writes the
+// packet built by MakePacket.
+func (c *PacketCodec) WritePacket(header *rpc.Header, body []byte) error {
+	header.Size = proto.Uint32(uint32(len(body)))
+	packet, err := MakePacket(header, body)
+	if err != nil {
+		return err
+	}
+	if len(packet)-2-len(body) > 0xffff {
+		return ErrHeaderTooLarge
+	}
+	_, err = c.w.Write(packet)
+	return err
+}
+
+// A stream ending partway through a packet is never a clean EOF.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
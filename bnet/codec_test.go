@@ -0,0 +1,139 @@
+package bnet
+
+import (
+	"bytes"
+	"github.com/HearthSim/hs-proto-go/bnet/rpc"
+	"github.com/golang/protobuf/proto"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func TestPacketCodecPartialReads(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewPacketCodec(nil, buf)
+	body := bytes.Repeat([]byte("stove"), 100)
+	for token := uint32(0); token < 3; token++ {
+		err := w.WritePacket(&rpc.Header{
+			ServiceId: proto.Uint32(1),
+			MethodId:  proto.Uint32(2),
+			Token:     proto.Uint32(token),
+		}, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := NewPacketCodec(iotest.OneByteReader(buf), nil)
+	for token := uint32(0); token < 3; token++ {
+		header, readBody, err := r.ReadPacket()
+		if err != nil {
+			t.Fatalf("packet %d: %v", token, err)
+		}
+		if header.GetToken() != token || header.GetMethodId() != 2 {
+			t.Errorf("packet %d: bad header %s", token, header.String())
+		}
+		if !bytes.Equal(readBody, body) {
+			t.Errorf("packet %d: body mismatch", token)
+		}
+	}
+	_, _, err := r.ReadPacket()
+	if err != io.EOF {
+		t.Errorf("expected EOF after last packet, got %v", err)
+	}
+}
+
+func TestPacketCodecLimits(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewPacketCodec(nil, buf)
+	err := w.WritePacket(&rpc.Header{
+		ServiceId: proto.Uint32(1),
+		Token:     proto.Uint32(1),
+	}, make([]byte, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := buf.Bytes()
+
+	r := NewPacketCodec(bytes.NewReader(packet), nil)
+	r.MaxBodySize = 99
+	_, _, err = r.ReadPacket()
+	if err != ErrBodyTooLarge {
+		t.Errorf("expected ErrBodyTooLarge, got %v", err)
+	}
+
+	r = NewPacketCodec(bytes.NewReader(packet), nil)
+	r.MaxHeaderSize = 1
+	_, _, err = r.ReadPacket()
+	if err != ErrHeaderTooLarge {
+		t.Errorf("expected ErrHeaderTooLarge, got %v", err)
+	}
+
+	r = NewPacketCodec(bytes.NewReader(packet[:len(packet)-1]), nil)
+	_, _, err = r.ReadPacket()
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("expected ErrUnexpectedEOF for a truncated packet, got %v", err)
+	}
+}
+
+func FuzzReadPacket(f *testing.F) {
+	packet, err := MakePacket(&rpc.Header{
+		ServiceId: proto.Uint32(0),
+		MethodId:  proto.Uint32(1),
+		Token:     proto.Uint32(7),
+		Size:      proto.Uint32(3),
+	}, []byte{1, 2, 3})
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(packet)
+	f.Add([]byte{0xff, 0xff})
+	f.Add([]byte{0x00, 0x02, 0x28, 0x80})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := NewPacketCodec(bytes.NewReader(data), nil)
+		r.MaxHeaderSize = 0x100
+		r.MaxBodySize = 0x1000
+		for {
+			header, body, err := r.ReadPacket()
+			if err != nil {
+				return
+			}
+			if len(body) != int(header.GetSize()) {
+				t.Fatalf("body length %d doesn't match header size %d",
+					len(body), header.GetSize())
+			}
+			if len(body) > r.MaxBodySize {
+				t.Fatalf("body length %d exceeds limit", len(body))
+			}
+		}
+	})
+}
+
+func FuzzPacketRoundTrip(f *testing.F) {
+	f.Add(uint32(0), uint32(1), uint32(0), []byte{})
+	f.Add(uint32(254), uint32(0), uint32(12), []byte("response"))
+	f.Fuzz(func(t *testing.T, serviceId, methodId, token uint32, body []byte) {
+		buf := &bytes.Buffer{}
+		c := NewPacketCodec(buf, buf)
+		err := c.WritePacket(&rpc.Header{
+			ServiceId: proto.Uint32(serviceId),
+			MethodId:  proto.Uint32(methodId),
+			Token:     proto.Uint32(token),
+		}, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header, readBody, err := c.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.GetServiceId() != serviceId ||
+			header.GetMethodId() != methodId ||
+			header.GetToken() != token {
+			t.Errorf("header mismatch: %s", header.String())
+		}
+		if !bytes.Equal(readBody, body) {
+			t.Errorf("body mismatch: %x != %x", readBody, body)
+		}
+	})
+}
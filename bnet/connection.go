@@ -1,6 +1,7 @@
 package bnet
 
 import (
+	"fmt"
 	"github.com/HearthSim/hs-proto-go/bnet/connection_service"
 	"github.com/HearthSim/hs-proto-go/bnet/rpc"
 	"github.com/golang/protobuf/proto"
@@ -47,16 +48,15 @@ func (s *ConnectionService) Invoke(method int, body []byte) (resp []byte, err er
 	case 3:
 		return s.Echo(body)
 	case 4:
-		return nil, s.ForceDisconnect(body)
+		return nil, Errorf(ErrorRPCInvalidMethod, "ForceDisconnect is only sent to clients")
 	case 5:
 		return nil, s.KeepAlive(body)
 	case 6:
-		return []byte{}, s.Encrypt(body)
+		return nil, s.Encrypt(body)
 	case 7:
 		return nil, s.RequestDisconnect(body)
 	default:
-		log.Panicf("error: ConnectionService.Invoke: unknown method %v", method)
-		return
+		return nil, Errorf(ErrorRPCInvalidMethod, "ConnectionService.Invoke: unknown method %v", method)
 	}
 }
 
@@ -67,6 +67,10 @@ func (s *ConnectionService) Connect(body []byte) ([]byte, error) {
 		return nil, err
 	}
 	log.Println("req:", req)
+	err = s.sess.Transition(StateConnected)
+	if err != nil {
+		return nil, err
+	}
 	bindReq := req.GetBindRequest()
 	serviceId := len(s.sess.exports)
 	exportedServiceIds := []uint32{}
@@ -85,8 +89,6 @@ func (s *ConnectionService) Connect(body []byte) ([]byte, error) {
 		s.sess.BindImport(int(id), hash)
 	}
 
-	s.sess.Transition(StateConnected)
-
 	now := time.Now()
 	nowNano := uint64(now.UnixNano())
 	nowSec := uint32(now.Unix())
@@ -121,18 +123,59 @@ func (s *ConnectionService) Echo(body []byte) ([]byte, error) {
 	return nil, nyi
 }
 
-func (s *ConnectionService) ForceDisconnect(body []byte) error {
-	return nyi
+// ForceDisconnect tells the client that the server is about to disconnect it,
+// with an error code and reason for the client to display.
+func (s *ConnectionService) ForceDisconnect(errorCode uint32, reason string) error {
+	body, err := proto.Marshal(&connection_service.DisconnectNotification{
+		ErrorCode: proto.Uint32(errorCode),
+		Reason:    proto.String(reason),
+	})
+	if err != nil {
+		return err
+	}
+	header := s.sess.MakeRequestHeader(s, 4, len(body))
+	return s.sess.QueuePacket(header, body)
 }
 
 func (s *ConnectionService) KeepAlive(body []byte) error {
 	return nil
 }
 
+// Encrypt upgrades the session to an encrypted stream, keyed by the session
+// key the client received in its LogonResult.  The response itself is the last
+// packet sent in the clear.
 func (s *ConnectionService) Encrypt(body []byte) error {
-	return nyi
+	req := connection_service.EncryptRequest{}
+	err := proto.Unmarshal(body, &req)
+	if err != nil {
+		return err
+	}
+	if len(s.sess.sessionKey) == 0 {
+		return fmt.Errorf("ConnectionService.Encrypt: client not authenticated")
+	}
+	// Key the streams before answering, so that the client is only told
+	// encryption is on once nothing can go wrong but a disconnect.
+	enc, dec, err := s.sess.newStreams()
+	if err != nil {
+		return err
+	}
+	s.sess.Respond(s.sess.receivedToken, []byte{})
+	err = s.sess.switchStreams(enc, dec)
+	if err != nil {
+		log.Printf("error: ConnectionService.Encrypt: %v", err)
+	}
+	return nil
 }
 
+// RequestDisconnect is sent by clients which are leaving, with the error code
+// which made them leave.
 func (s *ConnectionService) RequestDisconnect(body []byte) error {
-	return nyi
+	req := connection_service.DisconnectRequest{}
+	err := proto.Unmarshal(body, &req)
+	if err != nil {
+		return err
+	}
+	log.Printf("client requested disconnect with error code %d", req.GetErrorCode())
+	s.sess.Disconnect()
+	return nil
 }
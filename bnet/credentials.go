@@ -0,0 +1,72 @@
+package bnet
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// How long a cookie from GenerateTempCookie may be used to log on.
+const tempCookieLifetime = 5 * time.Minute
+
+// A credentialStore issues credentials which may be used once to log on
+// before they expire.
+type credentialStore struct {
+	lifetime time.Duration
+	now      func() time.Time
+
+	mutex  sync.Mutex
+	issued map[string]issuedCredential
+}
+
+type issuedCredential struct {
+	account Account
+	// The game account to play as after logging on, or 0 for the default.
+	gameAccountID uint64
+	expires       time.Time
+}
+
+func newCredentialStore(lifetime time.Duration) *credentialStore {
+	return &credentialStore{
+		lifetime: lifetime,
+		now:      time.Now,
+		issued:   map[string]issuedCredential{},
+	}
+}
+
+// issue returns a new credential for the account, sweeping out stale ones.
+func (c *credentialStore) issue(account Account, gameAccountID uint64) (string, error) {
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+
+	now := c.now()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for k, cred := range c.issued {
+		if !now.Before(cred.expires) {
+			delete(c.issued, k)
+		}
+	}
+	c.issued[token] = issuedCredential{account, gameAccountID, now.Add(c.lifetime)}
+	return token, nil
+}
+
+// redeem uses up a credential, returning what it was issued for if it's valid
+// for the email.
+func (c *credentialStore) redeem(email string, token []byte) (issuedCredential, bool) {
+	c.mutex.Lock()
+	cred, ok := c.issued[string(token)]
+	if ok {
+		delete(c.issued, string(token))
+	}
+	c.mutex.Unlock()
+	if !ok || cred.account.Email != email || !c.now().Before(cred.expires) {
+		return issuedCredential{}, false
+	}
+	return cred, true
+}
@@ -0,0 +1,107 @@
+package bnet
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net"
+)
+
+// A StreamCipher creates a keystream from the supplied key.  Once a client
+// requests encryption, a session uses one keystream for each direction.
+type StreamCipher func(key []byte) (cipher.Stream, error)
+
+// StreamCiphers maps the cipher names accepted by Server.SetCipher to their
+// implementations.
+var StreamCiphers = map[string]StreamCipher{
+	"arc4":    NewARC4Stream,
+	"aes-ctr": NewAESCTRStream,
+}
+
+// NewARC4Stream returns an ARC4 keystream.  It is the default cipher.
+func NewARC4Stream(key []byte) (cipher.Stream, error) {
+	c, err := rc4.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewAESCTRStream returns an AES keystream in counter mode.  Stream keys are
+// never reused between sessions, so a zero IV is safe.
+func NewAESCTRStream(key []byte) (cipher.Stream, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewCTR(block, make([]byte, block.BlockSize())), nil
+}
+
+// NewSessionKey returns fresh key material for a session.  The key is handed
+// to the client in its LogonResult once authentication succeeds.
+func NewSessionKey() []byte {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// StreamKeys derives the keys for server-to-client and client-to-server
+// traffic from a session key.  The derivation is stove's own, so only clients
+// built to talk to stove can follow it.
+func StreamKeys(sessionKey []byte) (serverKey, clientKey []byte) {
+	derive := func(label string) []byte {
+		mac := hmac.New(sha256.New, sessionKey)
+		mac.Write([]byte(label))
+		return mac.Sum(nil)
+	}
+	return derive("stove server stream"), derive("stove client stream")
+}
+
+// A streamConn is a connection whose reads and writes can each be switched
+// over to an encrypted stream.  The read half belongs to the goroutine reading
+// packets and the write half to the one pumping the packet queue, so neither
+// needs a lock.
+type streamConn struct {
+	net.Conn
+	r io.Reader
+	w io.Writer
+}
+
+func newStreamConn(c net.Conn) *streamConn {
+	return &streamConn{c, c, c}
+}
+
+func (c *streamConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *streamConn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+func (c *streamConn) encryptReads(s cipher.Stream) {
+	c.r = cipher.StreamReader{S: s, R: c.Conn}
+}
+
+func (c *streamConn) encryptWrites(s cipher.Stream) {
+	c.w = cipher.StreamWriter{S: s, W: c.Conn}
+}
+
+// SetCipher selects the stream cipher used by sessions which enable
+// encryption.
+func (s *Server) SetCipher(name string) error {
+	c, ok := StreamCiphers[name]
+	if !ok {
+		return fmt.Errorf("unknown stream cipher: %s", name)
+	}
+	s.cipher = c
+	return nil
+}
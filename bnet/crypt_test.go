@@ -0,0 +1,137 @@
+package bnet
+
+import (
+	"crypto/cipher"
+	"fmt"
+	"github.com/HearthSim/hs-proto-go/bnet/connection_service"
+	"github.com/HearthSim/hs-proto-go/bnet/rpc"
+	"github.com/golang/protobuf/proto"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestEncrypt(t *testing.T) {
+	for name, streamCipher := range StreamCiphers {
+		serv := NewServer()
+		serv.cipher = streamCipher
+		client, conn := net.Pipe()
+		sess := NewSession(serv, conn)
+		sess.sessionKey = NewSessionKey()
+		go serv.serveSession(sess)
+
+		plain := NewPacketCodec(client, client)
+		err := plain.WritePacket(&rpc.Header{
+			ServiceId: proto.Uint32(0),
+			MethodId:  proto.Uint32(6),
+			Token:     proto.Uint32(0),
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header, _, err := plain.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.GetServiceId() != 254 || header.GetToken() != 0 {
+			t.Fatalf("%s: bad Encrypt response: %s", name, header.String())
+		}
+
+		serverKey, clientKey := StreamKeys(sess.sessionKey)
+		dec, err := streamCipher(serverKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		enc, err := streamCipher(clientKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encrypted := NewPacketCodec(
+			cipher.StreamReader{S: dec, R: client},
+			cipher.StreamWriter{S: enc, W: client})
+
+		req, err := proto.Marshal(&connection_service.ConnectRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = encrypted.WritePacket(&rpc.Header{
+			ServiceId: proto.Uint32(0),
+			MethodId:  proto.Uint32(1),
+			Token:     proto.Uint32(1),
+		}, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header, body, err := encrypted.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.GetServiceId() != 254 || header.GetToken() != 1 {
+			t.Fatalf("%s: bad Connect response: %s", name, header.String())
+		}
+		res := connection_service.ConnectResponse{}
+		err = proto.Unmarshal(body, &res)
+		if err != nil {
+			t.Fatalf("%s: Connect response decode: %v", name, err)
+		}
+		if res.GetBindResult() != 0 {
+			t.Errorf("%s: bad bind result %d", name, res.GetBindResult())
+		}
+		sess.Disconnect()
+	}
+}
+
+func TestEncryptFailure(t *testing.T) {
+	serv := NewServer()
+	serv.cipher = func(key []byte) (cipher.Stream, error) {
+		return nil, fmt.Errorf("no cipher")
+	}
+	client, conn := net.Pipe()
+	sess := NewSession(serv, conn)
+	defer sess.Disconnect()
+	sess.sessionKey = NewSessionKey()
+	go serv.serveSession(sess)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	codec := NewPacketCodec(client, client)
+	for token := uint32(0); token < 2; token++ {
+		err := codec.WritePacket(&rpc.Header{
+			ServiceId: proto.Uint32(0),
+			MethodId:  proto.Uint32(6),
+			Token:     proto.Uint32(token),
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Each request is answered once, with an error, and the session
+		// carries on in the clear.
+		header, _, err := codec.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.GetServiceId() != 254 || header.GetToken() != token || header.GetStatus() == ErrorOK {
+			t.Fatalf("expected Encrypt %d to fail, got %s", token, header.String())
+		}
+	}
+}
+
+func TestEncryptDisconnected(t *testing.T) {
+	// Nothing pumps the queue of a session which has disconnected.
+	sess := newTestSession()
+	sess.server = NewServer()
+	sess.sessionKey = NewSessionKey()
+	sess.packetQueue = make(chan queuedPacket)
+	close(sess.quit)
+	done := make(chan error, 1)
+	go func() {
+		done <- sess.EnableEncryption()
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("enabled encryption on a disconnected session")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("EnableEncryption blocked on a disconnected session")
+	}
+}
@@ -27,13 +27,45 @@ func Migrate() {
 	db.LogMode(true)
 	err := db.AutoMigrate(
 		&Account{},
+		&GameAccount{},
+		&AccountGameAccount{},
+		&AccountLicense{},
+		&Suspension{},
 		&Friend{},
 		&InvitationRequest{},
+		&BlockedAccount{},
 	).Error
 
 	if err != nil {
 		panic(err)
 	}
+
+	accounts := []Account{}
+	db.Order("id").Find(&accounts)
+	for _, account := range accounts {
+		// Accounts from before the account state was stored were all shown
+		// as US accounts with license 1.
+		if len(account.Country) == 0 {
+			account.Country = "United States"
+			account.PreferredRegion = regionIDs["US"]
+			db.Save(&account)
+		}
+		count := 0
+		db.Model(&AccountLicense{}).Where("account_id = ?", account.ID).Count(&count)
+		if count == 0 {
+			db.Create(&AccountLicense{AccountID: account.ID, LicenseID: 1})
+		}
+
+		// Accounts from before game accounts were stored get a pegasus game
+		// account.  Going through the accounts in order, an empty table
+		// hands out the same ids as the bnet accounts', which their pegasus
+		// accounts were keyed by.
+		count = 0
+		db.Model(&AccountGameAccount{}).Where("account_id = ?", account.ID).Count(&count)
+		if count == 0 {
+			createGameAccount(account.ID, "WTCG", account.preferredRegion())
+		}
+	}
 }
 
 // EntityIDs are a 128-bit GUID applied to various entities in the bnet system.
@@ -72,32 +104,159 @@ const BnetAccountEntityIDHi uint64 = (EntityIDKindAccount << 56) |
 const BnetGameAccountEntityIDHi uint64 = (EntityIDKindGameAccount << 56) |
 	(EntityIDRegionTest << 32) |
 	(EntityIDGamePegasus)
+const BnetChannelEntityIDHi uint64 = (EntityIDKindChannel << 56) |
+	(EntityIDRegionTest << 32) |
+	(EntityIDGameNone)
 
 type Account struct {
 	// The lo part of the full entity id
 	ID            uint64
 	Email         string
 	WebCredential string
+	// bcrypt hash of the password, used by BcryptAuthenticator
+	PasswordHash string
 	// Formatted as Name#1234
-	BattleTag    string
-	Flags        int64
-	GameAccounts []GameAccount
+	BattleTag string
+	FullName  string
+	// The country name shown to the client, e.g. United States
+	Country string
+	// The region id the account plays in by default, e.g. 1 for US
+	PreferredRegion uint32
+	Flags           int64
+	GameAccounts    []GameAccount
 }
 
 type GameAccount struct {
 	// This ID must be the same as the account ID in the game's db.
 	ID        int64
 	CreatedAt time.Time
-	Game      string
-	Region    string
+	// The FourCC of the program, e.g. WTCG
+	Game string
+	// Two letter region code, e.g. US
+	Region string
+	Flags  int64
 }
 
+// Links a bnet account to each of its game accounts.
 type AccountGameAccount struct {
 	ID            int64
 	AccountID     int64
 	GameAccountID int64
 }
 
+// A license the account owns, such as a game or an expansion.  Licenses which
+// only apply to one game account have its id.
+type AccountLicense struct {
+	ID            int64
+	AccountID     uint64
+	GameAccountID int64
+	LicenseID     uint32
+	// Zero if the license doesn't expire.
+	Expires time.Time
+}
+
+// The region ids of the two letter region codes.
+var regionIDs = map[string]uint32{
+	"US": 1,
+	"EU": 2,
+	"KR": 3,
+	"TW": 4,
+	"CN": 5,
+}
+
+// regionName returns the two letter code of a region id, or "" if the id isn't
+// known.
+func regionName(id uint32) string {
+	for name, regionID := range regionIDs {
+		if regionID == id {
+			return name
+		}
+	}
+	return ""
+}
+
+// preferredRegion returns the code of the region the account's game accounts
+// are created in by default; US if the account doesn't prefer a known one.
+func (a *Account) preferredRegion() string {
+	if region := regionName(a.PreferredRegion); len(region) != 0 {
+		return region
+	}
+	return "US"
+}
+
+// accountByID returns the bnet account with the given id, or nil if there's no
+// such account.
+func accountByID(id uint64) *Account {
+	account := []Account{}
+	db.Where("id = ?", id).First(&account)
+	if len(account) == 0 {
+		return nil
+	}
+	return &account[0]
+}
+
+// accountByBattleTag returns the bnet account with the given BattleTag, or nil
+// if there's no such account.
+func accountByBattleTag(battleTag string) *Account {
+	account := []Account{}
+	db.Where("battle_tag = ?", battleTag).First(&account)
+	if len(account) == 0 {
+		return nil
+	}
+	return &account[0]
+}
+
+// accountIDForGameAccount returns the id of the bnet account which owns a game
+// account, or 0 if there's no such game account.
+func accountIDForGameAccount(gameAccountID int64) uint64 {
+	link := []AccountGameAccount{}
+	db.Where("game_account_id = ?", gameAccountID).First(&link)
+	if len(link) == 0 {
+		return 0
+	}
+	return uint64(link[0].AccountID)
+}
+
+// gameAccountsFor returns a bnet account's game accounts for a program, oldest
+// first.  An empty program returns the game accounts of every program.
+func gameAccountsFor(accountID uint64, program string) []GameAccount {
+	res := []GameAccount{}
+	q := db.Table("game_account").
+		Joins("join account_game_account on account_game_account.game_account_id = game_account.id").
+		Where("account_game_account.account_id = ?", accountID)
+	if len(program) != 0 {
+		q = q.Where("game_account.game = ?", program)
+	}
+	q.Order("game_account.id").Find(&res)
+	return res
+}
+
+// createGameAccount gives a bnet account a new game account of a program in a
+// region, given by its two letter code.
+func createGameAccount(accountID uint64, program, region string) GameAccount {
+	gameAccount := GameAccount{
+		CreatedAt: time.Now(),
+		Game:      program,
+		Region:    region,
+	}
+	db.Create(&gameAccount)
+	db.Create(&AccountGameAccount{
+		AccountID:     int64(accountID),
+		GameAccountID: gameAccount.ID,
+	})
+	return gameAccount
+}
+
+// licensesFor returns the licenses of a bnet account, or of one of its game
+// accounts if gameAccountID isn't 0.
+func licensesFor(accountID uint64, gameAccountID int64) []AccountLicense {
+	res := []AccountLicense{}
+	db.Where("account_id = ? and game_account_id = ?", accountID, gameAccountID).
+		Order("license_id").
+		Find(&res)
+	return res
+}
+
 type Friend struct {
 	ID     int64
 	Source uint64 // pointing to Account table
@@ -111,3 +270,11 @@ type InvitationRequest struct {
 	CreationTime   time.Time
 	ExpirationTime time.Time
 }
+
+// An account in another account's block list may not invite it to be friends.
+type BlockedAccount struct {
+	ID        int64
+	AccountID uint64
+	BlockedID uint64
+	CreatedAt time.Time
+}
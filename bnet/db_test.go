@@ -0,0 +1,24 @@
+package bnet
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestMain runs the tests against an empty database of their own.
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "bnet")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	os.Setenv("BNET_DB", filepath.Join(dir, "bnet.db"))
+	db = openDB()
+	Migrate()
+	db.LogMode(false)
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
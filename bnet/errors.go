@@ -1,6 +1,78 @@
 package bnet
 
+import (
+	"fmt"
+)
+
+// Error codes understood by bnet clients.  These are sent as the status of a
+// failed RPC and as the error code of results such as LogonResult.
 const (
-	ErrorOK     = 0
-	ErrorNoAuth = 10
+	ErrorOK                   = 0
+	ErrorInternal             = 1
+	ErrorTimedOut             = 2
+	ErrorDenied               = 3
+	ErrorNotExists            = 4
+	ErrorNotStarted           = 5
+	ErrorInProgress           = 6
+	ErrorInvalidArgs          = 7
+	ErrorInvalidSubscriber    = 8
+	ErrorWaitingForDependency = 9
+	ErrorNoAuth               = 10
+	ErrorNoGameAccount        = 12
+	ErrorNotImplemented       = 13
+	ErrorGameAccountBanned    = 42
+	ErrorGameAccountSuspended = 43
+
+	ErrorRPCServiceNotBound  = 3001
+	ErrorRPCPeerDisconnected = 3005
+	ErrorRPCRequestTimedOut  = 3006
+	ErrorRPCInvalidService   = 3010
+	ErrorRPCInvalidMethod    = 3011
+	ErrorRPCMalformedRequest = 3013
+	ErrorRPCQuotaExceeded    = 3014
+	ErrorRPCNotImplemented   = 3015
+	ErrorRPCServerError      = 3016
+	ErrorRPCShutdown         = 3017
+	ErrorRPCDisconnect       = 3018
+	ErrorRPCDisconnectIdle   = 3019
+	ErrorRPCProtocolError    = 3020
+
+	ErrorFriendsTooManySentInvitations     = 5003
+	ErrorFriendsTooManyReceivedInvitations = 5004
+	ErrorFriendsFriendshipAlreadyExists    = 5005
+	ErrorFriendsFriendshipDoesNotExist     = 5006
+	ErrorFriendsInvitationAlreadyExists    = 5007
+	ErrorFriendsInvalidInvitation          = 5008
+	ErrorFriendsAccountBlocked             = 5011
+	ErrorFriendsInviteeAtMaxFriends        = 5017
+	ErrorFriendsInviterAtMaxFriends        = 5018
 )
+
+// An Error is returned by service methods to fail the call with a specific
+// bnet error code.  Any other error fails the call with ErrorInternal.
+type Error struct {
+	Code   uint32
+	Reason string
+}
+
+// Errorf returns an Error with the code and a formatted reason.  The reason is
+// only logged; clients only see the code.
+func Errorf(code uint32, format string, a ...interface{}) error {
+	return &Error{code, fmt.Sprintf(format, a...)}
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (bnet error %d)", e.Reason, e.Code)
+}
+
+// ErrorCode returns the bnet error code which should be reported to the client
+// for err.
+func ErrorCode(err error) uint32 {
+	if err == nil {
+		return ErrorOK
+	}
+	if e, ok := err.(*Error); ok {
+		return e.Code
+	}
+	return ErrorInternal
+}
@@ -8,6 +8,30 @@ import (
 	"github.com/HearthSim/hs-proto-go/bnet/role"
 	"github.com/golang/protobuf/proto"
 	"log"
+	"time"
+)
+
+// Limits on friends and invitations, which are advertised to the client by
+// SubscribeToFriends.
+const (
+	maxFriends             = 200
+	maxReceivedInvitations = 1000
+	maxSentInvitations     = 20
+)
+
+// How long a friend invitation waits to be accepted.
+const invitationLifetime = 14 * 24 * time.Hour
+
+// How often expired friend invitations are removed.
+const invitationSweepInterval = time.Minute
+
+// Reasons sent with InvitationNotifications of removed invitations.
+const (
+	invitationRemovedAccepted = iota
+	invitationRemovedDeclined
+	invitationRemovedRevoked
+	invitationRemovedIgnored
+	invitationRemovedExpired
 )
 
 type FriendsServiceBinder struct{}
@@ -72,8 +96,7 @@ func (s *FriendsService) Invoke(method int, body []byte) (resp []byte, err error
 	case 12:
 		return []byte{}, s.RevokeAllInvitations(body)
 	default:
-		log.Panicf("error: FriendsService.Invoke: unknown method %v", method)
-		return
+		return nil, Errorf(ErrorRPCInvalidMethod, "FriendsService.Invoke: unknown method %v", method)
 	}
 }
 
@@ -85,14 +108,15 @@ func (s *FriendsService) SubscribeToFriends(body []byte) ([]byte, error) {
 	}
 
 	// get user EntityId from session data
-	log.Printf("FriendsService: SubscribeToFriends: Account EntityId [%s]", s.sess.account.ID)
+	log.Printf("FriendsService: SubscribeToFriends: Account EntityId [%d]", s.sess.account.ID)
 
 	log.Printf("req = %s", req.String())
 
+	s.sess.friendsSubscribed = true
 	res := friends_service.SubscribeToFriendsResponse{}
-	res.MaxFriends = proto.Uint32(200)
-	res.MaxReceivedInvitations = proto.Uint32(1000)
-	res.MaxSentInvitations = proto.Uint32(20)
+	res.MaxFriends = proto.Uint32(maxFriends)
+	res.MaxReceivedInvitations = proto.Uint32(maxReceivedInvitations)
+	res.MaxSentInvitations = proto.Uint32(maxSentInvitations)
 
 	// add roles
 	res.Role = []*role.Role{
@@ -101,51 +125,47 @@ func (s *FriendsService) SubscribeToFriends(body []byte) ([]byte, error) {
 	}
 
 	// handle friends
-	friendIDs := struct{ ID uint64 }{}
-	db.Table("friend").Select("Target as ID").Where("Source = ?", s.sess.account.ID).Scan(&friendIDs)
-	friends := []Account{}
-	db.Where(friendIDs).Find(&friends)
-
-	for _, friend := range friends {
-		// TODO: add real name, instead using battleTag?
-		f := friends_types.Friend{
-			Id:        EntityId(BnetAccountEntityIDHi, friend.ID),
-			FullName:  proto.String(friend.BattleTag),
-			BattleTag: proto.String(friend.BattleTag),
-			Role:      []uint32{1},
-		}
-		res.Friends = append(res.Friends, &f)
+	friends := friendsOf(s.sess.account.ID)
+	for i := range friends {
+		res.Friends = append(res.Friends, friend(&friends[i]))
 	}
 
 	// handle invitations
+	now := time.Now()
 	res.ReceivedInvitations = []*invitation_types.Invitation{}
 	invitationRequests := []InvitationRequest{}
-	db.Table("invitation_request").Where("invitee_id = ?", s.sess.account.ID).Find(&invitationRequests)
-
+	db.Where("invitee_id = ?", s.sess.account.ID).Find(&invitationRequests)
 	for _, ir := range invitationRequests {
-		// TODO: Check for expired invitations
-		accounts := []Account{}
-		db.Where("id = ?", ir.InviterID).First(&accounts)
-		if len(accounts) > 0 {
-			res.ReceivedInvitations = append(
-				res.ReceivedInvitations,
-				&invitation_types.Invitation{
-					Id:          proto.Uint64(ir.ID),
-					InviterName: proto.String(accounts[0].BattleTag),
-					InviterIdentity: &entity.Identity{
-						AccountId: EntityId(BnetAccountEntityIDHi, accounts[0].ID),
-					},
-					InviteeIdentity: &entity.Identity{
-						AccountId: EntityId(BnetAccountEntityIDHi, s.sess.account.ID),
-					},
-				})
-		} else {
-			// TODO: Remove invalid invitation from DB
-			log.Printf("Account %+v not found. Skipping this invitation.", ir)
+		if !now.Before(ir.ExpirationTime) {
+			// The sweep will get to it.
+			continue
 		}
+		inviter := accountByID(ir.InviterID)
+		if inviter == nil {
+			log.Printf("Account %+v not found. Deleting this invitation.", ir)
+			db.Delete(&ir)
+			continue
+		}
+		res.ReceivedInvitations = append(res.ReceivedInvitations,
+			ir.invitation(inviter, &s.sess.account))
 	}
 
 	res.SentInvitations = []*invitation_types.Invitation{}
+	invitationRequests = []InvitationRequest{}
+	db.Where("inviter_id = ?", s.sess.account.ID).Find(&invitationRequests)
+	for _, ir := range invitationRequests {
+		if !now.Before(ir.ExpirationTime) {
+			continue
+		}
+		invitee := accountByID(ir.InviteeID)
+		if invitee == nil {
+			log.Printf("Account %+v not found. Deleting this invitation.", ir)
+			db.Delete(&ir)
+			continue
+		}
+		res.SentInvitations = append(res.SentInvitations,
+			ir.invitation(&s.sess.account, invitee))
+	}
 
 	resBuf, err := proto.Marshal(&res)
 	if err != nil {
@@ -154,47 +174,300 @@ func (s *FriendsService) SubscribeToFriends(body []byte) ([]byte, error) {
 	return resBuf, nil
 }
 
+// SendInvitation invites the account with the BattleTag or email address the
+// client asks for to be friends.
 func (s *FriendsService) SendInvitation(body []byte) error {
 	log.Printf("FriendService: Send Invitation")
-	return nyi
-}
-
-func (s *FriendsService) AcceptInvitation(body []byte) error {
-	log.Printf("FriendsService: Accept Invitation")
-	req := invitation_types.GenericRequest{}
+	req := invitation_types.SendInvitationRequest{}
 	err := proto.Unmarshal(body, &req)
 	if err != nil {
 		return err
 	}
 	log.Printf("req = %s", req.String())
+	if s.sess.State() != StateReady {
+		return Errorf(ErrorNoAuth, "SendInvitation: not logged on")
+	}
 
+	inviter := &s.sess.account
+	invitee := invitationTarget(&req)
+	if invitee == nil {
+		return Errorf(ErrorNotExists, "SendInvitation: no such account: %s", req.GetTarget().String())
+	}
+	if invitee.ID == inviter.ID {
+		return Errorf(ErrorInvalidArgs, "SendInvitation: account %d invited itself", inviter.ID)
+	}
+	if areFriends(inviter.ID, invitee.ID) {
+		return Errorf(ErrorFriendsFriendshipAlreadyExists, "SendInvitation: %d and %d are already friends",
+			inviter.ID, invitee.ID)
+	}
+	if isBlocked(invitee.ID, inviter.ID) {
+		return Errorf(ErrorFriendsAccountBlocked, "SendInvitation: %d has blocked %d",
+			invitee.ID, inviter.ID)
+	}
+	count := 0
+	db.Model(&InvitationRequest{}).
+		Where("(inviter_id = ? and invitee_id = ?) or (inviter_id = ? and invitee_id = ?)",
+			inviter.ID, invitee.ID, invitee.ID, inviter.ID).
+		Count(&count)
+	if count != 0 {
+		return Errorf(ErrorFriendsInvitationAlreadyExists, "SendInvitation: %d and %d already invited each other",
+			inviter.ID, invitee.ID)
+	}
+	count = 0
+	db.Model(&InvitationRequest{}).Where("inviter_id = ?", inviter.ID).Count(&count)
+	if count >= maxSentInvitations {
+		return Errorf(ErrorFriendsTooManySentInvitations, "SendInvitation: %d has sent %d invitations",
+			inviter.ID, count)
+	}
+	count = 0
+	db.Model(&InvitationRequest{}).Where("invitee_id = ?", invitee.ID).Count(&count)
+	if count >= maxReceivedInvitations {
+		return Errorf(ErrorFriendsTooManyReceivedInvitations, "SendInvitation: %d has received %d invitations",
+			invitee.ID, count)
+	}
+	if n := friendCount(inviter.ID); n >= maxFriends {
+		return Errorf(ErrorFriendsInviterAtMaxFriends, "SendInvitation: %d has %d friends", inviter.ID, n)
+	}
+	if n := friendCount(invitee.ID); n >= maxFriends {
+		return Errorf(ErrorFriendsInviteeAtMaxFriends, "SendInvitation: %d has %d friends", invitee.ID, n)
+	}
+
+	now := time.Now()
+	ir := InvitationRequest{
+		InviterID:      inviter.ID,
+		InviteeID:      invitee.ID,
+		CreationTime:   now,
+		ExpirationTime: now.Add(invitationLifetime),
+	}
+	db.Create(&ir)
+	log.Printf("account %d invited %d to be friends", inviter.ID, invitee.ID)
+
+	invitation := ir.invitation(inviter, invitee)
+	s.sess.server.notifyFriends(inviter.ID, func(notify *FriendsNotifyService) {
+		notify.NotifySentInvitationAdded(invitation, 0)
+	})
+	s.sess.server.notifyFriends(invitee.ID, func(notify *FriendsNotifyService) {
+		notify.NotifyReceivedInvitationAdded(invitation, 0)
+	})
+	return nil
+}
+
+// invitationTarget returns the account a SendInvitationRequest is for, or nil
+// if there's no such account.
+func invitationTarget(req *invitation_types.SendInvitationRequest) *Account {
+	target := req.GetTarget()
+	switch {
+	case len(target.GetBattleTag()) != 0:
+		return accountByBattleTag(target.GetBattleTag())
+	case len(target.GetEmail()) != 0:
+		account, err := accountByEmail(target.GetEmail())
+		if err != nil {
+			return nil
+		}
+		return account
+	case target.GetIdentity().GetAccountId() != nil:
+		return accountByID(target.GetIdentity().GetAccountId().GetLow())
+	case req.GetTargetId().GetHigh() == BnetAccountEntityIDHi:
+		return accountByID(req.GetTargetId().GetLow())
+	}
+	return nil
+}
+
+func areFriends(a, b uint64) bool {
+	count := 0
+	db.Model(&Friend{}).Where("source = ? and target = ?", a, b).Count(&count)
+	return count != 0
+}
+
+func friendCount(accountID uint64) int {
+	count := 0
+	db.Model(&Friend{}).Where("source = ?", accountID).Count(&count)
+	return count
+}
+
+// friendsOf returns the accounts which are friends with an account.
+func friendsOf(accountID uint64) []Account {
+	friends := []Account{}
+	db.Table("account").
+		Joins("join friend on friend.target = account.id").
+		Where("friend.source = ?", accountID).
+		Find(&friends)
+	return friends
+}
+
+// isBlocked returns whether an account has blocked another from inviting it.
+func isBlocked(accountID, blockedID uint64) bool {
+	count := 0
+	db.Model(&BlockedAccount{}).Where("account_id = ? and blocked_id = ?", accountID, blockedID).Count(&count)
+	return count != 0
+}
+
+// invitation returns the invitation as sent to clients.
+func (ir *InvitationRequest) invitation(inviter, invitee *Account) *invitation_types.Invitation {
+	return &invitation_types.Invitation{
+		Id:          proto.Uint64(ir.ID),
+		InviterName: proto.String(inviter.BattleTag),
+		InviteeName: proto.String(invitee.BattleTag),
+		InviterIdentity: &entity.Identity{
+			AccountId: EntityId(BnetAccountEntityIDHi, inviter.ID),
+		},
+		InviteeIdentity: &entity.Identity{
+			AccountId: EntityId(BnetAccountEntityIDHi, invitee.ID),
+		},
+		CreationTime:   proto.Uint64(Timestamp(ir.CreationTime)),
+		ExpirationTime: proto.Uint64(Timestamp(ir.ExpirationTime)),
+	}
+}
+
+// friend returns the account as sent to clients in their friend list.
+func friend(account *Account) *friends_types.Friend {
+	// TODO: add real name, instead using battleTag?
+	return &friends_types.Friend{
+		Id:        EntityId(BnetAccountEntityIDHi, account.ID),
+		FullName:  proto.String(account.BattleTag),
+		BattleTag: proto.String(account.BattleTag),
+		Role:      []uint32{1},
+	}
+}
+
+// receivedInvitation returns an unexpired invitation the session's account
+// received.
+func (s *FriendsService) receivedInvitation(invitationID uint64) (*InvitationRequest, error) {
+	ir, err := s.invitation(invitationID)
+	if err == nil && ir.InviteeID != s.sess.account.ID {
+		err = Errorf(ErrorFriendsInvalidInvitation, "FriendsService: account %d didn't receive invitation %d",
+			s.sess.account.ID, invitationID)
+	}
+	return ir, err
+}
+
+// sentInvitation returns an unexpired invitation the session's account sent.
+func (s *FriendsService) sentInvitation(invitationID uint64) (*InvitationRequest, error) {
+	ir, err := s.invitation(invitationID)
+	if err == nil && ir.InviterID != s.sess.account.ID {
+		err = Errorf(ErrorFriendsInvalidInvitation, "FriendsService: account %d didn't send invitation %d",
+			s.sess.account.ID, invitationID)
+	}
+	return ir, err
+}
+
+func (s *FriendsService) invitation(invitationID uint64) (*InvitationRequest, error) {
+	if s.sess.State() != StateReady {
+		return nil, Errorf(ErrorNoAuth, "FriendsService: not logged on")
+	}
 	ir := []InvitationRequest{}
-	db.Where("id = ?", req.GetInvitationId()).First(&ir)
+	db.Where("id = ?", invitationID).First(&ir)
+	if len(ir) == 0 || !time.Now().Before(ir[0].ExpirationTime) {
+		return nil, Errorf(ErrorFriendsInvalidInvitation, "FriendsService: no invitation %d", invitationID)
+	}
+	return &ir[0], nil
+}
+
+// removeInvitation deletes an invitation and tells both accounts why it's gone.
+// If it was accepted, they're now friends.  The inviter isn't told that it was
+// ignored, only that it was declined.
+func (s *Server) removeInvitation(ir *InvitationRequest, reason uint32) {
+	db.Delete(ir)
+	inviter := accountByID(ir.InviterID)
+	invitee := accountByID(ir.InviteeID)
+	if inviter == nil || invitee == nil {
+		log.Printf("Account %+v not found. Deleted this invitation.", *ir)
+		return
+	}
 
-	if len(ir) > 0 {
+	accepted := reason == invitationRemovedAccepted
+	if accepted && !areFriends(inviter.ID, invitee.ID) {
 		friend1 := Friend{
-			Source: ir[0].InviterID,
-			Target: ir[0].InviteeID,
+			Source: inviter.ID,
+			Target: invitee.ID,
 		}
 		db.Create(&friend1)
 		friend2 := Friend{
-			Source: ir[0].InviteeID,
-			Target: ir[0].InviterID,
+			Source: invitee.ID,
+			Target: inviter.ID,
 		}
 		db.Create(&friend2)
-		db.Delete(&ir[0])
-	} else {
-		log.Printf("Invitation request not found")
 	}
 
-	// TODO: Notify both accounts (if online) about accepted friendship
+	invitation := ir.invitation(inviter, invitee)
+	inviterReason := reason
+	if reason == invitationRemovedIgnored {
+		inviterReason = invitationRemovedDeclined
+	}
+	s.notifyFriends(inviter.ID, func(notify *FriendsNotifyService) {
+		notify.NotifySentInvitationRemoved(invitation, inviterReason)
+		if accepted {
+			notify.NotifyFriendAdded(friend(invitee))
+		}
+	})
+	s.notifyFriends(invitee.ID, func(notify *FriendsNotifyService) {
+		notify.NotifyReceivedInvitationRemoved(invitation, reason)
+		if accepted {
+			notify.NotifyFriendAdded(friend(inviter))
+		}
+	})
+}
+
+// sweepInvitations periodically removes expired friend invitations, until stop
+// is closed.
+func (s *Server) sweepInvitations(stop <-chan struct{}) {
+	ticker := time.NewTicker(invitationSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.removeExpiredInvitations(time.Now())
+		case <-stop:
+			return
+		}
+	}
+}
+
+// removeExpiredInvitations removes the invitations which expired by now.
+func (s *Server) removeExpiredInvitations(now time.Time) {
+	expired := []InvitationRequest{}
+	db.Where("expiration_time <= ?", now).Find(&expired)
+	for i := range expired {
+		s.removeInvitation(&expired[i], invitationRemovedExpired)
+	}
+}
 
+func (s *FriendsService) AcceptInvitation(body []byte) error {
+	log.Printf("FriendsService: Accept Invitation")
+	req := invitation_types.GenericRequest{}
+	err := proto.Unmarshal(body, &req)
+	if err != nil {
+		return err
+	}
+	log.Printf("req = %s", req.String())
+	ir, err := s.receivedInvitation(req.GetInvitationId())
+	if err != nil {
+		return err
+	}
+	if n := friendCount(ir.InviteeID); n >= maxFriends {
+		return Errorf(ErrorFriendsInviteeAtMaxFriends, "AcceptInvitation: %d has %d friends", ir.InviteeID, n)
+	}
+	if n := friendCount(ir.InviterID); n >= maxFriends {
+		return Errorf(ErrorFriendsInviterAtMaxFriends, "AcceptInvitation: %d has %d friends", ir.InviterID, n)
+	}
+	s.sess.server.removeInvitation(ir, invitationRemovedAccepted)
 	return nil
 }
 
 func (s *FriendsService) RevokeInvitation(body []byte) error {
 	log.Printf("FriendsService: Revoke Invitation")
-	return nyi
+	req := invitation_types.GenericRequest{}
+	err := proto.Unmarshal(body, &req)
+	if err != nil {
+		return err
+	}
+	log.Printf("req = %s", req.String())
+	ir, err := s.sentInvitation(req.GetInvitationId())
+	if err != nil {
+		return err
+	}
+	s.sess.server.removeInvitation(ir, invitationRemovedRevoked)
+	return nil
 }
 
 func (s *FriendsService) DeclineInvitation(body []byte) error {
@@ -205,18 +478,37 @@ func (s *FriendsService) DeclineInvitation(body []byte) error {
 		return err
 	}
 	log.Printf("req = %s", req.String())
-
-	ir := InvitationRequest{}
-	db.Where("id = ?", req.GetInvitationId()).First(&ir)
-	db.Delete(&ir)
-
-	// TODO: Notify both accounts about declined invitation
+	ir, err := s.receivedInvitation(req.GetInvitationId())
+	if err != nil {
+		return err
+	}
+	s.sess.server.removeInvitation(ir, invitationRemovedDeclined)
 	return nil
 }
 
+// IgnoreInvitation declines an invitation and blocks the inviter from inviting
+// the account again.
 func (s *FriendsService) IgnoreInvitation(body []byte) error {
 	log.Printf("FriendsService: Ignore Invitation")
-	return nyi
+	req := invitation_types.GenericRequest{}
+	err := proto.Unmarshal(body, &req)
+	if err != nil {
+		return err
+	}
+	log.Printf("req = %s", req.String())
+	ir, err := s.receivedInvitation(req.GetInvitationId())
+	if err != nil {
+		return err
+	}
+	if !isBlocked(ir.InviteeID, ir.InviterID) {
+		db.Create(&BlockedAccount{
+			AccountID: ir.InviteeID,
+			BlockedID: ir.InviterID,
+			CreatedAt: time.Now(),
+		})
+	}
+	s.sess.server.removeInvitation(ir, invitationRemovedIgnored)
+	return nil
 }
 
 func (s *FriendsService) AssignRole(body []byte) error {
@@ -226,12 +518,67 @@ func (s *FriendsService) AssignRole(body []byte) error {
 
 func (s *FriendsService) RemoveFriend(body []byte) ([]byte, error) {
 	log.Printf("FriendsService: Remove Friend")
-	return nil, nyi
+	req := friends_service.GenericFriendRequest{}
+	err := proto.Unmarshal(body, &req)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("req = %s", req.String())
+	if s.sess.State() != StateReady {
+		return nil, Errorf(ErrorNoAuth, "RemoveFriend: not logged on")
+	}
+	account := &s.sess.account
+	target := req.GetTargetId()
+	if target.GetHigh() != BnetAccountEntityIDHi || !areFriends(account.ID, target.GetLow()) {
+		return nil, Errorf(ErrorFriendsFriendshipDoesNotExist, "RemoveFriend: %d isn't friends with %s",
+			account.ID, target.String())
+	}
+	removed := accountByID(target.GetLow())
+	if removed == nil {
+		removed = &Account{ID: target.GetLow()}
+	}
+	db.Where("(source = ? and target = ?) or (source = ? and target = ?)",
+		account.ID, removed.ID, removed.ID, account.ID).
+		Delete(Friend{})
+	log.Printf("account %d removed friend %d", account.ID, removed.ID)
+
+	s.sess.server.notifyFriends(account.ID, func(notify *FriendsNotifyService) {
+		notify.NotifyFriendRemoved(friend(removed))
+	})
+	s.sess.server.notifyFriends(removed.ID, func(notify *FriendsNotifyService) {
+		notify.NotifyFriendRemoved(friend(account))
+	})
+	res := friends_service.GenericFriendResponse{
+		TargetFriend: friend(removed),
+	}
+	return proto.Marshal(&res)
 }
 
+// ViewFriends lists the friends of the client's account or of one of its
+// friends.
 func (s *FriendsService) ViewFriends(body []byte) ([]byte, error) {
 	log.Printf("FriendsService: View Friends")
-	return nil, nyi
+	req := friends_service.ViewFriendsRequest{}
+	err := proto.Unmarshal(body, &req)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("req = %s", req.String())
+	if s.sess.State() != StateReady {
+		return nil, Errorf(ErrorNoAuth, "ViewFriends: not logged on")
+	}
+	target := req.GetTargetId()
+	if target.GetHigh() != BnetAccountEntityIDHi ||
+		(target.GetLow() != s.sess.account.ID && !areFriends(s.sess.account.ID, target.GetLow())) {
+		return nil, Errorf(ErrorDenied, "ViewFriends: %d may not view the friends of %s",
+			s.sess.account.ID, target.String())
+	}
+	res := friends_service.ViewFriendsResponse{}
+	friends := friendsOf(target.GetLow())
+	for i := range friends {
+		res.Friends = append(res.Friends, friend(&friends[i]))
+	}
+	return proto.Marshal(&res)
 }
 
 func (s *FriendsService) UpdateFriendState(body []byte) error {
@@ -241,10 +588,127 @@ func (s *FriendsService) UpdateFriendState(body []byte) error {
 
 func (s *FriendsService) UnsubscribeToFriends(body []byte) error {
 	log.Printf("FriendsService: Unsubscribe to friends")
-	return nyi
+	req := friends_service.UnsubscribeToFriendsRequest{}
+	err := proto.Unmarshal(body, &req)
+	if err != nil {
+		return err
+	}
+	log.Printf("req = %s", req.String())
+	s.sess.friendsSubscribed = false
+	return nil
 }
 
 func (s *FriendsService) RevokeAllInvitations(body []byte) error {
 	log.Printf("FriendsService: Revoke All Invitations")
-	return nyi
+	req := friends_service.GenericFriendRequest{}
+	err := proto.Unmarshal(body, &req)
+	if err != nil {
+		return err
+	}
+	log.Printf("req = %s", req.String())
+	if s.sess.State() != StateReady {
+		return Errorf(ErrorNoAuth, "RevokeAllInvitations: not logged on")
+	}
+	sent := []InvitationRequest{}
+	db.Where("inviter_id = ?", s.sess.account.ID).Find(&sent)
+	for i := range sent {
+		s.sess.server.removeInvitation(&sent[i], invitationRemovedRevoked)
+	}
+	return nil
+}
+
+// notifyFriends calls f with the FriendsNotify export of the account's client,
+// on the client's event loop, if the account is online and subscribed to its
+// friends.
+func (s *Server) notifyFriends(accountID uint64, f func(notify *FriendsNotifyService)) {
+	sess := s.SessionForAccount(accountID)
+	if sess == nil {
+		return
+	}
+	sess.Post(func() {
+		if !sess.friendsSubscribed {
+			return
+		}
+		notify := sess.ImportedService("bnet.protocol.friends.FriendsNotify")
+		if notify == nil {
+			return
+		}
+		f(notify.(*FriendsNotifyService))
+	})
+}
+
+type FriendsNotifyServiceBinder struct{}
+
+func (FriendsNotifyServiceBinder) Bind(sess *Session) Service {
+	return &FriendsNotifyService{sess}
+}
+
+// The FriendsNotify service tells clients about changes to their friends and
+// invitations.
+type FriendsNotifyService struct {
+	sess *Session
+}
+
+func (s *FriendsNotifyService) Name() string {
+	return "bnet.protocol.friends.FriendsNotify"
+}
+
+func (s *FriendsNotifyService) Methods() []string {
+	return []string{
+		"",
+		"NotifyFriendAdded",
+		"NotifyFriendRemoved",
+		"NotifyReceivedInvitationAdded",
+		"NotifyReceivedInvitationRemoved",
+		"NotifySentInvitationAdded",
+		"NotifySentInvitationRemoved",
+		"NotifyUpdateFriendState",
+	}
+}
+
+func (s *FriendsNotifyService) Invoke(method int, body []byte) (resp []byte, err error) {
+	return nil, Errorf(ErrorRPCInvalidService, "FriendsNotify is a client export, not a server export")
+}
+
+func (s *FriendsNotifyService) NotifyFriendAdded(f *friends_types.Friend) {
+	s.notify(1, &friends_service.FriendNotification{Target: f})
+}
+
+func (s *FriendsNotifyService) NotifyFriendRemoved(f *friends_types.Friend) {
+	s.notify(2, &friends_service.FriendNotification{Target: f})
+}
+
+func (s *FriendsNotifyService) NotifyReceivedInvitationAdded(invitation *invitation_types.Invitation, reason uint32) {
+	s.notifyInvitation(3, invitation, reason)
+}
+
+func (s *FriendsNotifyService) NotifyReceivedInvitationRemoved(invitation *invitation_types.Invitation, reason uint32) {
+	s.notifyInvitation(4, invitation, reason)
+}
+
+func (s *FriendsNotifyService) NotifySentInvitationAdded(invitation *invitation_types.Invitation, reason uint32) {
+	s.notifyInvitation(5, invitation, reason)
+}
+
+func (s *FriendsNotifyService) NotifySentInvitationRemoved(invitation *invitation_types.Invitation, reason uint32) {
+	s.notifyInvitation(6, invitation, reason)
+}
+
+func (s *FriendsNotifyService) notifyInvitation(method int, invitation *invitation_types.Invitation, reason uint32) {
+	s.notify(method, &friends_service.InvitationNotification{
+		Invitation: invitation,
+		Reason:     proto.Uint32(reason),
+	})
+}
+
+func (s *FriendsNotifyService) notify(method int, n proto.Message) {
+	buf, err := proto.Marshal(n)
+	if err != nil {
+		log.Panicf("error: FriendsNotifyService: marshal: %v", err)
+	}
+	header := s.sess.MakeRequestHeader(s, method, len(buf))
+	err = s.sess.QueuePacket(header, buf)
+	if err != nil {
+		log.Printf("error: FriendsNotifyService: %v", err)
+	}
 }
@@ -0,0 +1,395 @@
+package bnet
+
+import (
+	"fmt"
+	"github.com/HearthSim/hs-proto-go/bnet/connection_service"
+	"github.com/HearthSim/hs-proto-go/bnet/friends_service"
+	"github.com/HearthSim/hs-proto-go/bnet/invitation_types"
+	"github.com/HearthSim/hs-proto-go/bnet/rpc"
+	"github.com/golang/protobuf/proto"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNotifyFriends(t *testing.T) {
+	serv := NewServer()
+	client, conn := net.Pipe()
+	sess := NewSession(serv, conn)
+	go serv.serveSession(sess)
+	defer sess.Disconnect()
+
+	codec := NewPacketCodec(client, client)
+	connect, _ := proto.Marshal(&connection_service.ConnectRequest{
+		BindRequest: &connection_service.BindRequest{
+			ExportedService: []*connection_service.BoundService{{
+				Hash: proto.Uint32(Hash("bnet.protocol.friends.FriendsNotify")),
+				Id:   proto.Uint32(1),
+			}},
+		},
+	})
+	err := codec.WritePacket(&rpc.Header{
+		ServiceId: proto.Uint32(0),
+		MethodId:  proto.Uint32(1),
+		Token:     proto.Uint32(0),
+	}, connect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = codec.ReadPacket(); err != nil {
+		t.Fatal(err)
+	}
+	sess.account = Account{ID: 1}
+	serv.sessions.add(sess)
+
+	friendAdded := func(id uint64) func(*FriendsNotifyService) {
+		return func(notify *FriendsNotifyService) {
+			notify.NotifyFriendAdded(friend(&Account{ID: id, BattleTag: "Friend#1234"}))
+		}
+	}
+	// Clients only hear about friends once they've subscribed.
+	serv.notifyFriends(1, friendAdded(2))
+	sess.PostWait(func() {
+		sess.friendsSubscribed = true
+	})
+	serv.notifyFriends(1, friendAdded(3))
+	serv.notifyFriends(4, friendAdded(5))
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header, body, err := codec.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.GetServiceId() != 1 || header.GetMethodId() != 1 {
+		t.Fatalf("expected NotifyFriendAdded, got %s", header.String())
+	}
+	n := friends_service.FriendNotification{}
+	err = proto.Unmarshal(body, &n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.GetTarget().GetId().GetLow() != 3 {
+		t.Errorf("expected to be told about friend 3, got %s", n.String())
+	}
+}
+
+// The number of accounts newFriendsAccount stored.
+var friendsAccounts int
+
+// newFriendsAccount stores a new account with a BattleTag of name, and a
+// number which is new to the test database.
+func newFriendsAccount(t *testing.T, name string) *Account {
+	friendsAccounts++
+	account := &Account{
+		Email:     fmt.Sprintf("%s%d@example.com", name, friendsAccounts),
+		BattleTag: fmt.Sprintf("%s#%d", name, 1000+friendsAccounts),
+	}
+	if err := db.Create(account).Error; err != nil {
+		t.Fatal(err)
+	}
+	return account
+}
+
+// friendsClient logs an account on with a client which is subscribed to its
+// friends, and returns the session's FriendsService and the client's codec.
+func friendsClient(t *testing.T, serv *Server, account *Account) (*FriendsService, *PacketCodec) {
+	sess, codec := connectClient(t, serv, "bnet.protocol.friends.FriendsNotify")
+	for _, state := range []int{StateLoggingIn, StateReady} {
+		if err := sess.Transition(state); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sess.PostWait(func() {
+		sess.account = *account
+		sess.friendsSubscribed = true
+	})
+	serv.sessions.add(sess)
+	return &FriendsService{sess}, codec
+}
+
+// readFriendsNotification reads the next packet sent to a friendsClient, which
+// must be the FriendsNotify method given.
+func readFriendsNotification(t *testing.T, codec *PacketCodec, method uint32, n proto.Message) {
+	header, body, err := codec.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.GetServiceId() != 1 || header.GetMethodId() != method {
+		t.Fatalf("expected FriendsNotify method %d, got %s", method, header.String())
+	}
+	if err = proto.Unmarshal(body, n); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// expectInvitationRemoved reads the notification of a removed invitation, sent
+// or received, and checks why it was removed.
+func expectInvitationRemoved(t *testing.T, codec *PacketCodec, method uint32, id uint64, reason uint32) {
+	n := friends_service.InvitationNotification{}
+	readFriendsNotification(t, codec, method, &n)
+	if n.GetInvitation().GetId() != id || n.GetReason() != reason {
+		t.Errorf("expected invitation %d to be removed with reason %d, got %s", id, reason, n.String())
+	}
+}
+
+// sendInvitationRequest returns a SendInvitationRequest for the target, as the
+// client sends it.
+func sendInvitationRequest(t *testing.T, target *invitation_types.InvitationTarget) []byte {
+	return mustMarshal(t, &invitation_types.SendInvitationRequest{
+		TargetId: EntityId(0, 0),
+		Params:   &invitation_types.InvitationParams{},
+		Target:   target,
+	})
+}
+
+func invitationCount(inviterID, inviteeID uint64) int {
+	count := 0
+	db.Model(&InvitationRequest{}).Where("inviter_id = ? and invitee_id = ?", inviterID, inviteeID).Count(&count)
+	return count
+}
+
+func makeFriends(t *testing.T, a, b *Account) {
+	for _, f := range []Friend{{Source: a.ID, Target: b.ID}, {Source: b.ID, Target: a.ID}} {
+		if err := db.Create(&f).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRemoveFriend(t *testing.T) {
+	serv := NewServer()
+	remover := newFriendsAccount(t, "Remover")
+	removed := newFriendsAccount(t, "Removed")
+	makeFriends(t, remover, removed)
+	service, removerCodec := friendsClient(t, serv, remover)
+	defer service.sess.Disconnect()
+	removedService, removedCodec := friendsClient(t, serv, removed)
+	defer removedService.sess.Disconnect()
+
+	body := mustMarshal(t, &friends_service.GenericFriendRequest{
+		TargetId: EntityId(BnetAccountEntityIDHi, removed.ID),
+	})
+	buf, err := service.RemoveFriend(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := friends_service.GenericFriendResponse{}
+	proto.Unmarshal(buf, &res)
+	if res.GetTargetFriend().GetId().GetLow() != removed.ID {
+		t.Errorf("expected friend %d to be removed, got %s", removed.ID, res.String())
+	}
+	if areFriends(remover.ID, removed.ID) || areFriends(removed.ID, remover.ID) {
+		t.Errorf("the friendship wasn't removed both ways")
+	}
+
+	// Both sides are told.
+	for _, x := range []struct {
+		Codec  *PacketCodec
+		Friend uint64
+	}{{removerCodec, removed.ID}, {removedCodec, remover.ID}} {
+		n := friends_service.FriendNotification{}
+		readFriendsNotification(t, x.Codec, 2, &n)
+		if n.GetTarget().GetId().GetLow() != x.Friend {
+			t.Errorf("expected to be told friend %d was removed, got %s", x.Friend, n.String())
+		}
+	}
+
+	_, err = service.RemoveFriend(body)
+	if e, ok := err.(*Error); !ok || e.Code != ErrorFriendsFriendshipDoesNotExist {
+		t.Errorf("expected ErrorFriendsFriendshipDoesNotExist removing a friend twice, got %v", err)
+	}
+}
+
+func TestIgnoreInvitation(t *testing.T) {
+	serv := NewServer()
+	inviter := newFriendsAccount(t, "Pest")
+	invitee := newFriendsAccount(t, "Ignorer")
+	inviterService, inviterCodec := friendsClient(t, serv, inviter)
+	defer inviterService.sess.Disconnect()
+	service, inviteeCodec := friendsClient(t, serv, invitee)
+	defer service.sess.Disconnect()
+
+	invite := sendInvitationRequest(t, &invitation_types.InvitationTarget{
+		BattleTag: proto.String(invitee.BattleTag),
+	})
+	if err := inviterService.SendInvitation(invite); err != nil {
+		t.Fatal(err)
+	}
+	n := friends_service.InvitationNotification{}
+	readFriendsNotification(t, inviterCodec, 5, &n)
+	id := n.GetInvitation().GetId()
+	readFriendsNotification(t, inviteeCodec, 3, &n)
+
+	err := service.IgnoreInvitation(mustMarshal(t, &invitation_types.GenericRequest{
+		InvitationId: proto.Uint64(id),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isBlocked(invitee.ID, inviter.ID) {
+		t.Errorf("the inviter wasn't blocked")
+	}
+	if invitationCount(inviter.ID, invitee.ID) != 0 {
+		t.Errorf("the ignored invitation is still stored")
+	}
+	// The inviter is only told the invitation was declined.
+	expectInvitationRemoved(t, inviterCodec, 6, id, invitationRemovedDeclined)
+	expectInvitationRemoved(t, inviteeCodec, 4, id, invitationRemovedIgnored)
+
+	err = inviterService.SendInvitation(invite)
+	if e, ok := err.(*Error); !ok || e.Code != ErrorFriendsAccountBlocked {
+		t.Errorf("expected ErrorFriendsAccountBlocked inviting again, got %v", err)
+	}
+	if invitationCount(inviter.ID, invitee.ID) != 0 {
+		t.Errorf("a blocked account's invitation was stored")
+	}
+}
+
+func TestRevokeAllInvitations(t *testing.T) {
+	serv := NewServer()
+	inviter := newFriendsAccount(t, "Revoker")
+	invitees := []*Account{newFriendsAccount(t, "Revoked1"), newFriendsAccount(t, "Revoked2")}
+	service, codec := friendsClient(t, serv, inviter)
+	defer service.sess.Disconnect()
+	ids := map[uint64]bool{}
+	for _, invitee := range invitees {
+		err := service.SendInvitation(sendInvitationRequest(t, &invitation_types.InvitationTarget{
+			Email: proto.String(invitee.Email),
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := friends_service.InvitationNotification{}
+		readFriendsNotification(t, codec, 5, &n)
+		ids[n.GetInvitation().GetId()] = true
+	}
+
+	err := service.RevokeAllInvitations(mustMarshal(t, &friends_service.GenericFriendRequest{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range invitees {
+		n := friends_service.InvitationNotification{}
+		readFriendsNotification(t, codec, 6, &n)
+		if !ids[n.GetInvitation().GetId()] || n.GetReason() != invitationRemovedRevoked {
+			t.Errorf("expected a sent invitation to be revoked, got %s", n.String())
+		}
+		delete(ids, n.GetInvitation().GetId())
+	}
+	for _, invitee := range invitees {
+		if invitationCount(inviter.ID, invitee.ID) != 0 {
+			t.Errorf("the invitation of %d is still stored", invitee.ID)
+		}
+	}
+}
+
+func TestViewFriends(t *testing.T) {
+	serv := NewServer()
+	viewer := newFriendsAccount(t, "Viewer")
+	friendOfViewer := newFriendsAccount(t, "ViewerFriend")
+	friendOfFriend := newFriendsAccount(t, "FriendOfFriend")
+	makeFriends(t, viewer, friendOfViewer)
+	makeFriends(t, friendOfViewer, friendOfFriend)
+	_, conn := net.Pipe()
+	sess := NewSession(serv, conn)
+	defer sess.Disconnect()
+	sess.account = *viewer
+	service := &FriendsService{sess}
+
+	viewFriends := func(high, low uint64) ([]uint64, error) {
+		buf, err := service.ViewFriends(mustMarshal(t, &friends_service.ViewFriendsRequest{
+			TargetId: EntityId(high, low),
+		}))
+		if err != nil {
+			return nil, err
+		}
+		res := friends_service.ViewFriendsResponse{}
+		proto.Unmarshal(buf, &res)
+		ids := []uint64{}
+		for _, f := range res.Friends {
+			ids = append(ids, f.GetId().GetLow())
+		}
+		return ids, nil
+	}
+	expectCode := func(what string, err error, code uint32) {
+		if e, ok := err.(*Error); !ok || e.Code != code {
+			t.Errorf("%s: expected error %d, got %v", what, code, err)
+		}
+	}
+
+	_, err := viewFriends(BnetAccountEntityIDHi, viewer.ID)
+	expectCode("ViewFriends before logon", err, ErrorNoAuth)
+	for _, state := range []int{StateConnected, StateLoggingIn, StateReady} {
+		if err := sess.Transition(state); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Clients may view their own friends and their friends' friends.
+	ids, err := viewFriends(BnetAccountEntityIDHi, viewer.ID)
+	if err != nil || len(ids) != 1 || ids[0] != friendOfViewer.ID {
+		t.Errorf("expected the viewer's friend %d, got %v, %v", friendOfViewer.ID, ids, err)
+	}
+	ids, err = viewFriends(BnetAccountEntityIDHi, friendOfViewer.ID)
+	if err != nil || len(ids) != 2 {
+		t.Errorf("expected the 2 friends of the viewer's friend, got %v, %v", ids, err)
+	}
+	_, err = viewFriends(BnetAccountEntityIDHi, friendOfFriend.ID)
+	expectCode("ViewFriends of a stranger", err, ErrorDenied)
+	_, err = viewFriends(BnetGameAccountEntityIDHi, friendOfViewer.ID)
+	expectCode("ViewFriends of a game account", err, ErrorDenied)
+}
+
+func TestRemoveExpiredInvitations(t *testing.T) {
+	serv := NewServer()
+	inviter := newFriendsAccount(t, "Expirer")
+	invitee := newFriendsAccount(t, "Expiree")
+	other := newFriendsAccount(t, "NotExpiree")
+	service, codec := friendsClient(t, serv, inviter)
+	defer service.sess.Disconnect()
+	now := time.Now()
+	expired := InvitationRequest{
+		InviterID:      inviter.ID,
+		InviteeID:      invitee.ID,
+		CreationTime:   now.Add(-invitationLifetime),
+		ExpirationTime: now,
+	}
+	db.Create(&expired)
+	pending := InvitationRequest{
+		InviterID:      inviter.ID,
+		InviteeID:      other.ID,
+		CreationTime:   now,
+		ExpirationTime: now.Add(invitationLifetime),
+	}
+	db.Create(&pending)
+
+	// Expired invitations can't be accepted while they wait for the sweep.
+	_, conn := net.Pipe()
+	sess := NewSession(serv, conn)
+	defer sess.Disconnect()
+	for _, state := range []int{StateConnected, StateLoggingIn, StateReady} {
+		if err := sess.Transition(state); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sess.account = *invitee
+	inviteeService := &FriendsService{sess}
+	err := inviteeService.AcceptInvitation(mustMarshal(t, &invitation_types.GenericRequest{
+		InvitationId: proto.Uint64(expired.ID),
+	}))
+	if e, ok := err.(*Error); !ok || e.Code != ErrorFriendsInvalidInvitation {
+		t.Errorf("expected ErrorFriendsInvalidInvitation accepting an expired invitation, got %v", err)
+	}
+
+	serv.removeExpiredInvitations(now)
+	expectInvitationRemoved(t, codec, 6, expired.ID, invitationRemovedExpired)
+	if invitationCount(inviter.ID, invitee.ID) != 0 {
+		t.Errorf("the expired invitation is still stored")
+	}
+	if invitationCount(inviter.ID, other.ID) != 1 {
+		t.Errorf("the unexpired invitation was removed")
+	}
+	if areFriends(inviter.ID, invitee.ID) {
+		t.Errorf("the expired invitation made friends")
+	}
+}
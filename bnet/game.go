@@ -1,6 +1,8 @@
 package bnet
 
 import (
+	"context"
+	"github.com/HearthSim/hs-proto-go/bnet/game_master_types"
 	"github.com/HearthSim/hs-proto-go/bnet/game_utilities_service"
 	"github.com/golang/protobuf/proto"
 	"log"
@@ -11,6 +13,17 @@ type GameServer interface {
 	// Connect connects the bnet session to the game session.  The game server
 	// should set up the Client and ServerNotification channels on sess.
 	Connect(sess *Session)
+
+	// Shutdown lets the game server finish or save the work of its sessions
+	// before the server shuts down.  The bnet sessions stay connected until it
+	// returns or ctx is done.
+	Shutdown(ctx context.Context) error
+}
+
+// A GameResultReceiver is a GameServer which is told when the games its hosts
+// run end.
+type GameResultReceiver interface {
+	GameEnded(handle *game_master_types.GameHandle, reason uint32)
 }
 
 type GameUtilitiesServiceBinder struct{}
@@ -62,8 +75,7 @@ func (s *GameUtilitiesService) Invoke(method int, body []byte) (resp []byte, err
 	case 8:
 		return nil, s.NotifyGameAccountOffline(body)
 	default:
-		log.Panicf("error: GameUtilitiesService.Invoke: unknown method %v", method)
-		return
+		return nil, Errorf(ErrorRPCInvalidMethod, "GameUtilitiesService.Invoke: unknown method %v", method)
 	}
 }
 
@@ -73,6 +85,10 @@ func (s *GameUtilitiesService) ProcessClientRequest(body []byte) ([]byte, error)
 	if err != nil {
 		return nil, err
 	}
+	err = s.sess.connectGameServer()
+	if err != nil {
+		return nil, err
+	}
 	log.Printf("req = %s", req.String())
 	token := s.sess.receivedToken
 	s.sess.OnceNotified(NotifyClientResponse, func(n *Notification) {
@@ -104,8 +120,13 @@ func (s *GameUtilitiesService) GetPlayerVariables(body []byte) ([]byte, error) {
 	return nil, nyi
 }
 
+// GetLoad reports the total load of the game hosts for the session's program.
 func (s *GameUtilitiesService) GetLoad(body []byte) ([]byte, error) {
-	return nil, nyi
+	buf, err := proto.Marshal(s.sess.server.gameHosts.load(s.sess.program))
+	if err != nil {
+		log.Panicf("error: GameUtilitiesService: marshal: %v", err)
+	}
+	return buf, nil
 }
 
 func (s *GameUtilitiesService) ProcessServerRequest(body []byte) ([]byte, error) {
@@ -1,11 +1,13 @@
 package bnet
 
 import (
-	"fmt"
+	"crypto/subtle"
+	"github.com/HearthSim/hs-proto-go/bnet/attribute"
 	"github.com/HearthSim/hs-proto-go/bnet/game_master_service"
 	"github.com/HearthSim/hs-proto-go/bnet/game_master_types"
 	"github.com/golang/protobuf/proto"
 	"log"
+	"sort"
 )
 
 type GameMasterServiceBinder struct{}
@@ -56,7 +58,7 @@ func (s *GameMasterService) Invoke(method int, body []byte) (resp []byte, err er
 	case 3:
 		return s.FindGame(body)
 	case 4:
-		return []byte{}, s.CancelGameEntry(body)
+		return s.CancelGameEntry(body)
 	case 5:
 		return nil, s.GameEnded(body)
 	case 6:
@@ -80,8 +82,7 @@ func (s *GameMasterService) Invoke(method int, body []byte) (resp []byte, err er
 	case 15:
 		return s.GetGameStats(body)
 	default:
-		log.Panicf("error: GameMasterService.Invoke: unknown method %v", method)
-		return
+		return nil, Errorf(ErrorRPCInvalidMethod, "GameMasterService.Invoke: unknown method %v", method)
 	}
 }
 
@@ -89,15 +90,66 @@ func (s *GameMasterService) JoinGame(body []byte) ([]byte, error) {
 	return nil, nyi
 }
 
+// ListFactories describes a game factory for each game server, with the
+// games and players of its hosts.
 func (s *GameMasterService) ListFactories(body []byte) ([]byte, error) {
-	return nil, nyi
+	req := &game_master_service.ListFactoriesRequest{}
+	err := proto.Unmarshal(body, req)
+	if err != nil {
+		return nil, err
+	}
+	// TODO: apply req.Filter
+	programs := []string{}
+	for program := range s.sess.server.gameServers {
+		programs = append(programs, program)
+	}
+	sort.Strings(programs)
+	descriptions := []*game_master_types.GameFactoryDescription{}
+	for _, program := range programs {
+		load := s.sess.server.gameHosts.load(program)
+		descriptions = append(descriptions, &game_master_types.GameFactoryDescription{
+			Id:            proto.Uint64(uint64(FourCC(program))),
+			Name:          proto.String(program),
+			AllowQueueing: proto.Bool(true),
+			StatsBucket: []*game_master_types.GameStatsBucket{{
+				ActiveGames:   proto.Uint32(uint32(load.GetGameCount())),
+				ActivePlayers: proto.Uint32(uint32(load.GetPlayerCount())),
+			}},
+		})
+	}
+	res := &game_master_service.ListFactoriesResponse{}
+	res.TotalResults = proto.Uint32(uint32(len(descriptions)))
+	start := int(req.GetStartIndex())
+	if start > len(descriptions) {
+		start = len(descriptions)
+	}
+	end := len(descriptions)
+	if req.MaxResults != nil && start+int(req.GetMaxResults()) < end {
+		end = start + int(req.GetMaxResults())
+	}
+	res.Description = descriptions[start:end]
+	buf, err := proto.Marshal(res)
+	if err != nil {
+		log.Panicf("error: GameMasterService.ListFactories: marshal: %v", err)
+	}
+	return buf, nil
 }
 
 func (s *GameMasterService) FindGame(body []byte) ([]byte, error) {
 	req := &game_master_service.FindGameRequest{}
-	proto.Unmarshal(body, req)
+	err := proto.Unmarshal(body, req)
+	if err != nil {
+		return nil, Errorf(ErrorInvalidArgs, "FindGame: %v", err)
+	}
 	token := s.sess.receivedToken
-	fmt.Println(req.String())
+	log.Printf("req = %s", req.String())
+	if len(req.Player) == 0 {
+		return nil, Errorf(ErrorInvalidArgs, "FindGame: no players")
+	}
+	err = s.sess.connectGameServer()
+	if err != nil {
+		return nil, err
+	}
 	advNotification := false
 	if req.AdvancedNotification != nil {
 		advNotification = *req.AdvancedNotification
@@ -108,6 +160,12 @@ func (s *GameMasterService) FindGame(body []byte) ([]byte, error) {
 	})
 	// TODO: care about game_properties and other stuff
 	notify.Attributes = append(notify.Attributes, player.Attribute...)
+	if len(req.Player) == 2 {
+		notify, err = s.friendlyChallenge(req.Player)
+		if err != nil {
+			return nil, err
+		}
+	}
 	s.sess.OnceNotified(NotifyFindGameResponse, func(n *Notification) {
 		m := n.Map()
 		res := &game_master_service.FindGameResponse{}
@@ -124,27 +182,131 @@ func (s *GameMasterService) FindGame(body []byte) ([]byte, error) {
 	return nil, nil
 }
 
-func (s *GameMasterService) CancelGameEntry(body []byte) error {
+// friendlyChallenge returns the notification asking the game server for a game
+// between the client and the friend who is the second player.  The friend must
+// have agreed to play by sharing a channel with the client, which one of them
+// joined by accepting the other's challenge.  The friend's attributes, such as
+// their deck, are prefixed with opponent_.
+func (s *GameMasterService) friendlyChallenge(players []*game_master_types.Player) (*Notification, error) {
+	opponent := players[1].GetIdentity().GetGameAccountId()
+	if opponent.GetHigh() != BnetGameAccountEntityIDHi || s.sess.isEntity(opponent) {
+		return nil, Errorf(ErrorInvalidArgs, "FindGame: bad opponent %s", opponent.String())
+	}
+	accountID := accountIDForEntity(opponent)
+	if accountID == 0 || !areFriends(s.sess.account.ID, accountID) {
+		return nil, Errorf(ErrorFriendsFriendshipDoesNotExist, "FindGame: %d isn't friends with %s",
+			s.sess.account.ID, opponent.String())
+	}
+	opponentSess := s.sess.server.SessionForGameAccount(opponent.GetLow())
+	if opponentSess == nil {
+		return nil, Errorf(ErrorNotExists, "FindGame: %s isn't online", opponent.String())
+	}
+	if !s.sess.server.channels.shareChannel(s.sess, opponentSess) {
+		return nil, Errorf(ErrorDenied, "FindGame: %s didn't accept a challenge from %d",
+			opponent.String(), s.sess.account.ID)
+	}
+	notify := NewNotification(NotifyFriendlyChallengeRequest, map[string]interface{}{
+		"opponent": opponent.GetLow(),
+	})
+	notify.Attributes = append(notify.Attributes, players[0].Attribute...)
+	for _, attr := range players[1].Attribute {
+		notify.Attributes = append(notify.Attributes, &attribute.Attribute{
+			Name:  proto.String("opponent_" + attr.GetName()),
+			Value: attr.Value,
+		})
+	}
+	return notify, nil
+}
+
+// CancelGameEntry takes the client out of the matchmaking queue.  It fails if
+// the client was already matched, in which case it will join the game.
+func (s *GameMasterService) CancelGameEntry(body []byte) ([]byte, error) {
 	req := &game_master_types.CancelGameEntryRequest{}
-	proto.Unmarshal(body, req)
-	fmt.Printf("req = %s\n", req.String())
-	return nil
+	err := proto.Unmarshal(body, req)
+	if err != nil {
+		return nil, err
+	}
+	token := s.sess.receivedToken
+	log.Printf("req = %s", req.String())
+	if !s.sess.gameServerConnected {
+		return nil, Errorf(ErrorNotExists, "CancelGameEntry: not queued")
+	}
+	s.sess.OnceNotified(NotifyCancelGameResponse, func(n *Notification) {
+		if !n.Map()["cancelled"].(bool) {
+			s.sess.RespondError(token, ErrorNotExists)
+			return
+		}
+		s.sess.Respond(token, []byte{})
+	})
+	s.sess.ServerNotifications <- NewNotification(NotifyCancelGameRequest, map[string]interface{}{
+		"requestId": req.GetRequestId(),
+	})
+	return nil, nil
 }
 
+// GameEnded is sent by game hosts when one of their games ends, and is passed
+// on to the game server of the host's program.
 func (s *GameMasterService) GameEnded(body []byte) error {
-	return nyi
+	req := &game_master_service.GameEndedNotification{}
+	err := proto.Unmarshal(body, req)
+	if err != nil {
+		return err
+	}
+	program := s.sess.server.gameHosts.programForSession(s.sess)
+	if len(program) == 0 {
+		return Errorf(ErrorDenied, "GameEnded: not a registered game host")
+	}
+	if req.GetGameHandle().GetFactoryId() != uint64(FourCC(program)) {
+		return Errorf(ErrorNotExists, "GameEnded: %s host ended a game of factory %d",
+			program, req.GetGameHandle().GetFactoryId())
+	}
+	if receiver, ok := s.sess.server.gameServers[program].(GameResultReceiver); ok {
+		receiver.GameEnded(req.GameHandle, req.GetReason())
+	}
+	return nil
 }
 
 func (s *GameMasterService) PlayerLeft(body []byte) error {
 	return nyi
 }
 
+// RegisterServer adds the session as a game host, which new games of its
+// program may be sent to.  The host must give the game host password as its
+// "password" attribute.
 func (s *GameMasterService) RegisterServer(body []byte) error {
-	return nyi
+	req := &game_master_service.RegisterServerRequest{}
+	err := proto.Unmarshal(body, req)
+	if err != nil {
+		return err
+	}
+	program := FourCCString(req.GetProgramId())
+	if _, ok := s.sess.server.gameServers[program]; !ok {
+		return Errorf(ErrorNotExists, "RegisterServer: no game server for program %q", program)
+	}
+	password := ""
+	attrs := []*attribute.Attribute{}
+	for _, attr := range req.Attribute {
+		if attr.GetName() == "password" {
+			password = attr.GetValue().GetStringValue()
+			continue
+		}
+		attrs = append(attrs, attr)
+	}
+	expected := s.sess.server.gameHostPassword
+	if len(expected) == 0 || subtle.ConstantTimeCompare([]byte(password), []byte(expected)) != 1 {
+		return Errorf(ErrorDenied, "RegisterServer: bad password for %s host", program)
+	}
+	s.sess.server.registerGameHost(s.sess, program, attrs, req.State)
+	return nil
 }
 
+// UnregisterServer removes the session from the game hosts.  Games it's
+// running carry on, and may report their ends until it disconnects.
 func (s *GameMasterService) UnregisterServer(body []byte) error {
-	return nyi
+	if !s.sess.server.gameHosts.retire(s.sess) {
+		return Errorf(ErrorNotExists, "UnregisterServer: not registered")
+	}
+	return nil
 }
 
 func (s *GameMasterService) RegisterUtilities(body []byte) error {
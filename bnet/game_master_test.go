@@ -0,0 +1,98 @@
+package bnet
+
+import (
+	"github.com/HearthSim/hs-proto-go/bnet/channel_invitation_types"
+	"github.com/HearthSim/hs-proto-go/bnet/entity"
+	"github.com/HearthSim/hs-proto-go/bnet/game_master_service"
+	"github.com/HearthSim/hs-proto-go/bnet/game_master_types"
+	"github.com/golang/protobuf/proto"
+	"net"
+	"testing"
+)
+
+func TestFriendlyChallengeOpponent(t *testing.T) {
+	serv := NewServer()
+	_, conn := net.Pipe()
+	sess := NewSession(serv, conn)
+	defer sess.Disconnect()
+	sess.account.ID = 1
+	sess.gameAccountID = 101
+	s := &GameMasterService{sess}
+
+	challenge := func(opponent *entity.EntityId) error {
+		_, err := s.friendlyChallenge([]*game_master_types.Player{
+			{Identity: sess.identity()},
+			{Identity: &entity.Identity{GameAccountId: opponent}},
+		})
+		return err
+	}
+	if err := challenge(EntityId(BnetGameAccountEntityIDHi, 101)); ErrorCode(err) != ErrorInvalidArgs {
+		t.Errorf("client challenged itself: %v", err)
+	}
+	if err := challenge(EntityId(BnetAccountEntityIDHi, 2)); ErrorCode(err) != ErrorInvalidArgs {
+		t.Errorf("challenged an account rather than a game account: %v", err)
+	}
+	if err := challenge(EntityId(BnetGameAccountEntityIDHi, 102)); ErrorCode(err) != ErrorFriendsFriendshipDoesNotExist {
+		t.Errorf("challenged a stranger: %v", err)
+	}
+}
+
+func TestFriendlyChallengeAccepted(t *testing.T) {
+	serv := NewServer()
+	newSession := func(name string) *Session {
+		_, conn := net.Pipe()
+		sess := NewSession(serv, conn)
+		sess.account = *newFriendsAccount(t, name)
+		sess.gameAccountID = uint64(createGameAccount(sess.account.ID, "WTCG", "US").ID)
+		serv.sessions.add(sess)
+		return sess
+	}
+	challenger := newSession("Challenger")
+	defer challenger.Disconnect()
+	opponent := newSession("Challenged")
+	defer opponent.Disconnect()
+	makeFriends(t, &challenger.account, &opponent.account)
+	s := &GameMasterService{challenger}
+	challenge := func() error {
+		_, err := s.friendlyChallenge([]*game_master_types.Player{
+			{Identity: challenger.identity()},
+			{Identity: opponent.identity()},
+		})
+		return err
+	}
+
+	if err := challenge(); ErrorCode(err) != ErrorDenied {
+		t.Errorf("challenged a friend who wasn't asked: %v", err)
+	}
+	id := serv.channels.create(challenger, nil, nil, 1)
+	invitation, err := serv.channels.invite(challenger, opponent, &channel_invitation_types.ChannelInvitationParams{
+		ChannelId:   id,
+		ServiceType: proto.Uint32(1),
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := challenge(); ErrorCode(err) != ErrorDenied {
+		t.Errorf("challenged a friend who hasn't accepted: %v", err)
+	}
+	if _, err = serv.channels.accept(opponent, invitation.GetId(), nil, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := challenge(); err != nil {
+		t.Errorf("couldn't challenge a friend who accepted: %v", err)
+	}
+}
+
+func TestFindGameInvalidArgs(t *testing.T) {
+	_, conn := net.Pipe()
+	sess := NewSession(NewServer(), conn)
+	defer sess.Disconnect()
+	s := &GameMasterService{sess}
+	if _, err := s.FindGame([]byte{0xff}); ErrorCode(err) != ErrorInvalidArgs {
+		t.Errorf("expected ErrorInvalidArgs for a bad request, got %v", err)
+	}
+	req := &game_master_service.FindGameRequest{FactoryId: proto.Uint64(0)}
+	if _, err := s.FindGame(mustMarshal(t, req)); ErrorCode(err) != ErrorInvalidArgs {
+		t.Errorf("expected ErrorInvalidArgs without players, got %v", err)
+	}
+}
@@ -0,0 +1,347 @@
+package bnet
+
+import (
+	"context"
+	"github.com/HearthSim/hs-proto-go/bnet/attribute"
+	"github.com/HearthSim/hs-proto-go/bnet/game_utilities_service"
+	"github.com/HearthSim/hs-proto-go/bnet/server_pool_types"
+	"github.com/golang/protobuf/proto"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// How often registered game hosts are asked for their load.  A host which
+// doesn't answer is unregistered.
+const gameHostPollInterval = 15 * time.Second
+
+// A GameHost runs the games of a game server.  It may run in-process, or in a
+// process of its own which registered with GameMaster.RegisterServer.
+type GameHost interface {
+	// Load reports how busy the host is.
+	Load(ctx context.Context) (*server_pool_types.ServerState, error)
+
+	// CreateGame starts a game described by attrs, and returns the
+	// attributes clients need to join it.  What they hold is up to the game
+	// server.
+	CreateGame(ctx context.Context, attrs []*attribute.Attribute) ([]*attribute.Attribute, error)
+}
+
+// A registeredHost is a game host in the pool.
+type registeredHost struct {
+	id      uint64
+	program string
+	host    GameHost
+	// The session which registered the host, or nil if it's in-process.
+	sess       *Session
+	attributes []*attribute.Attribute
+	state      *server_pool_types.ServerState
+}
+
+// A gameHostPool holds the game hosts of each program, and picks which one
+// runs each new game.
+type gameHostPool struct {
+	sync.Mutex
+	lastID uint64
+	hosts  map[uint64]*registeredHost
+	// The programs of sessions whose hosts unregistered while still
+	// connected.  Their games may still end.
+	retired map[*Session]string
+}
+
+func newGameHostPool() *gameHostPool {
+	return &gameHostPool{
+		hosts:   map[uint64]*registeredHost{},
+		retired: map[*Session]string{},
+	}
+}
+
+// register adds a host to the pool and returns its id.
+func (p *gameHostPool) register(program string, host GameHost, sess *Session,
+	attrs []*attribute.Attribute, state *server_pool_types.ServerState) uint64 {
+	p.Lock()
+	defer p.Unlock()
+	p.lastID++
+	if state == nil {
+		state = &server_pool_types.ServerState{}
+	}
+	p.hosts[p.lastID] = &registeredHost{
+		id:         p.lastID,
+		program:    program,
+		host:       host,
+		sess:       sess,
+		attributes: attrs,
+		state:      state,
+	}
+	log.Printf("registered %s game host %d", program, p.lastID)
+	return p.lastID
+}
+
+// unregister removes a host from the pool, and returns whether it was there.
+func (p *gameHostPool) unregister(id uint64) bool {
+	p.Lock()
+	defer p.Unlock()
+	if _, ok := p.hosts[id]; !ok {
+		return false
+	}
+	delete(p.hosts, id)
+	log.Printf("unregistered game host %d", id)
+	return true
+}
+
+// retire unregisters the host a session registered, and returns whether it
+// had one.  Until forget is called, the session may still report the ends of
+// its games.
+func (p *gameHostPool) retire(sess *Session) bool {
+	id, program := p.hostForSession(sess)
+	if id == 0 || !p.unregister(id) {
+		return false
+	}
+	p.Lock()
+	defer p.Unlock()
+	p.retired[sess] = program
+	return true
+}
+
+// forget drops a disconnected session's retired host.
+func (p *gameHostPool) forget(sess *Session) {
+	p.Lock()
+	defer p.Unlock()
+	delete(p.retired, sess)
+}
+
+// programForSession returns the program of the host a session registered,
+// even if it has since retired, or "" if it didn't register one.
+func (p *gameHostPool) programForSession(sess *Session) string {
+	if _, program := p.hostForSession(sess); len(program) != 0 {
+		return program
+	}
+	p.Lock()
+	defer p.Unlock()
+	return p.retired[sess]
+}
+
+// hostForSession returns the id and program of the host a session registered,
+// or 0 if it didn't.
+func (p *gameHostPool) hostForSession(sess *Session) (uint64, string) {
+	p.Lock()
+	defer p.Unlock()
+	for id, h := range p.hosts {
+		if h.sess == sess {
+			return id, h.program
+		}
+	}
+	return 0, ""
+}
+
+func (p *gameHostPool) setState(id uint64, state *server_pool_types.ServerState) {
+	p.Lock()
+	defer p.Unlock()
+	if h, ok := p.hosts[id]; ok {
+		h.state = state
+	}
+}
+
+// leastLoaded returns the host of a program with the lowest load, and then the
+// fewest games, or nil if there is none.  The host is counted as running one
+// more game until it next reports its load.
+func (p *gameHostPool) leastLoaded(program string) GameHost {
+	p.Lock()
+	defer p.Unlock()
+	var best *registeredHost
+	for _, h := range p.hosts {
+		if h.program != program {
+			continue
+		}
+		if best == nil || lessLoaded(h, best) {
+			best = h
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	best.state.GameCount = proto.Int32(best.state.GetGameCount() + 1)
+	return best.host
+}
+
+func lessLoaded(a, b *registeredHost) bool {
+	if a.state.GetCurrentLoad() != b.state.GetCurrentLoad() {
+		return a.state.GetCurrentLoad() < b.state.GetCurrentLoad()
+	}
+	if a.state.GetGameCount() != b.state.GetGameCount() {
+		return a.state.GetGameCount() < b.state.GetGameCount()
+	}
+	// Keep the choice stable between equally loaded hosts.
+	return a.id < b.id
+}
+
+// all returns copies of the registered hosts, ordered by id.
+func (p *gameHostPool) all() []registeredHost {
+	p.Lock()
+	defer p.Unlock()
+	res := make([]registeredHost, 0, len(p.hosts))
+	for _, h := range p.hosts {
+		c := *h
+		c.state = proto.Clone(h.state).(*server_pool_types.ServerState)
+		res = append(res, c)
+	}
+	sort.Sort(hostsByID(res))
+	return res
+}
+
+type hostsByID []registeredHost
+
+func (hosts hostsByID) Len() int           { return len(hosts) }
+func (hosts hostsByID) Less(i, j int) bool { return hosts[i].id < hosts[j].id }
+func (hosts hostsByID) Swap(i, j int)      { hosts[i], hosts[j] = hosts[j], hosts[i] }
+
+// poll asks every host for its load, and unregisters those which fail to
+// answer in time.
+func (p *gameHostPool) poll() {
+	for _, h := range p.all() {
+		go func(h registeredHost) {
+			ctx, cancel := context.WithTimeout(context.Background(), gameHostPollInterval)
+			defer cancel()
+			state, err := h.host.Load(ctx)
+			if err != nil {
+				log.Printf("game host %d didn't report its load: %v", h.id, err)
+				if p.unregister(h.id) && h.sess != nil {
+					h.sess.Disconnect()
+				}
+				return
+			}
+			p.setState(h.id, state)
+		}(h)
+	}
+}
+
+// load returns the total load of a program's hosts.  The current load is their
+// mean.
+func (p *gameHostPool) load(program string) *server_pool_types.ServerState {
+	var load float32
+	var games, players int32
+	n := 0
+	for _, h := range p.all() {
+		if h.program != program {
+			continue
+		}
+		load += h.state.GetCurrentLoad()
+		games += h.state.GetGameCount()
+		players += h.state.GetPlayerCount()
+		n++
+	}
+	if n != 0 {
+		load /= float32(n)
+	}
+	return &server_pool_types.ServerState{
+		CurrentLoad: proto.Float32(load),
+		GameCount:   proto.Int32(games),
+		PlayerCount: proto.Int32(players),
+	}
+}
+
+// RegisterGameHost adds an in-process game host for a program, and returns its
+// id.
+func (s *Server) RegisterGameHost(program string, host GameHost) uint64 {
+	return s.gameHosts.register(program, host, nil, nil, nil)
+}
+
+// UnregisterGameHost removes a game host added with RegisterGameHost.
+func (s *Server) UnregisterGameHost(id uint64) {
+	s.gameHosts.unregister(id)
+}
+
+// GameHostFor returns the least loaded game host of a program, or nil if it
+// has none.
+func (s *Server) GameHostFor(program string) GameHost {
+	return s.gameHosts.leastLoaded(program)
+}
+
+// registerGameHost registers the session as a game host.  It's unregistered
+// when the session disconnects.  A session which registers again replaces its
+// previous registration.
+func (s *Server) registerGameHost(sess *Session, program string,
+	attrs []*attribute.Attribute, state *server_pool_types.ServerState) uint64 {
+	if id, _ := s.gameHosts.hostForSession(sess); id != 0 {
+		s.gameHosts.unregister(id)
+	}
+	id := s.gameHosts.register(program, sessionGameHost{sess, program}, sess, attrs, state)
+	go func() {
+		<-sess.Done()
+		s.gameHosts.unregister(id)
+		s.gameHosts.forget(sess)
+	}()
+	return id
+}
+
+func (s *Server) pollGameHosts(stop <-chan struct{}) {
+	ticker := time.NewTicker(gameHostPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.gameHosts.poll()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// SetGameHostPassword sets the password game hosts must give to register with
+// GameMaster.RegisterServer.  Until it's set, only in-process hosts are used.
+func (s *Server) SetGameHostPassword(password string) {
+	s.gameHostPassword = password
+}
+
+// A sessionGameHost is a game host in another process, which connected as a
+// session.  It answers the GameUtilities methods it exports.
+type sessionGameHost struct {
+	sess    *Session
+	program string
+}
+
+func (h sessionGameHost) utilities() (Service, error) {
+	service := h.sess.ImportedService("bnet.protocol.game_utilities.GameUtilities")
+	if service == nil {
+		return nil, Errorf(ErrorRPCServiceNotBound, "game host doesn't export GameUtilities")
+	}
+	return service, nil
+}
+
+func (h sessionGameHost) Load(ctx context.Context) (*server_pool_types.ServerState, error) {
+	service, err := h.utilities()
+	if err != nil {
+		return nil, err
+	}
+	body, err := h.sess.CallContext(ctx, service, 5, &server_pool_types.GetLoadRequest{})
+	if err != nil {
+		return nil, err
+	}
+	res := &server_pool_types.ServerState{}
+	err = proto.Unmarshal(body, res)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (h sessionGameHost) CreateGame(ctx context.Context, attrs []*attribute.Attribute) ([]*attribute.Attribute, error) {
+	service, err := h.utilities()
+	if err != nil {
+		return nil, err
+	}
+	req := &game_utilities_service.ServerRequest{}
+	req.Attribute = attrs
+	req.Program = proto.Uint32(FourCC(h.program))
+	body, err := h.sess.CallContext(ctx, service, 6, req)
+	if err != nil {
+		return nil, err
+	}
+	res := &game_utilities_service.ServerResponse{}
+	err = proto.Unmarshal(body, res)
+	if err != nil {
+		return nil, err
+	}
+	return res.Attribute, nil
+}
@@ -0,0 +1,179 @@
+package bnet
+
+import (
+	"context"
+	"errors"
+	"github.com/HearthSim/hs-proto-go/bnet/attribute"
+	"github.com/HearthSim/hs-proto-go/bnet/game_master_service"
+	"github.com/HearthSim/hs-proto-go/bnet/game_master_types"
+	"github.com/HearthSim/hs-proto-go/bnet/server_pool_types"
+	"github.com/golang/protobuf/proto"
+	"net"
+	"testing"
+	"time"
+)
+
+// A fakeGameHost reports a fixed load, or fails once dead.
+type fakeGameHost struct {
+	name string
+	dead bool
+}
+
+func (h *fakeGameHost) Load(ctx context.Context) (*server_pool_types.ServerState, error) {
+	if h.dead {
+		return nil, errors.New("host is dead")
+	}
+	return &server_pool_types.ServerState{GameCount: proto.Int32(0)}, nil
+}
+
+func (h *fakeGameHost) CreateGame(ctx context.Context, attrs []*attribute.Attribute) ([]*attribute.Attribute, error) {
+	return nil, nil
+}
+
+// waitForHosts waits until the pool holds n hosts.
+func waitForHosts(t *testing.T, p *gameHostPool, n int) {
+	deadline := time.Now().Add(time.Second)
+	for len(p.all()) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d game hosts, got %d", n, len(p.all()))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestGameHostPool(t *testing.T) {
+	p := newGameHostPool()
+	a, b := &fakeGameHost{name: "a"}, &fakeGameHost{name: "b"}
+	if p.leastLoaded("WTCG") != nil {
+		t.Errorf("picked a host from an empty pool")
+	}
+	p.register("WTCG", a, nil, nil, &server_pool_types.ServerState{
+		CurrentLoad: proto.Float32(0.5),
+	})
+	idB := p.register("WTCG", b, nil, nil, nil)
+	p.register("TEST", &fakeGameHost{name: "other"}, nil, nil, nil)
+
+	if host := p.leastLoaded("WTCG"); host != b {
+		t.Errorf("expected the less loaded host b, got %v", host)
+	}
+	p.setState(idB, &server_pool_types.ServerState{CurrentLoad: proto.Float32(0.5)})
+	// With the same load, games are spread between the hosts.
+	picked := map[GameHost]int{}
+	for i := 0; i < 4; i++ {
+		picked[p.leastLoaded("WTCG")]++
+	}
+	if picked[a] != 2 || picked[b] != 2 {
+		t.Errorf("expected games to be spread evenly, got a %d b %d", picked[a], picked[b])
+	}
+	load := p.load("WTCG")
+	if load.GetGameCount() != 4 || load.GetCurrentLoad() != 0.5 {
+		t.Errorf("bad load for WTCG: %s", load.String())
+	}
+
+	// Hosts which don't answer are unregistered.
+	b.dead = true
+	p.poll()
+	waitForHosts(t, p, 2)
+	if host := p.leastLoaded("WTCG"); host != a {
+		t.Errorf("expected the live host a, got %v", host)
+	}
+	if load := p.load("WTCG"); load.GetGameCount() != 1 {
+		t.Errorf("load wasn't updated by poll: %s", load.String())
+	}
+}
+
+func registerServerRequest(program, password string) []byte {
+	req := &game_master_service.RegisterServerRequest{}
+	req.ProgramId = proto.Uint32(FourCC(program))
+	req.Attribute = NewNotification("", map[string]interface{}{
+		"password": password,
+		"address":  "127.0.0.1:1120",
+	}).Attributes
+	buf, err := proto.Marshal(req)
+	if err != nil {
+		panic(err)
+	}
+	return buf
+}
+
+func TestRegisterServer(t *testing.T) {
+	serv := NewServer()
+	serv.RegisterGameServer("WTCG", &blockingGameServer{})
+	_, conn := net.Pipe()
+	sess := NewSession(serv, conn)
+	gameMaster := &GameMasterService{sess}
+
+	// Until a password is set, hosts can't register.
+	err := gameMaster.RegisterServer(registerServerRequest("WTCG", ""))
+	if e, ok := err.(*Error); !ok || e.Code != ErrorDenied {
+		t.Errorf("expected ErrorDenied without a password, got %v", err)
+	}
+	serv.SetGameHostPassword("secret")
+	err = gameMaster.RegisterServer(registerServerRequest("WTCG", "wrong"))
+	if e, ok := err.(*Error); !ok || e.Code != ErrorDenied {
+		t.Errorf("expected ErrorDenied for a wrong password, got %v", err)
+	}
+	err = gameMaster.RegisterServer(registerServerRequest("NOPE", "secret"))
+	if e, ok := err.(*Error); !ok || e.Code != ErrorNotExists {
+		t.Errorf("expected ErrorNotExists for an unknown program, got %v", err)
+	}
+	err = gameMaster.RegisterServer(registerServerRequest("WTCG", "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Registering again replaces the registration.
+	err = gameMaster.RegisterServer(registerServerRequest("WTCG", "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := serv.gameHosts.all()
+	if len(hosts) != 1 || hosts[0].sess != sess {
+		t.Fatalf("expected the session to be registered once, got %v", hosts)
+	}
+	for _, attr := range hosts[0].attributes {
+		if attr.GetName() == "password" {
+			t.Errorf("the password was kept with the host's attributes")
+		}
+	}
+	if serv.GameHostFor("WTCG") == nil {
+		t.Errorf("no host for WTCG")
+	}
+
+	gameEnded := func() error {
+		return gameMaster.GameEnded(mustMarshal(t, &game_master_service.GameEndedNotification{
+			GameHandle: &game_master_types.GameHandle{
+				FactoryId: proto.Uint64(uint64(FourCC("WTCG"))),
+				GameId:    EntityId(0, 7),
+			},
+		}))
+	}
+	if err := gameMaster.UnregisterServer(nil); err != nil {
+		t.Errorf("UnregisterServer: %v", err)
+	}
+	if err := gameMaster.UnregisterServer(nil); err == nil {
+		t.Errorf("unregistered twice")
+	}
+	if serv.GameHostFor("WTCG") != nil {
+		t.Errorf("an unregistered host was still picked for new games")
+	}
+	// The games an unregistered host is still running may end.
+	if err := gameEnded(); err != nil {
+		t.Errorf("GameEnded after UnregisterServer: %v", err)
+	}
+
+	// Hosts which disconnect are unregistered.
+	err = gameMaster.RegisterServer(registerServerRequest("WTCG", "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.Disconnect()
+	waitForHosts(t, serv.gameHosts, 0)
+}
+
+func TestFourCCString(t *testing.T) {
+	for _, s := range []string{"WTCG", "App", ""} {
+		if res := FourCCString(FourCC(s)); res != s {
+			t.Errorf("expected %q, got %q", s, res)
+		}
+	}
+}
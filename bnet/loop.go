@@ -0,0 +1,85 @@
+package bnet
+
+import (
+	"sync"
+)
+
+// An eventQueue is an unbounded FIFO of functions to run on a session's event
+// loop.  Posting never blocks, so sessions can post to each other's loops
+// without risking a deadlock.
+type eventQueue struct {
+	sync.Mutex
+	events []func()
+	// ready has an element whenever events may be non-empty.
+	ready chan struct{}
+}
+
+func newEventQueue() *eventQueue {
+	return &eventQueue{ready: make(chan struct{}, 1)}
+}
+
+func (q *eventQueue) push(f func()) {
+	q.Lock()
+	q.events = append(q.events, f)
+	q.Unlock()
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (q *eventQueue) take() []func() {
+	q.Lock()
+	defer q.Unlock()
+	events := q.events
+	q.events = nil
+	return events
+}
+
+// Post queues f to run on the session's event loop, and returns false if the
+// session has already disconnected.  Packets and notifications are handled on
+// the loop one at a time, so code running there owns the session's request
+// state: the received token and the notification handlers.  Code on the loop
+// must never wait for the client, e.g. with Call, since the response can only
+// be handled once it returns.
+func (s *Session) Post(f func()) bool {
+	select {
+	case <-s.quit:
+		return false
+	default:
+	}
+	s.events.push(f)
+	return true
+}
+
+// PostWait is like Post, but waits for f to return.
+func (s *Session) PostWait(f func()) bool {
+	done := make(chan struct{})
+	if !s.Post(func() {
+		defer close(done)
+		f()
+	}) {
+		return false
+	}
+	select {
+	case <-done:
+		return true
+	case <-s.quit:
+		return false
+	}
+}
+
+// Goroutine running the session's event loop until it disconnects.
+func (s *Session) runEventLoop() {
+	defer s.DisconnectOnPanic()
+	for {
+		select {
+		case <-s.events.ready:
+			for _, f := range s.events.take() {
+				f()
+			}
+		case <-s.quit:
+			return
+		}
+	}
+}
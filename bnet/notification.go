@@ -23,6 +23,17 @@ const (
 	NotifySpectatorInvite  = "WTCG.SpectatorInvite"
 )
 
+// Sent to the game server instead of GS_FG_REQ when two friends agree to play
+// each other.
+const NotifyFriendlyChallengeRequest = "GS_FC_REQ"
+
+// Sent to the game server to take the client out of the matchmaking queue.
+// The response says whether it was cancelled before a game was found.
+const (
+	NotifyCancelGameRequest  = "GS_CG_REQ"
+	NotifyCancelGameResponse = "GS_CG_RES"
+)
+
 // A notification sent or received by battle.net from or to another server.
 type Notification struct {
 	Type       string
@@ -120,14 +131,17 @@ func (n *Notification) Map() map[string]interface{} {
 	return res
 }
 
+// HandleNotifications forwards notifications from the game server to the
+// session's event loop until the session disconnects.  Posting never blocks,
+// so the game server can't deadlock against a loop waiting to notify it.
 func (s *Session) HandleNotifications() {
-	s.DisconnectOnPanic()
-	quit := s.ChanForTransition(StateDisconnected)
 	for {
 		select {
 		case notify := <-s.ClientNotifications:
-			s.handleNotification(notify)
-		case <-quit:
+			s.Post(func() {
+				s.handleNotification(notify)
+			})
+		case <-s.quit:
 			return
 		}
 	}
@@ -137,8 +151,13 @@ func (s *Session) handleNotification(notify *Notification) {
 	log.Printf("received notification (%s): %v\n", notify.Type, notify.Attributes)
 	switch notify.Type {
 	default:
-		if ch, ok := s.notificationHandlers[notify.Type]; ok {
-			h := <-ch
+		if handlers := s.notificationHandlers[notify.Type]; len(handlers) != 0 {
+			h := handlers[0]
+			if len(handlers) == 1 {
+				delete(s.notificationHandlers, notify.Type)
+			} else {
+				s.notificationHandlers[notify.Type] = handlers[1:]
+			}
 			h(notify)
 			return
 		}
@@ -159,13 +178,24 @@ func (s *Session) handleNotification(notify *Notification) {
 			}
 		}
 		if forwardToClient {
-			notifier := s.ImportedService("bnet.protocol.notification.NotificationListener").(*NotificationListenerService)
-			notifier.Notify(&notification_service.Notification{
+			n := &notification_service.Notification{
 				Type:      proto.String(notify.Type),
 				SenderId:  senderId,
 				TargetId:  targetId,
 				Attribute: filteredAttr,
-			})
+			}
+			// Notifications for another account or game account are routed
+			// to its session; anything else is for this client.
+			if targetId.GetLow() == 0 || s.isEntity(targetId) {
+				s.notify(n)
+			} else if notify.Type == NotifyWhisper {
+				err := s.whisper(n)
+				if err != nil {
+					log.Printf("error: whisper from %d: %v", s.account.ID, err)
+				}
+			} else if !s.server.deliverNotification(n) {
+				log.Printf("dropping %s notification for offline %s", notify.Type, targetId.String())
+			}
 			return
 		}
 		log.Panicf("error: unhandled notification type %s", notify.Type)
@@ -175,16 +205,11 @@ func (s *Session) handleNotification(notify *Notification) {
 type NotifyHandler func(n *Notification)
 
 // Will trigger handler once the server is notified with a notification of type
-// ty.
+// ty.  Handlers for the same type trigger in the order they were added.  It
+// must be called on the event loop.
 func (s *Session) OnceNotified(ty string, handle NotifyHandler) {
 	log.Printf("Adding OnceNotified for type=%s\n", ty)
-	if ch, ok := s.notificationHandlers[ty]; ok {
-		ch <- handle
-	} else {
-		ch = make(chan NotifyHandler, 1)
-		s.notificationHandlers[ty] = ch
-		ch <- handle
-	}
+	s.notificationHandlers[ty] = append(s.notificationHandlers[ty], handle)
 }
 
 type NotificationListenerServiceBinder struct{}
@@ -210,8 +235,7 @@ func (s *NotificationListenerService) Methods() []string {
 }
 
 func (s *NotificationListenerService) Invoke(method int, body []byte) (resp []byte, err error) {
-	log.Panicf("NotificationListener is a client export, not a server export")
-	return
+	return nil, Errorf(ErrorRPCInvalidService, "NotificationListener is a client export, not a server export")
 }
 
 func (s *NotificationListenerService) Notify(n *notification_service.Notification) {
@@ -225,3 +249,74 @@ func (s *NotificationListenerService) Notify(n *notification_service.Notificatio
 		panic(err)
 	}
 }
+
+// identity returns the entity ids of the client's account and game account.
+func (s *Session) identity() *entity.Identity {
+	return &entity.Identity{
+		AccountId:     EntityId(BnetAccountEntityIDHi, s.account.ID),
+		GameAccountId: EntityId(BnetGameAccountEntityIDHi, s.GameAccountID()),
+	}
+}
+
+// isEntity returns whether an entity id is the client's account or game
+// account.
+func (s *Session) isEntity(id *entity.EntityId) bool {
+	switch id.GetHigh() {
+	case BnetAccountEntityIDHi:
+		return id.GetLow() == s.account.ID
+	case BnetGameAccountEntityIDHi:
+		return id.GetLow() == s.GameAccountID()
+	}
+	return false
+}
+
+type NotificationServiceBinder struct{}
+
+func (NotificationServiceBinder) Bind(sess *Session) Service {
+	return &NotificationService{sess}
+}
+
+// The Notification service lets clients send notifications, such as whispers,
+// to other clients.
+type NotificationService struct {
+	sess *Session
+}
+
+func (s *NotificationService) Name() string {
+	return "bnet.protocol.notification.NotificationService"
+}
+
+func (s *NotificationService) Methods() []string {
+	return []string{
+		"",
+		"SendNotification",
+		"RegisterClient",
+		"UnregisterClient",
+		"FindClient",
+	}
+}
+
+func (s *NotificationService) Invoke(method int, body []byte) (resp []byte, err error) {
+	switch method {
+	case 1:
+		return []byte{}, s.SendNotification(body)
+	case 2, 3, 4:
+		return nil, nyi
+	default:
+		return nil, Errorf(ErrorRPCInvalidMethod, "NotificationService.Invoke: unknown method %v", method)
+	}
+}
+
+// SendNotification passes a whisper on to a friend of the client.
+func (s *NotificationService) SendNotification(body []byte) error {
+	req := notification_service.Notification{}
+	err := proto.Unmarshal(body, &req)
+	if err != nil {
+		return err
+	}
+	log.Printf("req = %s", req.String())
+	if req.GetType() != NotifyWhisper {
+		return Errorf(ErrorInvalidArgs, "SendNotification: can't send %s notifications", req.GetType())
+	}
+	return s.sess.whisper(&req)
+}
@@ -1,9 +1,14 @@
 package bnet
 
 import (
+	"github.com/HearthSim/hs-proto-go/bnet/channel_service"
+	"github.com/HearthSim/hs-proto-go/bnet/channel_types"
+	"github.com/HearthSim/hs-proto-go/bnet/entity"
 	"github.com/HearthSim/hs-proto-go/bnet/presence_service"
+	"github.com/HearthSim/hs-proto-go/bnet/presence_types"
 	"github.com/golang/protobuf/proto"
 	"log"
+	"sync"
 )
 
 type PresenceServiceBinder struct{}
@@ -43,13 +48,14 @@ func (s *PresenceService) Invoke(method int, body []byte) (resp []byte, err erro
 	case 3:
 		return []byte{}, s.Update(body)
 	case 4:
-		return []byte{}, s.Query(body)
+		return s.Query(body)
 	default:
-		log.Panicf("error: PresenceService.Invoke: unknown method %v", method)
-		return
+		return nil, Errorf(ErrorRPCInvalidMethod, "PresenceService.Invoke: unknown method %v", method)
 	}
 }
 
+// Subscribe sends the client the presence of its own or a friend's entity, and
+// then every change to it until the client unsubscribes.
 func (s *PresenceService) Subscribe(body []byte) error {
 	req := presence_service.SubscribeRequest{}
 	err := proto.Unmarshal(body, &req)
@@ -57,13 +63,27 @@ func (s *PresenceService) Subscribe(body []byte) error {
 		return err
 	}
 	log.Printf("req = %s", req.String())
+	err = s.checkVisible(req.GetEntityId())
+	if err != nil {
+		return err
+	}
+	s.sess.server.presence.subscribe(s.sess, req.GetEntityId(), req.GetObjectId())
 	return nil
 }
 
 func (s *PresenceService) Unsubscribe(body []byte) error {
-	return nyi
+	req := presence_service.UnsubscribeRequest{}
+	err := proto.Unmarshal(body, &req)
+	if err != nil {
+		return err
+	}
+	log.Printf("req = %s", req.String())
+	s.sess.server.presence.unsubscribe(s.sess, req.GetEntityId())
+	return nil
 }
 
+// Update sets or clears fields of the presence of the client's account or game
+// account.
 func (s *PresenceService) Update(body []byte) error {
 	req := presence_service.UpdateRequest{}
 	err := proto.Unmarshal(body, &req)
@@ -71,9 +91,241 @@ func (s *PresenceService) Update(body []byte) error {
 		return err
 	}
 	log.Printf("req = %s", req.String())
+	if s.sess.State() != StateReady {
+		return Errorf(ErrorNoAuth, "PresenceService: not logged on")
+	}
+	id := req.GetEntityId()
+	if !s.sess.isEntity(id) {
+		return Errorf(ErrorDenied, "PresenceService: %s isn't the session's entity", id.String())
+	}
+	s.sess.server.presence.update(s.sess, id, req.GetFieldOperation(), req.GetNoCreate())
+	return nil
+}
+
+func (s *PresenceService) Query(body []byte) ([]byte, error) {
+	req := presence_service.QueryRequest{}
+	err := proto.Unmarshal(body, &req)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("req = %s", req.String())
+	err = s.checkVisible(req.GetEntityId())
+	if err != nil {
+		return nil, err
+	}
+	res := presence_service.QueryResponse{
+		Field: s.sess.server.presence.query(req.GetEntityId(), req.GetKey()),
+	}
+	return proto.Marshal(&res)
+}
+
+// checkVisible checks that the client may see the presence of an entity: its
+// own, or that of a friend's account or game account.
+func (s *PresenceService) checkVisible(id *entity.EntityId) error {
+	if s.sess.State() != StateReady {
+		return Errorf(ErrorNoAuth, "PresenceService: not logged on")
+	}
+	if s.sess.isEntity(id) {
+		return nil
+	}
+	accountID := accountIDForEntity(id)
+	if accountID == 0 || !areFriends(s.sess.account.ID, accountID) {
+		return Errorf(ErrorDenied, "PresenceService: %d may not see the presence of %s",
+			s.sess.account.ID, id.String())
+	}
 	return nil
 }
 
-func (s *PresenceService) Query(body []byte) error {
-	return nyi
+type presenceKey struct {
+	high, low uint64
+}
+
+type presenceFieldKey struct {
+	program, group, field uint32
+	index                 uint64
+}
+
+func newPresenceFieldKey(key *presence_types.FieldKey) presenceFieldKey {
+	return presenceFieldKey{key.GetProgram(), key.GetGroup(), key.GetField(), key.GetIndex()}
+}
+
+// The presence of an entity, and the sessions subscribed to it.
+type presenceEntity struct {
+	// The session which set the fields.  They're cleared when it disconnects.
+	owner  *Session
+	fields map[presenceFieldKey]*presence_types.Field
+	// Subscribed sessions, mapped to the object id to notify them with.
+	subscribers map[*Session]uint64
+}
+
+// A presenceStore holds the presence fields of every online entity in memory.
+type presenceStore struct {
+	sync.Mutex
+	entities map[presenceKey]*presenceEntity
+}
+
+func newPresenceStore() *presenceStore {
+	return &presenceStore{
+		entities: map[presenceKey]*presenceEntity{},
+	}
+}
+
+// entity returns the presence of an entity, creating it if asked to.  The
+// store must be locked.
+func (p *presenceStore) entity(id *entity.EntityId, create bool) *presenceEntity {
+	key := presenceKey{id.GetHigh(), id.GetLow()}
+	e := p.entities[key]
+	if e == nil && create {
+		e = &presenceEntity{
+			fields:      map[presenceFieldKey]*presence_types.Field{},
+			subscribers: map[*Session]uint64{},
+		}
+		p.entities[key] = e
+	}
+	return e
+}
+
+// subscribe adds a subscriber to an entity, and sends it the current fields.
+func (p *presenceStore) subscribe(sess *Session, id *entity.EntityId, objectID uint64) {
+	p.Lock()
+	defer p.Unlock()
+	sess.OnDisconnect(p, func() { p.disconnect(sess) })
+	e := p.entity(id, true)
+	e.subscribers[sess] = objectID
+	ops := []*presence_types.FieldOperation{}
+	for _, field := range e.fields {
+		ops = append(ops, &presence_types.FieldOperation{Field: field})
+	}
+	sess.Post(func() {
+		sess.notifyPresence(objectID, id, ops, true)
+	})
+}
+
+func (p *presenceStore) unsubscribe(sess *Session, id *entity.EntityId) {
+	p.Lock()
+	defer p.Unlock()
+	e := p.entity(id, false)
+	if e == nil {
+		return
+	}
+	delete(e.subscribers, sess)
+	p.removeIfUnused(id, e)
+}
+
+// update applies field operations to an entity's presence and passes them on
+// to its subscribers.
+func (p *presenceStore) update(sess *Session, id *entity.EntityId, ops []*presence_types.FieldOperation, noCreate bool) {
+	p.Lock()
+	defer p.Unlock()
+	e := p.entity(id, !noCreate)
+	if e == nil {
+		return
+	}
+	sess.OnDisconnect(p, func() { p.disconnect(sess) })
+	e.owner = sess
+	for _, op := range ops {
+		key := newPresenceFieldKey(op.GetField().GetKey())
+		if op.GetOperation() == presence_types.FieldOperation_CLEAR {
+			delete(e.fields, key)
+		} else {
+			e.fields[key] = op.GetField()
+		}
+	}
+	p.publish(id, e, ops)
+}
+
+// publish sends field operations to an entity's subscribers.  Posting them
+// with the store locked keeps every subscriber's notifications in order.
+func (p *presenceStore) publish(id *entity.EntityId, e *presenceEntity, ops []*presence_types.FieldOperation) {
+	for subscriber, objectID := range e.subscribers {
+		subscriber, objectID := subscriber, objectID
+		subscriber.Post(func() {
+			subscriber.notifyPresence(objectID, id, ops, false)
+		})
+	}
+}
+
+// query returns an entity's fields with the given keys, or all of its fields
+// if no keys are given.
+func (p *presenceStore) query(id *entity.EntityId, keys []*presence_types.FieldKey) []*presence_types.Field {
+	p.Lock()
+	defer p.Unlock()
+	res := []*presence_types.Field{}
+	e := p.entity(id, false)
+	if e == nil {
+		return res
+	}
+	if len(keys) == 0 {
+		for _, field := range e.fields {
+			res = append(res, field)
+		}
+		return res
+	}
+	for _, key := range keys {
+		if field, ok := e.fields[newPresenceFieldKey(key)]; ok {
+			res = append(res, field)
+		}
+	}
+	return res
+}
+
+// disconnect unsubscribes a session from everything, and clears the presence
+// it set.
+func (p *presenceStore) disconnect(sess *Session) {
+	p.Lock()
+	defer p.Unlock()
+	for key, e := range p.entities {
+		id := EntityId(key.high, key.low)
+		delete(e.subscribers, sess)
+		if e.owner == sess {
+			ops := []*presence_types.FieldOperation{}
+			for _, field := range e.fields {
+				ops = append(ops, &presence_types.FieldOperation{
+					Field:     field,
+					Operation: presence_types.FieldOperation_CLEAR.Enum(),
+				})
+			}
+			e.owner = nil
+			e.fields = map[presenceFieldKey]*presence_types.Field{}
+			if len(ops) != 0 {
+				p.publish(id, e, ops)
+			}
+		}
+		p.removeIfUnused(id, e)
+	}
+}
+
+// removeIfUnused drops an entity with no fields or subscribers from the store.
+// The store must be locked.
+func (p *presenceStore) removeIfUnused(id *entity.EntityId, e *presenceEntity) {
+	if len(e.fields) == 0 && len(e.subscribers) == 0 {
+		delete(p.entities, presenceKey{id.GetHigh(), id.GetLow()})
+	}
+}
+
+// notifyPresence sends presence field operations to the client's subscription
+// with the given object id.  The first notification of a subscription adds
+// the entity's channel.  It must be called on the event loop.
+func (s *Session) notifyPresence(objectID uint64, id *entity.EntityId, ops []*presence_types.FieldOperation, added bool) {
+	subscriber := s.ImportedService("bnet.protocol.channel.ChannelSubscriber")
+	if subscriber == nil {
+		return
+	}
+	state := &channel_types.ChannelState{}
+	err := proto.SetExtension(state, presence_types.E_ChannelState_Presence, &presence_types.ChannelState{
+		EntityId:       id,
+		FieldOperation: ops,
+	})
+	if err != nil {
+		log.Panicf("error: Session.notifyPresence: %v", err)
+	}
+	if added {
+		subscriber.(*ChannelSubscriberService).NotifyAdd(objectID, &channel_service.AddNotification{
+			ChannelState: state,
+		})
+	} else {
+		subscriber.(*ChannelSubscriberService).NotifyUpdateChannelState(objectID, &channel_service.UpdateChannelStateNotification{
+			StateChange: state,
+		})
+	}
 }
@@ -0,0 +1,111 @@
+package bnet
+
+import (
+	"github.com/HearthSim/hs-proto-go/bnet/attribute"
+	"github.com/HearthSim/hs-proto-go/bnet/channel_service"
+	"github.com/HearthSim/hs-proto-go/bnet/connection_service"
+	"github.com/HearthSim/hs-proto-go/bnet/presence_types"
+	"github.com/HearthSim/hs-proto-go/bnet/rpc"
+	"github.com/golang/protobuf/proto"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPresenceStore(t *testing.T) {
+	serv := NewServer()
+	client, conn := net.Pipe()
+	subscriber := NewSession(serv, conn)
+	go serv.serveSession(subscriber)
+	defer subscriber.Disconnect()
+	_, conn = net.Pipe()
+	owner := NewSession(serv, conn)
+
+	codec := NewPacketCodec(client, client)
+	connect, _ := proto.Marshal(&connection_service.ConnectRequest{
+		BindRequest: &connection_service.BindRequest{
+			ExportedService: []*connection_service.BoundService{{
+				Hash: proto.Uint32(Hash("bnet.protocol.channel.ChannelSubscriber")),
+				Id:   proto.Uint32(1),
+			}},
+		},
+	})
+	err := codec.WritePacket(&rpc.Header{
+		ServiceId: proto.Uint32(0),
+		MethodId:  proto.Uint32(1),
+		Token:     proto.Uint32(0),
+	}, connect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = codec.ReadPacket(); err != nil {
+		t.Fatal(err)
+	}
+
+	id := EntityId(BnetAccountEntityIDHi, 2)
+	field := func(n uint32, value string) *presence_types.Field {
+		return &presence_types.Field{
+			Key: &presence_types.FieldKey{
+				Program: proto.Uint32(FourCC("BN")),
+				Group:   proto.Uint32(1),
+				Field:   proto.Uint32(n),
+			},
+			Value: &attribute.Variant{StringValue: proto.String(value)},
+		}
+	}
+	serv.presence.update(owner, id, []*presence_types.FieldOperation{
+		{Field: field(1, "away")},
+		{Field: field(2, "in a game")},
+	}, false)
+	serv.presence.update(owner, id, []*presence_types.FieldOperation{
+		{Field: field(2, ""), Operation: presence_types.FieldOperation_CLEAR.Enum()},
+	}, false)
+	if fields := serv.presence.query(id, nil); len(fields) != 1 || fields[0].GetValue().GetStringValue() != "away" {
+		t.Errorf("expected only field 1 to be left, got %v", fields)
+	}
+
+	// Subscribers get the current fields, then every change to them, until
+	// the session which set them disconnects.
+	serv.presence.subscribe(subscriber, id, 42)
+	owner.Disconnect()
+
+	read := func(method uint32) *presence_types.ChannelState {
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		header, body, err := codec.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.GetServiceId() != 1 || header.GetMethodId() != method || header.GetObjectId() != 42 {
+			t.Fatalf("expected method %d for object 42, got %s", method, header.String())
+		}
+		var state proto.Message
+		if method == 1 {
+			n := channel_service.AddNotification{}
+			err = proto.Unmarshal(body, &n)
+			state = n.GetChannelState()
+		} else {
+			n := channel_service.UpdateChannelStateNotification{}
+			err = proto.Unmarshal(body, &n)
+			state = n.GetStateChange()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		ext, err := proto.GetExtension(state, presence_types.E_ChannelState_Presence)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ext.(*presence_types.ChannelState)
+	}
+	added := read(1)
+	if ops := added.GetFieldOperation(); len(ops) != 1 || ops[0].GetField().GetKey().GetField() != 1 {
+		t.Errorf("expected field 1 on subscribing, got %s", added.String())
+	}
+	cleared := read(6)
+	if ops := cleared.GetFieldOperation(); len(ops) != 1 || ops[0].GetOperation() != presence_types.FieldOperation_CLEAR {
+		t.Errorf("expected field 1 to be cleared on disconnect, got %s", cleared.String())
+	}
+	if fields := serv.presence.query(id, nil); len(fields) != 0 {
+		t.Errorf("fields left after the owner disconnected: %v", fields)
+	}
+}
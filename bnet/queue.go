@@ -0,0 +1,122 @@
+package bnet
+
+import (
+	"sync"
+	"time"
+)
+
+// Until slots have freed up a few times, assume one frees up this often.
+const defaultSlotInterval = 30 * time.Second
+
+// A logonQueue limits how many sessions may log on at once.  Sessions past the
+// capacity wait in line for a slot, which is held until the session holding it
+// leaves the queue: when its logon fails, or when it disconnects.
+type logonQueue struct {
+	sync.Mutex
+	// The number of slots; 0 admits everyone.
+	capacity int
+	active   int
+	waiting  []*queuedLogon
+
+	// Moving average of the time between slots freeing up, used for ETAs.
+	slotInterval time.Duration
+	lastFreed    time.Time
+}
+
+// A queuedLogon is a session in the logon queue.  Its callbacks are posted to
+// the session's event loop.
+type queuedLogon struct {
+	sess *Session
+	// update reports the session's position in line, counting from 1.
+	update func(position int, eta time.Duration)
+	// admit is called once the session has a slot.
+	admit func()
+	// Set once the session has left the line or given up its slot.
+	left bool
+}
+
+func newLogonQueue() *logonQueue {
+	return &logonQueue{slotInterval: defaultSlotInterval}
+}
+
+// join puts a session in line.  If a slot is free, admit is called before
+// join returns; otherwise the session is told its position.  The session
+// leaves the queue when it disconnects, or earlier when the returned entry is
+// passed to leave.
+func (q *logonQueue) join(sess *Session, update func(int, time.Duration), admit func()) *queuedLogon {
+	entry := &queuedLogon{sess: sess, update: update, admit: admit}
+	q.Lock()
+	admitted := q.capacity == 0 || (q.active < q.capacity && len(q.waiting) == 0)
+	if admitted {
+		q.active++
+	} else {
+		q.waiting = append(q.waiting, entry)
+		q.sendUpdates(len(q.waiting) - 1)
+	}
+	q.Unlock()
+
+	go func() {
+		<-sess.Done()
+		q.leave(entry)
+	}()
+	if admitted {
+		admit()
+	}
+	return entry
+}
+
+// leave takes a session out of line, or frees the slot it holds.  Leaving
+// more than once does nothing.
+func (q *logonQueue) leave(entry *queuedLogon) {
+	q.Lock()
+	defer q.Unlock()
+	if entry.left {
+		return
+	}
+	entry.left = true
+	for i, e := range q.waiting {
+		if e == entry {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			q.sendUpdates(i)
+			return
+		}
+	}
+
+	// The session held a slot, so the next in line may have it.
+	q.active--
+	now := time.Now()
+	if !q.lastFreed.IsZero() {
+		q.slotInterval = (4*q.slotInterval + now.Sub(q.lastFreed)) / 5
+	}
+	q.lastFreed = now
+	admitted := 0
+	for ; q.active < q.capacity && admitted < len(q.waiting); admitted++ {
+		q.active++
+		q.waiting[admitted].sess.Post(q.waiting[admitted].admit)
+	}
+	if admitted != 0 {
+		q.waiting = q.waiting[admitted:]
+		q.sendUpdates(0)
+	}
+}
+
+// sendUpdates tells the sessions from index i on their positions, which have
+// changed.  The queue must be locked.
+func (q *logonQueue) sendUpdates(i int) {
+	for ; i < len(q.waiting); i++ {
+		position := i + 1
+		eta := time.Duration(position) * q.slotInterval
+		entry := q.waiting[i]
+		entry.sess.Post(func() {
+			entry.update(position, eta)
+		})
+	}
+}
+
+// SetMaxPlayers sets how many sessions may be logged on at once; the rest wait
+// in the logon queue.  0 lets everyone in.
+func (s *Server) SetMaxPlayers(n int) {
+	s.logonQueue.Lock()
+	defer s.logonQueue.Unlock()
+	s.logonQueue.capacity = n
+}
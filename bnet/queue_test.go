@@ -0,0 +1,118 @@
+package bnet
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// A queueEvent is a position update, or 0 when the session is admitted.
+type queueEvent struct {
+	sess     int
+	position int
+}
+
+func TestLogonQueue(t *testing.T) {
+	q := newLogonQueue()
+	q.capacity = 2
+	events := make(chan queueEvent, 16)
+	sessions := []*Session{}
+	join := func() {
+		_, conn := net.Pipe()
+		sess := NewSession(NewServer(), conn)
+		i := len(sessions)
+		sessions = append(sessions, sess)
+		q.join(sess, func(position int, eta time.Duration) {
+			if eta != time.Duration(position)*q.slotInterval {
+				t.Errorf("session %d: bad eta %v at position %d", i, eta, position)
+			}
+			events <- queueEvent{i, position}
+		}, func() {
+			events <- queueEvent{i, 0}
+		})
+	}
+	expect := func(want ...queueEvent) {
+		got := map[queueEvent]bool{}
+		for range want {
+			select {
+			case e := <-events:
+				got[e] = true
+			case <-time.After(time.Second):
+				t.Fatalf("timed out waiting for %v", want)
+			}
+		}
+		for _, e := range want {
+			if !got[e] {
+				t.Errorf("expected %v, got %v", e, got)
+			}
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		join()
+	}
+	expect(queueEvent{0, 0}, queueEvent{1, 0},
+		queueEvent{2, 1}, queueEvent{3, 2}, queueEvent{4, 3})
+
+	// Leaving the line moves everyone behind up ...
+	sessions[3].Disconnect()
+	expect(queueEvent{4, 2})
+	// ... and a slot freeing up admits the first in line.
+	sessions[0].Disconnect()
+	expect(queueEvent{2, 0}, queueEvent{4, 1})
+	sessions[1].Disconnect()
+	expect(queueEvent{4, 0})
+
+	select {
+	case e := <-events:
+		t.Errorf("unexpected %v", e)
+	case <-time.After(10 * time.Millisecond):
+	}
+	for _, sess := range sessions {
+		sess.Disconnect()
+	}
+}
+
+func TestLogonQueueLeave(t *testing.T) {
+	q := newLogonQueue()
+	q.capacity = 1
+	admitted := make(chan int, 4)
+	entries := []*queuedLogon{}
+	for i := 0; i < 3; i++ {
+		i := i
+		_, conn := net.Pipe()
+		sess := NewSession(NewServer(), conn)
+		defer sess.Disconnect()
+		entries = append(entries, q.join(sess, func(int, time.Duration) {}, func() {
+			admitted <- i
+		}))
+	}
+	expect := func(want int) {
+		select {
+		case got := <-admitted:
+			if got != want {
+				t.Fatalf("expected session %d to be admitted, got %d", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for session %d", want)
+		}
+	}
+
+	expect(0)
+	// A session giving up its slot, as on a failed logon, admits the next
+	// in line, but only once.
+	q.leave(entries[0])
+	expect(1)
+	q.leave(entries[0])
+	select {
+	case i := <-admitted:
+		t.Errorf("session %d admitted for a slot freed twice", i)
+	case <-time.After(10 * time.Millisecond):
+	}
+	q.Lock()
+	active := q.active
+	q.Unlock()
+	if active != 1 {
+		t.Errorf("expected 1 active session, got %d", active)
+	}
+}
@@ -0,0 +1,143 @@
+package bnet
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// How long a session replaced by a second login to its account gets to hang
+// up before it's disconnected.
+const replacedSessionTimeout = 5 * time.Second
+
+// A sessionRegistry tracks the sessions of every logged in account, so that
+// services can reach players other than the one they're bound to.
+type sessionRegistry struct {
+	sync.RWMutex
+	byAccount     map[uint64]*Session
+	byGameAccount map[uint64]*Session
+	// Every connected session, logged in or not.
+	connected map[*Session]struct{}
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{
+		byAccount:     map[uint64]*Session{},
+		byGameAccount: map[uint64]*Session{},
+		connected:     map[*Session]struct{}{},
+	}
+}
+
+// connect tracks a session from the time it connects until it disconnects.
+func (r *sessionRegistry) connect(sess *Session) {
+	r.Lock()
+	r.connected[sess] = struct{}{}
+	r.Unlock()
+
+	go func() {
+		<-sess.quit
+		r.Lock()
+		delete(r.connected, sess)
+		r.Unlock()
+	}()
+}
+
+// allConnected returns a snapshot of every connected session.
+func (r *sessionRegistry) allConnected() []*Session {
+	r.RLock()
+	defer r.RUnlock()
+	res := make([]*Session, 0, len(r.connected))
+	for sess := range r.connected {
+		res = append(res, sess)
+	}
+	return res
+}
+
+// add registers a logged in session until it disconnects.  A second login to
+// the same account replaces the first, which is disconnected.
+func (r *sessionRegistry) add(sess *Session) {
+	r.Lock()
+	old, ok := r.byAccount[sess.account.ID]
+	r.byAccount[sess.account.ID] = sess
+	r.byGameAccount[sess.gameAccountID] = sess
+	r.Unlock()
+	if ok && old != sess {
+		log.Printf("account %d logged in again; replacing its session",
+			sess.account.ID)
+		old.kick(ErrorRPCDisconnect, "logged in from another client",
+			replacedSessionTimeout)
+	}
+
+	go func() {
+		<-sess.quit
+		r.remove(sess)
+	}()
+}
+
+// selectGameAccount changes which game account a logged in session plays as.
+func (r *sessionRegistry) selectGameAccount(sess *Session, gameAccountID uint64) {
+	r.Lock()
+	defer r.Unlock()
+	if r.byGameAccount[sess.gameAccountID] == sess {
+		delete(r.byGameAccount, sess.gameAccountID)
+	}
+	sess.gameAccountID = gameAccountID
+	if r.byAccount[sess.account.ID] == sess {
+		r.byGameAccount[gameAccountID] = sess
+	}
+}
+
+func (r *sessionRegistry) remove(sess *Session) {
+	r.Lock()
+	defer r.Unlock()
+	if r.byAccount[sess.account.ID] == sess {
+		delete(r.byAccount, sess.account.ID)
+	}
+	if r.byGameAccount[sess.gameAccountID] == sess {
+		delete(r.byGameAccount, sess.gameAccountID)
+	}
+}
+
+// SessionForAccount returns the session of the online bnet account with the
+// given id, or nil if the account isn't online.
+func (s *Server) SessionForAccount(id uint64) *Session {
+	s.sessions.RLock()
+	defer s.sessions.RUnlock()
+	return s.sessions.byAccount[id]
+}
+
+// SessionForGameAccount returns the session playing as the game account with
+// the given id, or nil if the game account isn't online.
+func (s *Server) SessionForGameAccount(id uint64) *Session {
+	s.sessions.RLock()
+	defer s.sessions.RUnlock()
+	return s.sessions.byGameAccount[id]
+}
+
+// Sessions returns a snapshot of every online session.
+func (s *Server) Sessions() []*Session {
+	s.sessions.RLock()
+	defer s.sessions.RUnlock()
+	res := make([]*Session, 0, len(s.sessions.byAccount))
+	for _, sess := range s.sessions.byAccount {
+		res = append(res, sess)
+	}
+	return res
+}
+
+// AccountID returns the lo part of the session's bnet account entity id.
+func (s *Session) AccountID() uint64 {
+	return s.account.ID
+}
+
+// GameAccountID returns the lo part of the session's game account entity id.
+func (s *Session) GameAccountID() uint64 {
+	s.server.sessions.RLock()
+	defer s.server.sessions.RUnlock()
+	return s.gameAccountID
+}
+
+// BattleTag returns the BattleTag of the session's account.
+func (s *Session) BattleTag() string {
+	return s.account.BattleTag
+}
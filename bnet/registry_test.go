@@ -0,0 +1,93 @@
+package bnet
+
+import (
+	"github.com/HearthSim/hs-proto-go/bnet/connection_service"
+	"github.com/golang/protobuf/proto"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSessionRegistry(t *testing.T) {
+	serv := NewServer()
+	newSession := func(accountID, gameAccountID uint64) (*Session, net.Conn) {
+		client, conn := net.Pipe()
+		sess := NewSession(serv, conn)
+		sess.account.ID = accountID
+		sess.gameAccountID = gameAccountID
+		return sess, client
+	}
+	a, client := newSession(1, 101)
+	b, _ := newSession(2, 102)
+	serv.sessions.add(a)
+	serv.sessions.add(b)
+
+	if serv.SessionForAccount(1) != a || serv.SessionForGameAccount(102) != b {
+		t.Errorf("lookup returned the wrong session")
+	}
+	if serv.SessionForAccount(3) != nil {
+		t.Errorf("lookup of an offline account returned a session")
+	}
+	if n := len(serv.Sessions()); n != 2 {
+		t.Errorf("expected 2 online sessions, got %d", n)
+	}
+
+	// Logging in again replaces the old session, which is disconnected, and
+	// then can't remove the new one when it goes.
+	a2, _ := newSession(1, 101)
+	serv.sessions.add(a2)
+	header, body, err := NewPacketCodec(client, client).ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	notification := &connection_service.DisconnectNotification{}
+	proto.Unmarshal(body, notification)
+	if header.GetServiceId() != 0 || header.GetMethodId() != 4 ||
+		notification.GetErrorCode() != ErrorRPCDisconnect {
+		t.Errorf("replaced session wasn't disconnected: %s %s", header.String(), notification.String())
+	}
+	a.Disconnect()
+	b.Disconnect()
+	deadline := time.Now().Add(time.Second)
+	for serv.SessionForAccount(2) != nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if serv.SessionForAccount(2) != nil || serv.SessionForGameAccount(102) != nil {
+		t.Errorf("disconnected session is still registered")
+	}
+	if serv.SessionForAccount(1) != a2 || serv.SessionForGameAccount(101) != a2 {
+		t.Errorf("replacement session was unregistered")
+	}
+	a2.Disconnect()
+}
+
+func TestSelectGameAccount(t *testing.T) {
+	serv := NewServer()
+	_, conn := net.Pipe()
+	sess := NewSession(serv, conn)
+	defer sess.Disconnect()
+	sess.account.ID = 1
+	sess.gameAccountID = 101
+	serv.sessions.add(sess)
+
+	serv.sessions.selectGameAccount(sess, 102)
+	if sess.GameAccountID() != 102 {
+		t.Errorf("expected game account 102, got %d", sess.GameAccountID())
+	}
+	if serv.SessionForGameAccount(101) != nil || serv.SessionForGameAccount(102) != sess {
+		t.Errorf("registry still maps the old game account")
+	}
+
+	// A cookie logs on again as the selected game account, but only once.
+	cookie, err := serv.tempCookies.issue(sess.account, sess.GameAccountID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cred, ok := serv.tempCookies.redeem("", []byte(cookie))
+	if !ok || cred.gameAccountID != 102 {
+		t.Errorf("cookie rejected or for the wrong game account: %v", cred.gameAccountID)
+	}
+	if _, ok = serv.tempCookies.redeem("", []byte(cookie)); ok {
+		t.Errorf("cookie accepted twice")
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"github.com/HearthSim/hs-proto-go/bnet/content_handle"
 	"github.com/HearthSim/hs-proto-go/bnet/resource_service"
 	"github.com/golang/protobuf/proto"
-	"log"
 )
 
 type ResourcesServiceBinder struct{}
@@ -37,8 +36,7 @@ func (s *ResourcesService) Invoke(method int, body []byte) (resp []byte, err err
 	case 1:
 		return s.GetContentHandle(body)
 	default:
-		log.Panicf("error: ResourcesService.Invoke: unknown method %v", method)
-		return
+		return nil, Errorf(ErrorRPCInvalidMethod, "ResourcesService.Invoke: unknown method %v", method)
 	}
 }
 
@@ -1,16 +1,19 @@
 package bnet
 
 import (
-	"fmt"
-	"github.com/HearthSim/hs-proto-go/bnet/rpc"
-	"github.com/golang/protobuf/proto"
+	"context"
+	"errors"
 	"log"
 	"net"
+	"sync"
 	"time"
 )
 
 // Use nyi to error from unimplemented service methods.
-var nyi = fmt.Errorf("nyi")
+var nyi = Errorf(ErrorNotImplemented, "nyi")
+
+// ErrServerClosed is returned by Serve once Shutdown has been called.
+var ErrServerClosed = errors.New("bnet: server closed")
 
 // A Service is a set of RPC methods bound to a particular Session.
 type Service interface {
@@ -46,26 +49,79 @@ type Server struct {
 
 	// Registered game servers are mapped by their product FourCCs.
 	gameServers map[string]GameServer
+
+	// The cipher used by sessions which upgrade to an encrypted stream.
+	cipher StreamCipher
+
+	// Limits on the size of packets received from clients.
+	maxHeaderSize int
+	maxBodySize   int
+
+	// Checks the credentials of clients logging on.
+	authenticator Authenticator
+	// The login page clients are sent to for their WebCredentials.
+	webAuthURL string
+	// Cookies issued by GenerateTempCookie, which log on as the same game
+	// account again.
+	tempCookies *credentialStore
+
+	// Sessions waiting for, or holding, a logon slot.
+	logonQueue *logonQueue
+
+	// Sessions of logged in accounts.
+	sessions *sessionRegistry
+
+	// The presence of online players.
+	presence *presenceStore
+	// Channels such as parties, and invitations to join them.
+	channels *channelStore
+
+	// The hosts which run games, and the password hosts in other processes
+	// must register with.
+	gameHosts        *gameHostPool
+	gameHostPassword string
+
+	// listenerMutex protects listener and closing.
+	listenerMutex sync.Mutex
+	listener      net.Listener
+	closing       bool
 }
 
 func NewServer() *Server {
 	s := &Server{}
 	s.registeredServices = map[uint32]ServiceBinder{}
 	s.gameServers = map[string]GameServer{}
+	s.cipher = NewARC4Stream
+	s.authenticator = TokenAuthenticator{}
+	s.webAuthURL = "http://hearthsim.info"
+	s.tempCookies = newCredentialStore(tempCookieLifetime)
+	s.maxHeaderSize = DefaultMaxHeaderSize
+	s.maxBodySize = DefaultMaxBodySize
+	s.sessions = newSessionRegistry()
+	s.presence = newPresenceStore()
+	s.channels = newChannelStore()
+	s.gameHosts = newGameHostPool()
+	s.logonQueue = newLogonQueue()
 
 	s.registerService(ConnectionServiceBinder{})
 	// Server exports:
 	s.registerService(AccountServiceBinder{})
 	s.registerService(AuthServerServiceBinder{})
 	s.registerService(ChannelInvitationServiceBinder{})
+	s.registerService(ChannelOwnerServiceBinder{})
+	s.registerService(ChannelServiceBinder{})
 	s.registerService(FriendsServiceBinder{})
 	s.registerService(GameUtilitiesServiceBinder{})
 	s.registerService(GameMasterServiceBinder{})
+	s.registerService(NotificationServiceBinder{})
 	s.registerService(PresenceServiceBinder{})
 	s.registerService(ResourcesServiceBinder{})
 	// Client exports:
+	s.registerService(AccountNotifyServiceBinder{})
 	s.registerService(AuthClientServiceBinder{})
 	s.registerService(ChallengeNotifyServiceBinder{})
+	s.registerService(ChannelSubscriberServiceBinder{})
+	s.registerService(FriendsNotifyServiceBinder{})
 	s.registerService(NotificationListenerServiceBinder{})
 	s.registerService(ChannelInvitationNotifyServiceBinder{})
 
@@ -76,6 +132,18 @@ func (s *Server) RegisterGameServer(fourcc string, serv GameServer) {
 	s.gameServers[fourcc] = serv
 }
 
+// SetPacketLimits sets the largest header and body, in bytes, accepted from
+// clients.  Clients sending anything larger are disconnected.
+func (s *Server) SetPacketLimits(maxHeaderSize, maxBodySize int) {
+	s.maxHeaderSize = maxHeaderSize
+	s.maxBodySize = maxBodySize
+}
+
+// SetAuthenticator sets the authenticator used for clients logging on.
+func (s *Server) SetAuthenticator(a Authenticator) {
+	s.authenticator = a
+}
+
 func (s *Server) registerService(binder ServiceBinder) {
 	s.registeredServices[ServiceHash(binder)] = binder
 }
@@ -87,15 +155,93 @@ func (s *Server) ListenAndServe(addr string) error {
 	if err != nil {
 		return err
 	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until it fails or the server shuts down, in
+// which case it returns ErrServerClosed.
+func (s *Server) Serve(l net.Listener) error {
+	s.listenerMutex.Lock()
+	if s.closing {
+		s.listenerMutex.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listener = l
+	s.listenerMutex.Unlock()
+	stop := make(chan struct{})
+	defer close(stop)
+	go s.sweepSuspensions(stop)
+	go s.sweepInvitations(stop)
+	go s.sweepChannelInvitations(stop)
+	go s.pollGameHosts(stop)
 	for {
 		c, err := l.Accept()
 		if err != nil {
+			s.listenerMutex.Lock()
+			closing := s.closing
+			s.listenerMutex.Unlock()
+			if closing {
+				return ErrServerClosed
+			}
 			return err
 		}
 		go s.handleClient(c)
 	}
 }
 
+// Shutdown stops the server gracefully.  It stops accepting connections, tells
+// every client it's being disconnected and lets the game servers finish or
+// save their work before closing the connections.  If ctx is done first, the
+// connections are closed anyway and the context's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.listenerMutex.Lock()
+	s.closing = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.listenerMutex.Unlock()
+
+	sessions := s.sessions.allConnected()
+	log.Printf("shutting down: disconnecting %d clients", len(sessions))
+	for _, sess := range sessions {
+		err := sess.ForceDisconnect(ErrorRPCShutdown, "server is shutting down")
+		if err != nil {
+			log.Printf("warn: Server.Shutdown: %v", err)
+		}
+	}
+	var res error
+	for program, serv := range s.gameServers {
+		err := serv.Shutdown(ctx)
+		if err != nil {
+			log.Printf("error: Server.Shutdown: %s: %v", program, err)
+			if res == nil {
+				res = err
+			}
+		}
+	}
+	for _, sess := range sessions {
+		sess.Disconnect()
+	}
+	return res
+}
+
+// connectGameServer connects the session to the game server of the program it
+// logged on with, unless it's already connected.  The game server isn't
+// connected at logon, so that the client can pick a game account first.
+func (s *Session) connectGameServer() error {
+	if s.gameServerConnected {
+		return nil
+	}
+	if _, ok := s.server.gameServers[s.program]; !ok {
+		return Errorf(ErrorNotExists, "no game server for program %q", s.program)
+	}
+	s.server.ConnectGameServer(s, s.program)
+	s.gameServerConnected = true
+	go s.HandleNotifications()
+	return nil
+}
+
 func (s *Server) ConnectGameServer(client *Session, program string) {
 	if serv, ok := s.gameServers[program]; ok {
 		serv.Connect(client)
@@ -106,41 +252,36 @@ func (s *Server) ConnectGameServer(client *Session, program string) {
 
 func (s *Server) handleClient(c net.Conn) {
 	c.SetDeadline(time.Time{})
-
+	s.listenerMutex.Lock()
+	closing := s.closing
+	s.listenerMutex.Unlock()
+	if closing {
+		c.Close()
+		return
+	}
 	sess := NewSession(s, c)
+	s.sessions.connect(sess)
+	s.serveSession(sess)
+}
+
+// serveSession reads packets from the session's connection until it fails,
+// handing each to the session's event loop.  The next packet isn't read until
+// the loop has handled the last one.
+func (s *Server) serveSession(sess *Session) {
 	defer sess.DisconnectOnPanic()
-	buf := make([]byte, 0x1000)
+	codec := NewPacketCodec(sess.conn, sess.conn)
+	codec.MaxHeaderSize = s.maxHeaderSize
+	codec.MaxBodySize = s.maxBodySize
 	for {
-		_, err := sess.conn.Read(buf[:2])
-		if err != nil {
-			log.Panicf("error: Server.handleClient: length read: %v", err)
-		}
-		headerLen := int(buf[0])<<8 | int(buf[1])
-		if headerLen > len(buf) {
-			buf = append(buf, make([]byte, headerLen-len(buf))...)
-		}
-		_, err = sess.conn.Read(buf[:headerLen])
+		header, body, err := codec.ReadPacket()
 		if err != nil {
-			log.Panicf("error: Server.handleClient: header read: %v", err)
-		}
-		header := rpc.Header{}
-		err = proto.Unmarshal(buf[:headerLen], &header)
-		if err != nil {
-			log.Panicf("error: Server.handleClient: header decode: %v", err)
-		}
-		bodyLen := int(header.GetSize())
-		var body []byte
-		if bodyLen > 0 {
-			if bodyLen > len(buf) {
-				buf = append(buf, make([]byte, bodyLen-len(buf))...)
-			}
-			body = buf[:bodyLen]
-			_, err = sess.conn.Read(body)
-			if err != nil {
-				log.Panicf("error: Server.handleClient: body read: %v", err)
-			}
+			log.Panicf("error: Server.serveSession: %v", err)
 		}
 		log.Printf("handling packet %s %x", header.String(), body)
-		sess.HandlePacket(&header, body)
+		if !sess.PostWait(func() {
+			sess.HandlePacket(header, body)
+		}) {
+			return
+		}
 	}
 }
@@ -0,0 +1,117 @@
+package bnet
+
+import (
+	"context"
+	"github.com/HearthSim/hs-proto-go/bnet/connection_service"
+	"github.com/HearthSim/hs-proto-go/bnet/rpc"
+	"github.com/golang/protobuf/proto"
+	"net"
+	"testing"
+	"time"
+)
+
+// A blockingGameServer holds up shutdown until it's released, and reports how
+// many sessions were still connected when it was asked to shut down.
+type blockingGameServer struct {
+	serv      *Server
+	connected chan int
+	release   chan struct{}
+}
+
+func (s *blockingGameServer) Connect(sess *Session) {}
+
+func (s *blockingGameServer) Shutdown(ctx context.Context) error {
+	s.connected <- len(s.serv.sessions.allConnected())
+	select {
+	case <-s.release:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	serv := NewServer()
+	game := &blockingGameServer{serv, make(chan int, 1), make(chan struct{})}
+	serv.RegisterGameServer("TEST", game)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- serv.Serve(l)
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	codec := NewPacketCodec(c, c)
+	err = codec.WritePacket(&rpc.Header{
+		ServiceId: proto.Uint32(0),
+		MethodId:  proto.Uint32(1),
+		Token:     proto.Uint32(0),
+	}, mustMarshal(t, &connection_service.ConnectRequest{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = codec.ReadPacket(); err != nil {
+		t.Fatal(err)
+	}
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- serv.Shutdown(context.Background())
+	}()
+
+	// The client is told why it's being disconnected ...
+	header, body, err := codec.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.GetServiceId() != 0 || header.GetMethodId() != 4 {
+		t.Fatalf("expected ForceDisconnect, got %s", header.String())
+	}
+	notify := connection_service.DisconnectNotification{}
+	if err = proto.Unmarshal(body, &notify); err != nil {
+		t.Fatal(err)
+	}
+	if notify.GetErrorCode() != ErrorRPCShutdown || notify.GetReason() == "" {
+		t.Errorf("bad DisconnectNotification: %s", notify.String())
+	}
+	// ... and stays connected while the game servers finish up, but its new
+	// requests are refused.
+	if n := <-game.connected; n != 1 {
+		t.Errorf("expected 1 session connected during game shutdown, got %d", n)
+	}
+	err = codec.WritePacket(&rpc.Header{
+		ServiceId: proto.Uint32(0),
+		MethodId:  proto.Uint32(3),
+		Token:     proto.Uint32(1),
+	}, mustMarshal(t, &connection_service.EchoRequest{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, _, err = codec.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.GetToken() != 1 || header.GetStatus() != ErrorRPCShutdown {
+		t.Errorf("expected request to fail with ErrorRPCShutdown, got %s",
+			header.String())
+	}
+
+	close(game.release)
+	if err = <-shutdown; err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+	if _, _, err = codec.ReadPacket(); err == nil {
+		t.Errorf("connection still open after shutdown")
+	}
+	if err = <-served; err != ErrServerClosed {
+		t.Errorf("Serve: expected ErrServerClosed, got %v", err)
+	}
+}
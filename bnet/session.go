@@ -1,6 +1,9 @@
 package bnet
 
 import (
+	"context"
+	"crypto/cipher"
+	"fmt"
 	"github.com/HearthSim/hs-proto-go/bnet/rpc"
 	"github.com/golang/protobuf/proto"
 	"log"
@@ -28,11 +31,18 @@ type Session struct {
 	// server.
 	ClientNotifications <-chan *Notification
 
-	notificationHandlers map[string]chan NotifyHandler
-
 	server *Server
-	conn   net.Conn
+	conn   *streamConn
+
+	// events are run in order by the session's event loop; see Post.
+	events *eventQueue
+	// Handlers waiting for a notification of each type, oldest first.  Only
+	// used on the event loop.
+	notificationHandlers map[string][]NotifyHandler
 
+	// bindMutex protects exports, imports and importMap, which are bound on
+	// the event loop but looked up from any goroutine.
+	bindMutex sync.RWMutex
 	// Exports contain methods the client may invoke on the server; the client
 	// refers to these as imports.
 	exports []Service
@@ -42,47 +52,99 @@ type Session struct {
 	// Maps an imported service hash to an index into imports.
 	importMap map[uint32]int
 
+	// callMutex protects responses and lastToken, which are used by callers
+	// on any goroutine.
+	callMutex sync.Mutex
 	// A request registers itself for a response by assigning to this map a
 	// channel on which it will listen for the response.
-	responses map[uint32]chan []byte
+	responses map[uint32]chan callResult
 	// The token used for request/response pairs increments sequentially.
 	lastToken uint32
-	// This token is the most recently received token sent by the client.
+	// This token is the most recently received token sent by the client.  It
+	// is only valid on the event loop, while the request is being handled.
 	receivedToken uint32
+	// The object id of the most recently received request, which names the
+	// channel for Channel service requests.  It is only valid on the event
+	// loop, while the request is being handled.
+	receivedObjectID uint64
 
 	// This channel contains outgoing packets.
-	packetQueue chan []byte
+	packetQueue chan queuedPacket
 
-	// stateMutex protects Session.State
-	stateMutex     sync.Mutex
-	stateChange    *sync.Cond
-	stateListeners map[int]int32
+	// Key material agreed on during authentication, from which the stream
+	// keys are derived when the client asks for encryption.
+	sessionKey []byte
+
+	// stateMutex protects state and stateWaiters.
+	stateMutex sync.Mutex
+	// Channels to close when the session enters each state.
+	stateWaiters map[int][]chan struct{}
 	// state is the current state of the session; it may be any of the State
 	// consts defined above.
 	state int
+	// Once the client is told it's being disconnected, its requests fail
+	// with this error code.
+	disconnecting       bool
+	disconnectErrorCode uint32
+	// quit is closed once the session is disconnected.
+	quit     chan struct{}
+	quitOnce sync.Once
+	// Keys of the functions registered with OnDisconnect, guarded by
+	// stateMutex.
+	disconnectHandlers map[interface{}]bool
 
 	startedPlaying time.Time
 	account        Account
+	// The lo part of the game account entity id the session plays as.  It's
+	// guarded by the server's session registry, since it may be changed by
+	// SelectGameAccount.
+	gameAccountID uint64
+	// The program the session logged on with, and the account's game
+	// accounts for it.
+	program      string
+	gameAccounts []GameAccount
+	// Whether the game server has been connected.  Only accessed from the
+	// event loop.
+	gameServerConnected bool
+	// The account state the client is subscribed to.  Only accessed from
+	// the event loop.
+	accountSubscribed        bool
+	gameAccountSubscriptions map[int64]bool
+	// Whether the client is subscribed to friend and invitation changes.
+	// Only accessed from the event loop.
+	friendsSubscribed bool
+	// When the current whisper rate limit window began, and how many whispers
+	// the client has sent in it.  Only accessed from the event loop.
+	whisperWindow time.Time
+	whispersSent  int
+	// Whether the client is subscribed to channel invitations, and the
+	// channels it counts towards its limits, by reservation token.  Only
+	// accessed from the event loop.
+	channelInvitationsSubscribed bool
+	channelCounts                map[uint64]*channelCount
+	lastReservationToken         uint64
 }
 
 func NewSession(s *Server, c net.Conn) *Session {
 	sess := &Session{}
 	sess.server = s
-	sess.conn = c
+	sess.conn = newStreamConn(c)
 	sess.importMap = map[uint32]int{}
-	sess.responses = map[uint32]chan []byte{}
-	sess.packetQueue = make(chan []byte, 1)
-	sess.stateChange = sync.NewCond(&sess.stateMutex)
-	sess.stateListeners = map[int]int32{}
-	sess.notificationHandlers = map[string]chan NotifyHandler{}
-	for i := 0; i < StateCount; i++ {
-		sess.stateListeners[i] = 0
-	}
+	sess.responses = map[uint32]chan callResult{}
+	sess.quit = make(chan struct{})
+	sess.packetQueue = make(chan queuedPacket, 1)
+	sess.stateWaiters = map[int][]chan struct{}{}
+	sess.disconnectHandlers = map[interface{}]bool{}
+	sess.events = newEventQueue()
+	sess.notificationHandlers = map[string][]NotifyHandler{}
+	sess.gameAccountSubscriptions = map[int64]bool{}
+	sess.channelCounts = map[uint64]*channelCount{}
 	sess.state = StateConnecting
 	// The connection service export is implicity bound at index 0:
 	sess.BindExport(0, Hash("bnet.protocol.connection.ConnectionService"))
 	sess.BindImport(0, Hash("bnet.protocol.connection.ConnectionService"))
 	go sess.pumpPacketQueue()
+	go sess.runEventLoop()
 	return sess
 }
 
@@ -96,6 +158,8 @@ func (s *Session) BindExport(index int, hash uint32) {
 	} else {
 		service = binder.Bind(s)
 	}
+	s.bindMutex.Lock()
+	defer s.bindMutex.Unlock()
 	if index >= len(s.exports) {
 		padLen := (1 + index) - len(s.exports)
 		s.exports = append(s.exports, make([]Service, padLen)...)
@@ -111,6 +175,8 @@ func (s *Session) BindImport(index int, hash uint32) {
 	} else {
 		service = binder.Bind(s)
 	}
+	s.bindMutex.Lock()
+	defer s.bindMutex.Unlock()
 	if index >= len(s.imports) {
 		padLen := (1 + index) - len(s.imports)
 		s.imports = append(s.imports, make([]Service, padLen)...)
@@ -120,6 +186,8 @@ func (s *Session) BindImport(index int, hash uint32) {
 }
 
 func (s *Session) ImportedService(name string) Service {
+	s.bindMutex.RLock()
+	defer s.bindMutex.RUnlock()
 	for _, imp := range s.imports {
 		if imp != nil && imp.Name() == name {
 			return imp
@@ -128,31 +196,88 @@ func (s *Session) ImportedService(name string) Service {
 	return nil
 }
 
+// A queuedPacket is an entry in the outgoing packet queue.  Entries with an
+// encrypt stream switch every later write over to that stream.
+type queuedPacket struct {
+	packet  []byte
+	encrypt cipher.Stream
+}
+
 func (s *Session) QueuePacket(header *rpc.Header, buf []byte) error {
 	packet, err := MakePacket(header, buf)
 	if err != nil {
 		return err
 	}
-	s.packetQueue <- packet
+	select {
+	case s.packetQueue <- queuedPacket{packet: packet}:
+		return nil
+	case <-s.quit:
+		return Errorf(ErrorRPCPeerDisconnected, "session is disconnected")
+	}
+}
+
+// EnableEncryption switches the session's connection over to the server's
+// stream cipher.  Packets already queued are still sent in the clear.  It must
+// be called on the event loop while handling a packet, since the goroutine
+// reading packets waits for that and the read half is switched in place.
+func (s *Session) EnableEncryption() error {
+	enc, dec, err := s.newStreams()
+	if err != nil {
+		return err
+	}
+	return s.switchStreams(enc, dec)
+}
+
+// newStreams keys the keystreams for the session's outgoing and incoming
+// traffic.
+func (s *Session) newStreams() (enc, dec cipher.Stream, err error) {
+	if len(s.sessionKey) == 0 {
+		return nil, nil, fmt.Errorf("session has no key to encrypt with")
+	}
+	serverKey, clientKey := StreamKeys(s.sessionKey)
+	enc, err = s.server.cipher(serverKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	dec, err = s.server.cipher(clientKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return enc, dec, nil
+}
+
+// switchStreams switches the connection over to keystreams from newStreams.
+// It only fails if the session has disconnected.
+func (s *Session) switchStreams(enc, dec cipher.Stream) error {
+	select {
+	case s.packetQueue <- queuedPacket{encrypt: enc}:
+	case <-s.quit:
+		return Errorf(ErrorRPCPeerDisconnected, "session is disconnected")
+	}
+	s.conn.encryptReads(dec)
 	return nil
 }
 
 // Goroutine to pump the outgoing packet queue
 func (s *Session) pumpPacketQueue() {
 	defer s.DisconnectOnPanic()
-	quit := s.ChanForTransition(StateDisconnected)
 	for {
 		select {
-		case packet := <-s.packetQueue:
-			w, err := s.conn.Write(packet)
-			if w != len(packet) {
-				panic(err)
+		case q := <-s.packetQueue:
+			if q.packet != nil {
+				w, err := s.conn.Write(q.packet)
+				if w != len(q.packet) {
+					panic(err)
+				}
+				log.Printf("Wrote %d bytes", len(q.packet))
+				if err != nil {
+					log.Panicf("error: Session.WritePacketQueue failed: %v", err)
+				}
 			}
-			log.Printf("Wrote %d bytes", len(packet))
-			if err != nil {
-				log.Panicf("error: Session.WritePacketQueue failed: %v", err)
+			if q.encrypt != nil {
+				s.conn.encryptWrites(q.encrypt)
 			}
-		case <-quit:
+		case <-s.quit:
 			return
 		}
 	}
@@ -173,13 +298,83 @@ func (s *Session) Disconnect() {
 	s.Transition(StateDisconnected)
 }
 
+// ForceDisconnect tells the client that it's being disconnected, with a bnet
+// error code and a reason.  Requests the client makes afterwards fail with the
+// same code.  The connection stays open until Disconnect is called, so that
+// work the client already started can finish.
+func (s *Session) ForceDisconnect(errorCode uint32, reason string) error {
+	s.stateMutex.Lock()
+	s.disconnecting = true
+	s.disconnectErrorCode = errorCode
+	s.stateMutex.Unlock()
+	log.Printf("disconnecting client: %s (error %d)", reason, errorCode)
+	connection := s.ImportedService("bnet.protocol.connection.ConnectionService").(*ConnectionService)
+	return connection.ForceDisconnect(errorCode, reason)
+}
+
+// isDisconnecting returns whether the session has been force-disconnected.
+func (s *Session) isDisconnecting() bool {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	return s.disconnecting
+}
+
+// kick force-disconnects the session, and disconnects it if the client hasn't
+// hung up once timeout has passed.  A session which is already being
+// disconnected is left alone.
+func (s *Session) kick(errorCode uint32, reason string, timeout time.Duration) {
+	s.stateMutex.Lock()
+	disconnecting := s.disconnecting
+	s.disconnecting = true
+	s.stateMutex.Unlock()
+	if disconnecting {
+		return
+	}
+	err := s.ForceDisconnect(errorCode, reason)
+	if err != nil {
+		log.Printf("error: Session.kick: %v", err)
+	}
+	go func() {
+		select {
+		case <-s.Done():
+		case <-time.After(timeout):
+			s.Disconnect()
+		}
+	}()
+}
+
+// Done returns a channel which is closed once the session is disconnected.
+func (s *Session) Done() <-chan struct{} {
+	return s.quit
+}
+
+// OnDisconnect calls f on a goroutine of its own once the session is
+// disconnected, unless a function was already registered with the same key.
+// Stores holding on to sessions use it to forget them.
+func (s *Session) OnDisconnect(key interface{}, f func()) {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	if s.disconnectHandlers[key] {
+		return
+	}
+	s.disconnectHandlers[key] = true
+	go func() {
+		<-s.Done()
+		f()
+	}()
+}
+
 func (s *Session) MakeRequestHeader(service Service, methodId, size int) *rpc.Header {
+	s.bindMutex.RLock()
 	serviceId, ok := s.importMap[Hash(service.Name())]
+	s.bindMutex.RUnlock()
 	if !ok {
 		log.Panicf("Client didn't export service %s", service.Name())
 	}
+	s.callMutex.Lock()
 	token := s.lastToken
 	s.lastToken++
+	s.callMutex.Unlock()
 	return &rpc.Header{
 		ServiceId: proto.Uint32(uint32(serviceId)),
 		MethodId:  proto.Uint32(uint32(methodId)),
@@ -188,28 +383,31 @@ func (s *Session) MakeRequestHeader(service Service, methodId, size int) *rpc.He
 	}
 }
 
+// HandlePacket handles a packet from the client.  It must be called on the
+// event loop.
 func (s *Session) HandlePacket(header *rpc.Header, body []byte) {
-	if s.state == StateDisconnected {
+	if s.State() == StateDisconnected {
 		panic("cannot handle packets from disconnected clients")
 	}
 	serviceId := int(header.GetServiceId())
 	methodId := int(header.GetMethodId())
 	s.receivedToken = header.GetToken()
+	s.receivedObjectID = header.GetObjectId()
+
+	s.stateMutex.Lock()
+	disconnecting, errorCode := s.disconnecting, s.disconnectErrorCode
+	s.stateMutex.Unlock()
 
 	if serviceId == 254 {
-		s.HandleResponse(header.GetToken(), body)
+		s.HandleResponse(header.GetToken(), header.GetStatus(), body)
+	} else if disconnecting {
+		s.RespondError(header.GetToken(), errorCode)
 	} else {
-		resp := s.HandleRequest(serviceId, methodId, body)
-		if resp != nil {
-			respHead := &rpc.Header{
-				ServiceId: proto.Uint32(254),
-				Token:     header.Token,
-				Size:      proto.Uint32(uint32(len(resp))),
-			}
-			err := s.QueuePacket(respHead, resp)
-			if err != nil {
-				log.Panicf("error: Session.HandlePacket: respond: %v", err)
-			}
+		resp, err := s.HandleRequest(serviceId, methodId, body)
+		if err != nil {
+			s.RespondError(header.GetToken(), ErrorCode(err))
+		} else if resp != nil {
+			s.Respond(header.GetToken(), resp)
 		}
 	}
 }
@@ -225,22 +423,103 @@ func (s *Session) Respond(token uint32, body []byte) {
 	}
 }
 
-func (s *Session) HandleResponse(token uint32, body []byte) {
-	if ch, ok := s.responses[token]; ok {
-		// Note: don't use unbuffered channels for response channels, please...
-		ch <- body
+// RespondError fails the request with the given token, sending a response with
+// the bnet error code as its status.
+func (s *Session) RespondError(token uint32, status uint32) {
+	err := s.QueuePacket(&rpc.Header{
+		ServiceId: proto.Uint32(254),
+		Token:     proto.Uint32(token),
+		Status:    proto.Uint32(status),
+		Size:      proto.Uint32(0),
+	}, nil)
+	if err != nil {
+		log.Panicf("error: Session.RespondError: %v", err)
+	}
+}
+
+// A callResult is a client's response to a request made with Session.Call.
+type callResult struct {
+	status uint32
+	body   []byte
+}
+
+func (s *Session) HandleResponse(token, status uint32, body []byte) {
+	s.callMutex.Lock()
+	ch, ok := s.responses[token]
+	s.callMutex.Unlock()
+	if ok {
+		// Response channels are buffered, and each token is only answered
+		// once, so this never blocks.
+		ch <- callResult{status, body}
 	} else {
 		log.Printf(" warn: Session.HandleResponse: token not found: %v", token)
 	}
 }
 
-func (s *Session) HandleRequest(serviceId, methodId int, body []byte) (resp []byte) {
+// DefaultCallTimeout is how long Call waits for the client to respond.
+const DefaultCallTimeout = 30 * time.Second
+
+// Call invokes a method on one of the client's exports and waits for the
+// response body, giving up after DefaultCallTimeout.
+func (s *Session) Call(service Service, methodId int, req proto.Message) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultCallTimeout)
+	defer cancel()
+	return s.CallContext(ctx, service, methodId, req)
+}
+
+// CallContext is like Call, but waits for the response until ctx is done.  An
+// error status from the client is returned as an *Error with that code.  It
+// must not be called on the session's own event loop, which handles the
+// response.
+func (s *Session) CallContext(ctx context.Context, service Service, methodId int, req proto.Message) ([]byte, error) {
+	body, err := proto.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	header := s.MakeRequestHeader(service, methodId, len(body))
+	token := header.GetToken()
+	ch := make(chan callResult, 1)
+	s.callMutex.Lock()
+	s.responses[token] = ch
+	s.callMutex.Unlock()
+	defer func() {
+		s.callMutex.Lock()
+		delete(s.responses, token)
+		s.callMutex.Unlock()
+	}()
+
+	err = s.QueuePacket(header, body)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case res := <-ch:
+		if res.status != ErrorOK {
+			return nil, Errorf(res.status, "%s method %d failed", service.Name(), methodId)
+		}
+		return res.body, nil
+	case <-ctx.Done():
+		return nil, Errorf(ErrorRPCRequestTimedOut, "%s method %d: %v",
+			service.Name(), methodId, ctx.Err())
+	case <-s.quit:
+		return nil, Errorf(ErrorRPCPeerDisconnected, "%s method %d: session disconnected",
+			service.Name(), methodId)
+	}
+}
+
+// HandleRequest invokes a method on one of the session's exports.  Failed
+// calls, including ones which panic, return an error rather than taking the
+// session down with them.
+func (s *Session) HandleRequest(serviceId, methodId int, body []byte) (resp []byte, err error) {
 	var service Service
+	s.bindMutex.RLock()
 	if serviceId < len(s.exports) {
 		service = s.exports[serviceId]
 	}
+	s.bindMutex.RUnlock()
 	if service == nil {
-		log.Panicf("error: Session.HandleRequest: Unknown serviceId %v", serviceId)
+		log.Printf("error: Session.HandleRequest: Unknown serviceId %v", serviceId)
+		return nil, Errorf(ErrorRPCServiceNotBound, "unknown serviceId %v", serviceId)
 	}
 	serviceName := service.Name()
 	methodNames := service.Methods()
@@ -249,43 +528,139 @@ func (s *Session) HandleRequest(serviceId, methodId int, body []byte) (resp []by
 		methodName = methodNames[methodId]
 	}
 	log.Printf("Session.HandleRequest: invoking %s.%s", serviceName, methodName)
-	resp, err := service.Invoke(methodId, body)
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("error: Session.HandleRequest: %s.%s panicked: %v\n"+
+				"=== STACK TRACE ===\n%s", serviceName, methodName, r,
+				string(debug.Stack()))
+			resp = nil
+			err = Errorf(ErrorInternal, "%s.%s: %v", serviceName, methodName, r)
+		}
+	}()
+	resp, err = service.Invoke(methodId, body)
 	if err != nil {
-		log.Panicf("error: Session.HandleRequest: Invoke: %v", err)
+		log.Printf("error: Session.HandleRequest: %s.%s: %v",
+			serviceName, methodName, err)
+		return nil, err
+	}
+	return resp, nil
+}
+
+// stateTransitions lists the states each state may move to.  Every state
+// may move to StateDisconnected, and nothing may leave it.
+var stateTransitions = [StateCount][]int{
+	StateDisconnected:         {},
+	StateConnecting:           {StateConnected, StateDisconnected},
+	StateConnected:            {StateLoggingIn, StateDisconnected},
+	StateLoggingIn:            {StateReady, StateAuthenticationFailed, StateDisconnected},
+	StateAuthenticationFailed: {StateLoggingIn, StateDisconnected},
+	StateReady:                {StateDisconnected},
+}
+
+var stateNames = [StateCount]string{
+	StateDisconnected:         "Disconnected",
+	StateConnecting:           "Connecting",
+	StateConnected:            "Connected",
+	StateLoggingIn:            "LoggingIn",
+	StateAuthenticationFailed: "AuthenticationFailed",
+	StateReady:                "Ready",
+}
+
+func stateName(state int) string {
+	if state < 0 || state >= StateCount {
+		return fmt.Sprintf("State(%d)", state)
 	}
-	return resp
+	return stateNames[state]
+}
+
+// CanTransition reports whether a session may move from one state to another.
+func CanTransition(from, to int) bool {
+	if from < 0 || from >= StateCount {
+		return false
+	}
+	for _, allowed := range stateTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
 }
 
 // Transition updates the session's state with the value provided, and notifies
-// any listeners of that state update.
-func (s *Session) Transition(state int) {
+// any listeners of that state update.  Moves not allowed by stateTransitions
+// are logged and rejected with an error.  Moving to the current state again
+// does nothing, so the session may be disconnected more than once.
+func (s *Session) Transition(state int) error {
 	s.stateMutex.Lock()
+	if s.state == state {
+		s.stateMutex.Unlock()
+		return nil
+	}
+	if !CanTransition(s.state, state) {
+		from := s.state
+		s.stateMutex.Unlock()
+		log.Printf("error: Session.Transition: invalid transition from %s to %s",
+			stateName(from), stateName(state))
+		return Errorf(ErrorRPCProtocolError, "invalid transition from %s to %s",
+			stateName(from), stateName(state))
+	}
 	s.state = state
+	waiters := s.stateWaiters[state]
+	delete(s.stateWaiters, state)
+	if state == StateDisconnected {
+		// Nobody may leave StateDisconnected, so nobody waiting for
+		// another state would ever wake.
+		s.stateWaiters = nil
+	}
 	s.stateMutex.Unlock()
-	s.stateChange.Broadcast()
-	// If every broadcast hasn't triggered yet, we should wait:
-	for s.stateListeners[state] != 0 {
-		time.Sleep(time.Millisecond)
+
+	for _, ch := range waiters {
+		close(ch)
+	}
+	if state == StateDisconnected {
+		s.quitOnce.Do(func() {
+			close(s.quit)
+		})
 	}
+	return nil
 }
 
-// WaitForTransition blocks until the session state matches the value provided.
-func (s *Session) WaitForTransition(state int) {
+// State returns the current state of the session.
+func (s *Session) State() int {
 	s.stateMutex.Lock()
-	s.stateListeners[state] += 1
-	for s.state != state {
-		s.stateChange.Wait()
+	defer s.stateMutex.Unlock()
+	return s.state
+}
+
+// WaitForTransition blocks until the session state matches the value provided,
+// and returns false if the session disconnects first.
+func (s *Session) WaitForTransition(state int) bool {
+	select {
+	case <-s.ChanForTransition(state):
+		return true
+	case <-s.quit:
+		return state == StateDisconnected
 	}
-	s.stateListeners[state] -= 1
-	s.stateMutex.Unlock()
 }
 
-// ChanForTransition makes a channel that waits for the specified state.
-func (s *Session) ChanForTransition(state int) chan struct{} {
-	res := make(chan struct{}, 1)
-	go func() {
-		s.WaitForTransition(state)
-		res <- struct{}{}
-	}()
-	return res
+// ChanForTransition makes a channel that is closed once the session enters the
+// specified state, or immediately if it's already in it.  It is never closed
+// if the session disconnects first; select on the session's quit channel too.
+func (s *Session) ChanForTransition(state int) <-chan struct{} {
+	ch := make(chan struct{})
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	if s.state == state {
+		close(ch)
+	} else if s.stateWaiters != nil {
+		s.stateWaiters[state] = append(s.stateWaiters[state], ch)
+	}
+	return ch
+}
+
+// waitersFor returns the number of channels waiting for a state.
+func (s *Session) waitersFor(state int) int {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	return len(s.stateWaiters[state])
 }
@@ -1,6 +1,13 @@
 package bnet
 
 import (
+	"context"
+	"fmt"
+	"github.com/HearthSim/hs-proto-go/bnet/connection_service"
+	"github.com/HearthSim/hs-proto-go/bnet/game_utilities_service"
+	"github.com/HearthSim/hs-proto-go/bnet/rpc"
+	"github.com/golang/protobuf/proto"
+	"net"
 	"runtime"
 	"sync"
 	"sync/atomic"
@@ -8,37 +15,445 @@ import (
 	"time"
 )
 
-func TestTransitions(t *testing.T) {
-	runtime.GOMAXPROCS(8)
-
+func newTestSession() *Session {
 	s := &Session{}
-	s.stateChange = sync.NewCond(&s.stateMutex)
-	s.stateListeners = map[int]int32{}
+	s.stateWaiters = map[int][]chan struct{}{}
+	s.disconnectHandlers = map[interface{}]bool{}
 	s.state = StateConnecting
+	s.quit = make(chan struct{})
+	return s
+}
+
+func TestOnDisconnect(t *testing.T) {
+	s := newTestSession()
+	called := make(chan string, 3)
+	s.OnDisconnect("store", func() { called <- "first" })
+	s.OnDisconnect("store", func() { called <- "again" })
+	select {
+	case f := <-called:
+		t.Fatalf("%s function called before the session disconnected", f)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	s.Transition(StateDisconnected)
+	if f := <-called; f != "first" {
+		t.Errorf("expected the first function registered to be called, got %s", f)
+	}
+	// Functions registered afterwards are called right away.
+	s.OnDisconnect("other store", func() { called <- "late" })
+	if f := <-called; f != "late" {
+		t.Errorf("expected the late function to be called, got %s", f)
+	}
+	select {
+	case f := <-called:
+		t.Errorf("%s function called too", f)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
 
+func TestTransitions(t *testing.T) {
+	runtime.GOMAXPROCS(8)
+
+	s := newTestSession()
 	numWaits := int32(1000)
 	j := int32(0)
+	done := make(chan struct{})
 	for i := int32(0); i < numWaits; i++ {
 		go func() {
-			s.WaitForTransition(StateDisconnected)
-			atomic.AddInt32(&j, 1)
+			if s.WaitForTransition(StateConnected) {
+				atomic.AddInt32(&j, 1)
+			}
+			done <- struct{}{}
 		}()
 	}
-	for s.stateListeners[StateDisconnected] < numWaits {
+	for s.waitersFor(StateConnected) < int(numWaits) {
 		time.Sleep(time.Millisecond)
 	}
-	// each goroutine needs to get its PC through the cond.Wait() call, so we
-	// grab a momentary lock on the mutex to ensure everything gets through.
-	s.stateMutex.Lock()
-	done := make(chan struct{})
+	if err := s.Transition(StateConnected); err != nil {
+		t.Fatal(err)
+	}
+	for i := int32(0); i < numWaits; i++ {
+		<-done
+	}
+	if atomic.LoadInt32(&j) != numWaits {
+		t.Errorf("failed: %d != %d", j, numWaits)
+	}
+
+	// Waiting for the current state returns at once, and waiting for any
+	// other state gives up once the session disconnects.
+	if !s.WaitForTransition(StateConnected) {
+		t.Errorf("waiting for the current state failed")
+	}
 	go func() {
+		for s.waitersFor(StateReady) == 0 {
+			time.Sleep(time.Millisecond)
+		}
 		s.Transition(StateDisconnected)
-		s.Transition(StateConnecting)
-		done <- struct{}{}
 	}()
-	s.stateMutex.Unlock()
-	<-done
-	if j != numWaits {
-		t.Errorf("failed: %d != %d", j, numWaits)
+	if s.WaitForTransition(StateReady) {
+		t.Errorf("waiting for a state after disconnection succeeded")
+	}
+	if !s.WaitForTransition(StateDisconnected) {
+		t.Errorf("waiting for StateDisconnected failed")
+	}
+}
+
+func TestTransitionRules(t *testing.T) {
+	for i, x := range []struct {
+		Path []int
+		Ok   bool
+	}{
+		{[]int{StateConnected, StateLoggingIn, StateReady, StateDisconnected}, true},
+		{[]int{StateConnected, StateLoggingIn, StateAuthenticationFailed, StateLoggingIn}, true},
+		{[]int{StateDisconnected}, true},
+		// Moving to the current state again is allowed, and does nothing.
+		{[]int{StateConnected, StateConnected}, true},
+		{[]int{StateDisconnected, StateDisconnected}, true},
+		{[]int{StateLoggingIn}, false},
+		{[]int{StateConnected, StateLoggingIn, StateReady, StateLoggingIn}, false},
+		{[]int{StateConnected, StateReady}, false},
+		{[]int{StateDisconnected, StateConnecting}, false},
+		{[]int{StateDisconnected, StateConnected}, false},
+		{[]int{StateCount}, false},
+	} {
+		s := newTestSession()
+		var err error
+		for _, state := range x.Path {
+			prev := s.State()
+			if err = s.Transition(state); err != nil {
+				if s.State() != prev {
+					t.Errorf("path %d: rejected transition changed state", i)
+				}
+				break
+			}
+		}
+		if (err == nil) != x.Ok {
+			t.Errorf("path %d: expected ok=%v, got %v", i, x.Ok, err)
+		}
+	}
+}
+
+func TestHandleRequestError(t *testing.T) {
+	serv := NewServer()
+	client, conn := net.Pipe()
+	sess := NewSession(serv, conn)
+	go serv.serveSession(sess)
+	defer sess.Disconnect()
+
+	codec := NewPacketCodec(client, client)
+	for i, x := range []struct {
+		ServiceId uint32
+		MethodId  uint32
+		Status    uint32
+	}{
+		// ConnectionService.Bind is not yet implemented.
+		{0, 2, ErrorNotImplemented},
+		{0, 100, ErrorRPCInvalidMethod},
+		{99, 1, ErrorRPCServiceNotBound},
+		// The session should still be up to handle a successful call.
+		{0, 1, ErrorOK},
+	} {
+		err := codec.WritePacket(&rpc.Header{
+			ServiceId: proto.Uint32(x.ServiceId),
+			MethodId:  proto.Uint32(x.MethodId),
+			Token:     proto.Uint32(uint32(i)),
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header, _, err := codec.ReadPacket()
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		if header.GetToken() != uint32(i) {
+			t.Errorf("request %d: bad token %d", i, header.GetToken())
+		}
+		if header.GetStatus() != x.Status {
+			t.Errorf("request %d: status %d != %d", i, header.GetStatus(), x.Status)
+		}
+	}
+}
+
+func TestCall(t *testing.T) {
+	serv := NewServer()
+	client, conn := net.Pipe()
+	sess := NewSession(serv, conn)
+	go serv.serveSession(sess)
+	codec := NewPacketCodec(client, client)
+	connection := sess.ImportedService("bnet.protocol.connection.ConnectionService")
+
+	// The client echoes the first request and fails the second.
+	go func() {
+		for _, status := range []uint32{ErrorOK, ErrorDenied} {
+			header, body, err := codec.ReadPacket()
+			if err != nil {
+				return
+			}
+			if status != ErrorOK {
+				body = nil
+			}
+			codec.WritePacket(&rpc.Header{
+				ServiceId: proto.Uint32(254),
+				Token:     header.Token,
+				Status:    proto.Uint32(status),
+			}, body)
+		}
+	}()
+	echo := &connection_service.EchoRequest{Payload: []byte("ping")}
+	res, err := sess.Call(connection, 3, echo)
+	if err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+	if string(res) != string(mustMarshal(t, echo)) {
+		t.Errorf("Call: bad response %x", res)
+	}
+	_, err = sess.Call(connection, 3, echo)
+	if ErrorCode(err) != ErrorDenied {
+		t.Errorf("Call: expected ErrorDenied, got %v", err)
+	}
+
+	// Requests the client never answers time out.
+	go codec.ReadPacket()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	_, err = sess.CallContext(ctx, connection, 3, echo)
+	cancel()
+	if ErrorCode(err) != ErrorRPCRequestTimedOut {
+		t.Errorf("CallContext: expected timeout, got %v", err)
+	}
+
+	// ... and fail once the session disconnects.
+	go func() {
+		codec.ReadPacket()
+		sess.Disconnect()
+	}()
+	_, err = sess.Call(connection, 3, echo)
+	if ErrorCode(err) != ErrorRPCPeerDisconnected {
+		t.Errorf("Call: expected disconnection, got %v", err)
+	}
+
+	sess.callMutex.Lock()
+	pending := len(sess.responses)
+	sess.callMutex.Unlock()
+	if pending != 0 {
+		t.Errorf("%d response channels left behind", pending)
+	}
+}
+
+func mustMarshal(t *testing.T, m proto.Message) []byte {
+	buf, err := proto.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+// connectClient starts serving a session whose client connects exporting the
+// service named, bound to id 1, and returns the session and the client's end.
+func connectClient(t *testing.T, serv *Server, export string) (*Session, *PacketCodec) {
+	client, conn := net.Pipe()
+	sess := NewSession(serv, conn)
+	go serv.serveSession(sess)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	codec := NewPacketCodec(client, client)
+	err := codec.WritePacket(&rpc.Header{
+		ServiceId: proto.Uint32(0),
+		MethodId:  proto.Uint32(1),
+		Token:     proto.Uint32(0),
+	}, mustMarshal(t, &connection_service.ConnectRequest{
+		BindRequest: &connection_service.BindRequest{
+			ExportedService: []*connection_service.BoundService{{
+				Hash: proto.Uint32(Hash(export)),
+				Id:   proto.Uint32(1),
+			}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = codec.ReadPacket(); err != nil {
+		t.Fatal(err)
+	}
+	return sess, codec
+}
+
+// A fakeGameServer answers every client request notification from a session
+// with the request's attributes, as the game server would.
+func fakeGameServer(sess *Session) chan<- *Notification {
+	server := make(chan *Notification)
+	client := make(chan *Notification)
+	sess.ServerNotifications = server
+	sess.ClientNotifications = client
+	sess.gameServerConnected = true
+	go sess.HandleNotifications()
+	go func() {
+		for {
+			select {
+			case n := <-server:
+				res := &Notification{NotifyClientResponse, n.Attributes}
+				select {
+				case client <- res:
+				case <-sess.quit:
+					return
+				}
+			case <-sess.quit:
+				return
+			}
+		}
+	}()
+	return client
+}
+
+// Many clients make requests while the server calls them and forwards
+// notifications to them; run with -race.
+func TestConcurrentSessions(t *testing.T) {
+	const numClients = 16
+	const numRequests = 20
+	serv := NewServer()
+	errs := make(chan error, numClients)
+	for i := 0; i < numClients; i++ {
+		go func(i int) {
+			errs <- runConcurrentClient(serv, uint64(i), numRequests)
+		}(i)
+	}
+	for i := 0; i < numClients; i++ {
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for clients")
+		}
+	}
+}
+
+func runConcurrentClient(serv *Server, id uint64, numRequests int) error {
+	client, conn := net.Pipe()
+	sess := NewSession(serv, conn)
+	sess.gameAccountID = id
+	notifications := fakeGameServer(sess)
+	go serv.serveSession(sess)
+	defer sess.Disconnect()
+
+	codec := NewPacketCodec(client, client)
+	connect, _ := proto.Marshal(&connection_service.ConnectRequest{
+		BindRequest: &connection_service.BindRequest{
+			ImportedServiceHash: []uint32{
+				Hash("bnet.protocol.game_utilities.GameUtilities"),
+			},
+			ExportedService: []*connection_service.BoundService{{
+				Hash: proto.Uint32(Hash("bnet.protocol.notification.NotificationListener")),
+				Id:   proto.Uint32(1),
+			}},
+		},
+	})
+	err := codec.WritePacket(&rpc.Header{
+		ServiceId: proto.Uint32(0),
+		MethodId:  proto.Uint32(1),
+		Token:     proto.Uint32(0),
+	}, connect)
+	if err != nil {
+		return err
+	}
+	if _, _, err = codec.ReadPacket(); err != nil {
+		return err
+	}
+
+	// The client answers calls and counts everything else it receives.
+	var writeMutex sync.Mutex
+	writePacket := func(header *rpc.Header, body []byte) error {
+		writeMutex.Lock()
+		defer writeMutex.Unlock()
+		return codec.WritePacket(header, body)
+	}
+	responses := make(chan *rpc.Header, numRequests)
+	responseBodies := make(chan []byte, numRequests)
+	notified := make(chan struct{}, numRequests)
+	go func() {
+		for {
+			header, body, err := codec.ReadPacket()
+			if err != nil {
+				return
+			}
+			switch header.GetServiceId() {
+			case 254:
+				responses <- header
+				responseBodies <- body
+			case 0:
+				// net.Pipe is unbuffered, so keep reading while the
+				// request side holds the connection.
+				go writePacket(&rpc.Header{
+					ServiceId: proto.Uint32(254),
+					Token:     header.Token,
+				}, body)
+			case 1:
+				notified <- struct{}{}
+			}
+		}
+	}()
+
+	calls := make(chan error, numRequests)
+	connection := sess.ImportedService("bnet.protocol.connection.ConnectionService")
+	for i := 0; i < numRequests; i++ {
+		go func() {
+			_, err := sess.Call(connection, 3, &connection_service.EchoRequest{})
+			calls <- err
+		}()
+		go func() {
+			notifications <- NewNotification(NotifyWhisper, map[string]interface{}{
+				"forwardToClient": true,
+				"targetId":        *EntityId(BnetGameAccountEntityIDHi, id),
+			})
+		}()
+		req, _ := proto.Marshal(&game_utilities_service.ClientRequest{
+			Attribute: NewNotification("", map[string]interface{}{
+				"token": uint64(i),
+				"id":    id,
+			}).Attributes,
+		})
+		err = writePacket(&rpc.Header{
+			ServiceId: proto.Uint32(1),
+			MethodId:  proto.Uint32(1),
+			Token:     proto.Uint32(uint32(i)),
+		}, req)
+		if err != nil {
+			return err
+		}
+	}
+
+	timeout := time.After(5 * time.Second)
+	for i := 0; i < numRequests; i++ {
+		select {
+		case header := <-responses:
+			body := <-responseBodies
+			res := &game_utilities_service.ClientResponse{}
+			if err := proto.Unmarshal(body, res); err != nil {
+				return err
+			}
+			// Responses must be matched with their own requests.
+			m := (&Notification{Attributes: res.Attribute}).Map()
+			if m["token"] != uint64(header.GetToken()) || m["id"] != id {
+				return fmt.Errorf("client %d: response %d has attributes %v",
+					id, header.GetToken(), m)
+			}
+		case <-timeout:
+			return fmt.Errorf("client %d: timed out after %d responses", id, i)
+		}
+	}
+	for notes, done := 0, 0; notes < numRequests || done < numRequests; {
+		select {
+		case <-notified:
+			notes++
+		case err := <-calls:
+			if err != nil {
+				return fmt.Errorf("client %d: Call: %v", id, err)
+			}
+			done++
+		case <-timeout:
+			return fmt.Errorf("client %d: timed out after %d notifications and %d calls",
+				id, notes, done)
+		}
 	}
+	return nil
 }
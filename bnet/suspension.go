@@ -0,0 +1,155 @@
+package bnet
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// How often the server looks for online accounts which have been suspended,
+// such as by a moderator running stove -suspend.
+const suspensionSweepInterval = 15 * time.Second
+
+// A Suspension keeps an account from logging on until it expires or is lifted.
+type Suspension struct {
+	ID        int64
+	AccountID uint64
+	Reason    string
+	CreatedAt time.Time
+	// Zero for a permanent ban.
+	Expires time.Time
+	// Set when a moderator lifts the suspension early.
+	LiftedAt time.Time
+}
+
+// Active returns whether the suspension is in force at the given time.
+func (s *Suspension) Active(now time.Time) bool {
+	return s.LiftedAt.IsZero() && (s.Expires.IsZero() || now.Before(s.Expires))
+}
+
+// errorCode returns the error code clients of the suspended account get.
+func (s *Suspension) errorCode() uint32 {
+	if s.Expires.IsZero() {
+		return ErrorGameAccountBanned
+	}
+	return ErrorGameAccountSuspended
+}
+
+func (s *Suspension) String() string {
+	until := "permanently"
+	if !s.Expires.IsZero() {
+		until = "until " + s.Expires.Format(time.RFC1123)
+	}
+	return fmt.Sprintf("account %d suspended %s: %s", s.AccountID, until, s.Reason)
+}
+
+// activeSuspension returns the suspension in force on an account, preferring a
+// permanent ban, then whichever lasts longest.  It returns nil if the account
+// isn't suspended.
+func activeSuspension(accountID uint64, now time.Time) *Suspension {
+	suspensions := []Suspension{}
+	db.Where("account_id = ?", accountID).Find(&suspensions)
+	var res *Suspension
+	for i := range suspensions {
+		s := &suspensions[i]
+		if !s.Active(now) {
+			continue
+		}
+		if res == nil || s.Expires.IsZero() ||
+			(!res.Expires.IsZero() && s.Expires.After(res.Expires)) {
+			res = s
+		}
+	}
+	return res
+}
+
+// Suspend suspends the account with the given email for a duration, or bans it
+// if the duration is 0.  An online session of the account is disconnected by
+// the server within suspensionSweepInterval.
+func Suspend(email, reason string, duration time.Duration) (*Suspension, error) {
+	account, err := accountByEmail(email)
+	if err != nil {
+		return nil, fmt.Errorf("no account with email %s", email)
+	}
+	now := time.Now()
+	suspension := &Suspension{
+		AccountID: account.ID,
+		Reason:    reason,
+		CreatedAt: now,
+	}
+	if duration != 0 {
+		suspension.Expires = now.Add(duration)
+	}
+	db.Create(suspension)
+	return suspension, nil
+}
+
+// Unban lifts every suspension in force on the account with the given email,
+// and returns how many there were.
+func Unban(email string) (int, error) {
+	account, err := accountByEmail(email)
+	if err != nil {
+		return 0, fmt.Errorf("no account with email %s", email)
+	}
+	suspensions := []Suspension{}
+	db.Where("account_id = ?", account.ID).Find(&suspensions)
+	now := time.Now()
+	lifted := 0
+	for _, s := range suspensions {
+		if !s.Active(now) {
+			continue
+		}
+		s.LiftedAt = now
+		db.Save(&s)
+		lifted++
+	}
+	return lifted, nil
+}
+
+// ActiveSuspensions returns every suspension in force, oldest first.
+func ActiveSuspensions() []Suspension {
+	suspensions := []Suspension{}
+	db.Order("id").Find(&suspensions)
+	now := time.Now()
+	res := []Suspension{}
+	for _, s := range suspensions {
+		if s.Active(now) {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// sweepSuspensions periodically disconnects online sessions of suspended
+// accounts, until stop is closed.
+func (s *Server) sweepSuspensions(stop <-chan struct{}) {
+	ticker := time.NewTicker(suspensionSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.disconnectSuspended(ActiveSuspensions())
+		case <-stop:
+			return
+		}
+	}
+}
+
+// disconnectSuspended force-disconnects the online sessions of the suspended
+// accounts.
+func (s *Server) disconnectSuspended(suspensions []Suspension) {
+	for i := range suspensions {
+		suspension := &suspensions[i]
+		sess := s.SessionForAccount(suspension.AccountID)
+		// Sessions an earlier sweep disconnected are still on their way out.
+		if sess == nil || sess.isDisconnecting() {
+			continue
+		}
+		log.Printf("disconnecting suspended %s", suspension)
+		// Let the client see why before it goes.
+		s.NotifyAccountUpdated(suspension.AccountID)
+		// The client should hang up, but don't leave it logged on if it
+		// doesn't.
+		sess.kick(suspension.errorCode(), suspension.Reason, suspensionSweepInterval)
+	}
+}
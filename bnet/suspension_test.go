@@ -0,0 +1,56 @@
+package bnet
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSuspensionActive(t *testing.T) {
+	now := time.Now()
+	for i, x := range []struct {
+		Suspension Suspension
+		Active     bool
+		Code       uint32
+	}{
+		{Suspension{}, true, ErrorGameAccountBanned},
+		{Suspension{Expires: now.Add(time.Hour)}, true, ErrorGameAccountSuspended},
+		{Suspension{Expires: now}, false, ErrorGameAccountSuspended},
+		{Suspension{LiftedAt: now}, false, ErrorGameAccountBanned},
+	} {
+		if active := x.Suspension.Active(now); active != x.Active {
+			t.Errorf("case %d: expected active=%v, got %v", i, x.Active, active)
+		}
+		if code := x.Suspension.errorCode(); code != x.Code {
+			t.Errorf("case %d: expected error code %d, got %d", i, x.Code, code)
+		}
+	}
+}
+
+func TestDisconnectSuspended(t *testing.T) {
+	serv := NewServer()
+	client, conn := net.Pipe()
+	sess := NewSession(serv, conn)
+	defer sess.Disconnect()
+	sess.account.ID = 1
+	serv.sessions.add(sess)
+	codec := NewPacketCodec(client, client)
+
+	suspensions := []Suspension{{AccountID: 1, Reason: "cheating"}}
+	serv.disconnectSuspended(suspensions)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	header, _, err := codec.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.GetServiceId() != 0 || header.GetMethodId() != 4 {
+		t.Fatalf("expected ForceDisconnect, got %s", header.String())
+	}
+
+	// Later sweeps leave the session alone while it's on its way out.
+	serv.disconnectSuspended(suspensions)
+	client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if header, _, err := codec.ReadPacket(); err == nil {
+		t.Errorf("disconnected the session again: %s", header.String())
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/HearthSim/hs-proto-go/bnet/rpc"
 	"github.com/golang/protobuf/proto"
 	"hash/fnv"
+	"time"
 )
 
 // EntityId creates a 128-bit entity id from its high and low qwords.
@@ -22,6 +23,39 @@ func Hash(s string) uint32 {
 	return h.Sum32()
 }
 
+// FourCC packs a four character code such as "WTCG" into an integer, as
+// programs are identified in the protocol.
+func FourCC(s string) uint32 {
+	res := uint32(0)
+	for i := 0; i < len(s) && i < 4; i++ {
+		res = res<<8 | uint32(s[i])
+	}
+	return res
+}
+
+// FourCCString unpacks a four character code packed by FourCC.
+func FourCCString(fourcc uint32) string {
+	res := []byte{}
+	for shift := uint(24); ; shift -= 8 {
+		if c := byte(fourcc >> shift); c != 0 {
+			res = append(res, c)
+		}
+		if shift == 0 {
+			break
+		}
+	}
+	return string(res)
+}
+
+// Timestamp returns the time in microseconds since the Unix epoch, as times
+// are sent in the protocol.  The zero time is 0.
+func Timestamp(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
+	}
+	return uint64(t.UnixNano() / int64(time.Microsecond))
+}
+
 // MakePacket returns a buffer with the encoded values of the supplied header
 // and body.
 func MakePacket(header *rpc.Header, buf []byte) ([]byte, error) {
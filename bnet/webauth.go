@@ -0,0 +1,107 @@
+package bnet
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// DefaultWebCredentialLifetime is how long a WebCredential issued by the login
+// page may be used to log on.
+const DefaultWebCredentialLifetime = 5 * time.Minute
+
+// A WebAuthServer hosts the login page which clients are sent to by the
+// external challenge.  It checks email and password, and issues short-lived
+// WebCredentials which the client then logs on with.
+//
+// It is also the server's Authenticator: issued WebCredentials are accepted
+// once before they expire, and any other credentials are passed on to the
+// authenticator it wraps.
+type WebAuthServer struct {
+	// Checks the email and password posted to the login page.
+	passwords Authenticator
+	// Checks credentials which weren't issued by the login page.
+	next        Authenticator
+	credentials *credentialStore
+}
+
+// LoginPagePasswords returns what the login page checks passwords with, for the
+// authenticator backend named in the config.  The token backend doesn't know
+// about passwords, so the hashes stored with SetPassword are checked instead.
+func LoginPagePasswords(backend string, auth Authenticator) Authenticator {
+	if backend == "htpasswd" {
+		return auth
+	}
+	return BcryptAuthenticator{}
+}
+
+func NewWebAuthServer(passwords, next Authenticator, lifetime time.Duration) *WebAuthServer {
+	return &WebAuthServer{
+		passwords:   passwords,
+		next:        next,
+		credentials: newCredentialStore(lifetime),
+	}
+}
+
+func (s *WebAuthServer) Authenticate(email string, credentials []byte) (*Account, error) {
+	if cred, ok := s.credentials.redeem(email, credentials); ok {
+		return &cred.account, nil
+	}
+	if s.next == nil {
+		return nil, errNoAuth
+	}
+	return s.next.Authenticate(email, credentials)
+}
+
+// issue checks an email and password, and returns a new WebCredential for the
+// account.
+func (s *WebAuthServer) issue(email, password string) (string, error) {
+	account, err := s.passwords.Authenticate(email, []byte(password))
+	if err != nil {
+		return "", err
+	}
+	return s.credentials.issue(*account, 0)
+}
+
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head><title>stove login</title></head>
+<body>
+<form method="post">
+{{if .}}<p>{{.}}</p>{{end}}
+<p><label>Email <input type="email" name="email" autofocus></label></p>
+<p><label>Password <input type="password" name="password"></label></p>
+<p><input type="submit" value="Log In"></p>
+</form>
+</body>
+</html>
+`))
+
+// ServeHTTP shows the login page, and on a successful login redirects to the
+// URL the client watches for, which carries the WebCredential as its ST
+// parameter.
+func (s *WebAuthServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method != "POST" {
+		loginPage.Execute(w, "")
+		return
+	}
+	email := r.PostFormValue("email")
+	token, err := s.issue(email, r.PostFormValue("password"))
+	if err != nil {
+		log.Printf("web login failed for %s: %v", email, err)
+		w.WriteHeader(http.StatusUnauthorized)
+		loginPage.Execute(w, "Incorrect email or password.")
+		return
+	}
+	log.Printf("issued web credential to %s", email)
+	http.Redirect(w, r, "http://localhost:0/?ST="+url.QueryEscape(token), http.StatusFound)
+}
+
+// SetWebAuthURL sets the login page which clients are sent to by the external
+// challenge.
+func (s *Server) SetWebAuthURL(webAuthURL string) {
+	s.webAuthURL = webAuthURL
+}
@@ -0,0 +1,113 @@
+package bnet
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// staticPasswords accepts a single email and password.
+type staticPasswords struct {
+	account  Account
+	password string
+}
+
+func (p staticPasswords) Authenticate(email string, credentials []byte) (*Account, error) {
+	if email != p.account.Email || string(credentials) != p.password {
+		return nil, errNoAuth
+	}
+	return &p.account, nil
+}
+
+func TestWebAuth(t *testing.T) {
+	passwords := staticPasswords{Account{ID: 7, Email: "player@example.com"}, "hunter2"}
+	s := NewWebAuthServer(passwords, nil, time.Minute)
+	now := time.Now()
+	s.credentials.now = func() time.Time { return now }
+	login := func(email, password string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/", strings.NewReader(url.Values{
+			"email":    {email},
+			"password": {password},
+		}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		s.ServeHTTP(w, r)
+		return w
+	}
+	credential := func(w *httptest.ResponseRecorder) string {
+		loc, err := url.Parse(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return loc.Query().Get("ST")
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "password") {
+		t.Errorf("GET: expected the login form, got %d", w.Code)
+	}
+	if w = login("player@example.com", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("bad password: expected 401, got %d", w.Code)
+	}
+
+	w = login("player@example.com", "hunter2")
+	if w.Code != http.StatusFound {
+		t.Fatalf("login: expected a redirect, got %d", w.Code)
+	}
+	token := credential(w)
+	if _, err := s.Authenticate("other@example.com", []byte(token)); ErrorCode(err) != ErrorNoAuth {
+		t.Errorf("credential accepted for another email: %v", err)
+	}
+	// Credentials are only accepted once, so the failed attempt used it up.
+	token = credential(login("player@example.com", "hunter2"))
+	account, err := s.Authenticate("player@example.com", []byte(token))
+	if err != nil || account.ID != 7 {
+		t.Errorf("credential rejected: %v", err)
+	}
+	if _, err = s.Authenticate("player@example.com", []byte(token)); ErrorCode(err) != ErrorNoAuth {
+		t.Errorf("credential accepted twice: %v", err)
+	}
+
+	// Stale credentials expire, and are swept when new ones are issued.
+	token = credential(login("player@example.com", "hunter2"))
+	now = now.Add(2 * time.Minute)
+	if _, err = s.Authenticate("player@example.com", []byte(token)); ErrorCode(err) != ErrorNoAuth {
+		t.Errorf("expired credential accepted: %v", err)
+	}
+	credential(login("player@example.com", "hunter2"))
+	now = now.Add(2 * time.Minute)
+	credential(login("player@example.com", "hunter2"))
+	if n := len(s.credentials.issued); n != 1 {
+		t.Errorf("expected stale credentials to be swept, %d left", n)
+	}
+}
+
+func TestLoginPagePasswords(t *testing.T) {
+	// With the default token backend, the login page checks the passwords set
+	// with SetPassword, and clients log on with the credentials it issues or
+	// with their account's token.
+	auth, err := NewAuthenticator("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewWebAuthServer(LoginPagePasswords("", auth), auth, time.Minute)
+	if _, ok := s.passwords.(BcryptAuthenticator); !ok {
+		t.Errorf("default login page checks passwords with %T", s.passwords)
+	}
+	if _, ok := s.next.(TokenAuthenticator); !ok {
+		t.Errorf("default logons fall back to %T", s.next)
+	}
+	for _, backend := range []string{"token", "bcrypt"} {
+		if _, ok := LoginPagePasswords(backend, auth).(BcryptAuthenticator); !ok {
+			t.Errorf("%s: login page doesn't check bcrypt hashes", backend)
+		}
+	}
+	htpasswd := &HtpasswdAuthenticator{}
+	if LoginPagePasswords("htpasswd", htpasswd) != htpasswd {
+		t.Errorf("htpasswd: login page doesn't check the password file")
+	}
+}
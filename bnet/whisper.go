@@ -0,0 +1,122 @@
+package bnet
+
+import (
+	"github.com/HearthSim/hs-proto-go/bnet/attribute"
+	"github.com/HearthSim/hs-proto-go/bnet/entity"
+	"github.com/HearthSim/hs-proto-go/bnet/notification_service"
+	"github.com/golang/protobuf/proto"
+	"time"
+)
+
+// Each client may send at most maxWhispers whispers per whisperInterval.
+const (
+	maxWhispers     = 10
+	whisperInterval = 10 * time.Second
+)
+
+// The text of the whisper sent back when the target isn't online.
+const whisperOfflineText = "Player not online."
+
+// whisper delivers a whisper from the client to a friend.  Whispers to a friend
+// who isn't online are answered with a whisper from them saying so.  It must
+// be called on the event loop.
+func (s *Session) whisper(n *notification_service.Notification) error {
+	if s.State() != StateReady {
+		return Errorf(ErrorNoAuth, "whisper: not logged on")
+	}
+	now := time.Now()
+	if now.Sub(s.whisperWindow) >= whisperInterval {
+		s.whisperWindow = now
+		s.whispersSent = 0
+	}
+	if s.whispersSent >= maxWhispers {
+		return Errorf(ErrorRPCQuotaExceeded, "whisper: %d sent too many whispers", s.account.ID)
+	}
+	s.whispersSent++
+
+	targetAccountID := accountIDForEntity(n.GetTargetId())
+	if targetAccountID == 0 || !areFriends(s.account.ID, targetAccountID) {
+		return Errorf(ErrorFriendsFriendshipDoesNotExist, "whisper: %d isn't friends with %s",
+			s.account.ID, n.GetTargetId().String())
+	}
+	sender := s.identity()
+	res := &notification_service.Notification{
+		Type:            proto.String(NotifyWhisper),
+		SenderId:        sender.GameAccountId,
+		SenderAccountId: sender.AccountId,
+		SenderBattleTag: proto.String(s.account.BattleTag),
+		TargetId:        n.TargetId,
+		TargetAccountId: EntityId(BnetAccountEntityIDHi, targetAccountID),
+		Attribute:       n.Attribute,
+	}
+	if s.server.deliverNotification(res) {
+		return nil
+	}
+
+	target := accountByID(targetAccountID)
+	reply := &notification_service.Notification{
+		Type:            proto.String(NotifyWhisper),
+		SenderId:        n.TargetId,
+		SenderAccountId: res.TargetAccountId,
+		SenderBattleTag: proto.String(target.BattleTag),
+		TargetId:        sender.GameAccountId,
+		TargetAccountId: sender.AccountId,
+		Attribute: []*attribute.Attribute{{
+			Name:  proto.String("whisper"),
+			Value: &attribute.Variant{StringValue: proto.String(whisperOfflineText)},
+		}},
+	}
+	s.Post(func() {
+		s.notify(reply)
+	})
+	return nil
+}
+
+// accountIDForEntity returns the id of the bnet account an account or game
+// account entity belongs to, or 0 if there's no such account.
+func accountIDForEntity(id *entity.EntityId) uint64 {
+	switch id.GetHigh() {
+	case BnetAccountEntityIDHi:
+		if accountByID(id.GetLow()) == nil {
+			return 0
+		}
+		return id.GetLow()
+	case BnetGameAccountEntityIDHi:
+		return accountIDForGameAccount(int64(id.GetLow()))
+	}
+	return 0
+}
+
+// sessionForEntity returns the session of an online account or game account.
+func (s *Server) sessionForEntity(id *entity.EntityId) *Session {
+	switch id.GetHigh() {
+	case BnetAccountEntityIDHi:
+		return s.SessionForAccount(id.GetLow())
+	case BnetGameAccountEntityIDHi:
+		return s.SessionForGameAccount(id.GetLow())
+	}
+	return nil
+}
+
+// deliverNotification sends a notification to the client of its target, and
+// returns false if the target isn't online.
+func (s *Server) deliverNotification(n *notification_service.Notification) bool {
+	target := s.sessionForEntity(n.GetTargetId())
+	if target == nil {
+		return false
+	}
+	target.Post(func() {
+		target.notify(n)
+	})
+	return true
+}
+
+// notify sends a notification to the client if it listens for them.  It must
+// be called on the event loop.
+func (s *Session) notify(n *notification_service.Notification) {
+	listener := s.ImportedService("bnet.protocol.notification.NotificationListener")
+	if listener == nil {
+		return
+	}
+	listener.(*NotificationListenerService).Notify(n)
+}
@@ -0,0 +1,165 @@
+package bnet
+
+import (
+	"github.com/HearthSim/hs-proto-go/bnet/connection_service"
+	"github.com/HearthSim/hs-proto-go/bnet/notification_service"
+	"github.com/HearthSim/hs-proto-go/bnet/rpc"
+	"github.com/golang/protobuf/proto"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWhisperRateLimit(t *testing.T) {
+	serv := NewServer()
+	_, conn := net.Pipe()
+	sess := NewSession(serv, conn)
+	defer sess.Disconnect()
+	sess.account.ID = 1
+	sess.state = StateReady
+
+	n := &notification_service.Notification{
+		Type:     proto.String(NotifyWhisper),
+		TargetId: EntityId(BnetGameAccountEntityIDHi, 102),
+	}
+	for i := 0; i < maxWhispers; i++ {
+		if err := sess.whisper(n); ErrorCode(err) == ErrorRPCQuotaExceeded {
+			t.Fatalf("whisper %d was rate limited", i)
+		}
+	}
+	if err := sess.whisper(n); ErrorCode(err) != ErrorRPCQuotaExceeded {
+		t.Errorf("expected the whisper to be rate limited, got %v", err)
+	}
+	sess.whisperWindow = sess.whisperWindow.Add(-whisperInterval)
+	if err := sess.whisper(n); ErrorCode(err) == ErrorRPCQuotaExceeded {
+		t.Errorf("whisper was rate limited in a new window")
+	}
+}
+
+func TestRouteNotification(t *testing.T) {
+	serv := NewServer()
+	client, conn := net.Pipe()
+	target := NewSession(serv, conn)
+	go serv.serveSession(target)
+	defer target.Disconnect()
+	_, conn = net.Pipe()
+	sender := NewSession(serv, conn)
+	defer sender.Disconnect()
+
+	codec := NewPacketCodec(client, client)
+	connect, _ := proto.Marshal(&connection_service.ConnectRequest{
+		BindRequest: &connection_service.BindRequest{
+			ExportedService: []*connection_service.BoundService{{
+				Hash: proto.Uint32(Hash("bnet.protocol.notification.NotificationListener")),
+				Id:   proto.Uint32(1),
+			}},
+		},
+	})
+	err := codec.WritePacket(&rpc.Header{
+		ServiceId: proto.Uint32(0),
+		MethodId:  proto.Uint32(1),
+		Token:     proto.Uint32(0),
+	}, connect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = codec.ReadPacket(); err != nil {
+		t.Fatal(err)
+	}
+	target.account.ID = 2
+	target.gameAccountID = 102
+	serv.sessions.add(target)
+	sender.account.ID = 1
+
+	// Notifications for another game account go to its client rather than
+	// back to the session they came from.
+	sender.handleNotification(NewNotification(NotifySpectatorInvite, map[string]interface{}{
+		"forwardToClient": true,
+		"targetId":        *EntityId(BnetGameAccountEntityIDHi, 102),
+		"senderId":        *EntityId(BnetGameAccountEntityIDHi, 101),
+	}))
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header, body, err := codec.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.GetServiceId() != 1 || header.GetMethodId() != 1 {
+		t.Fatalf("expected OnNotificationReceived, got %s", header.String())
+	}
+	n := notification_service.Notification{}
+	err = proto.Unmarshal(body, &n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.GetType() != NotifySpectatorInvite || n.GetSenderId().GetLow() != 101 {
+		t.Errorf("unexpected notification %s", n.String())
+	}
+}
+
+func TestWhisperFriendsOnly(t *testing.T) {
+	serv := NewServer()
+	_, conn := net.Pipe()
+	sess := NewSession(serv, conn)
+	defer sess.Disconnect()
+	sess.account = *newFriendsAccount(t, "Whisperer")
+	sess.state = StateReady
+	stranger := newFriendsAccount(t, "Stranger")
+
+	err := sess.whisper(&notification_service.Notification{
+		Type:     proto.String(NotifyWhisper),
+		TargetId: EntityId(BnetAccountEntityIDHi, stranger.ID),
+	})
+	if ErrorCode(err) != ErrorFriendsFriendshipDoesNotExist {
+		t.Errorf("expected ErrorFriendsFriendshipDoesNotExist whispering a stranger, got %v", err)
+	}
+}
+
+func TestWhisperOffline(t *testing.T) {
+	serv := NewServer()
+	sender, codec := connectClient(t, serv, "bnet.protocol.notification.NotificationListener")
+	defer sender.Disconnect()
+	account := newFriendsAccount(t, "Talker")
+	offline := newFriendsAccount(t, "Sleeper")
+	makeFriends(t, account, offline)
+	for _, state := range []int{StateLoggingIn, StateReady} {
+		if err := sender.Transition(state); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var err error
+	sender.PostWait(func() {
+		sender.account = *account
+		err = sender.whisper(&notification_service.Notification{
+			Type:     proto.String(NotifyWhisper),
+			TargetId: EntityId(BnetAccountEntityIDHi, offline.ID),
+			Attribute: NewNotification("", map[string]interface{}{
+				"whisper": "hello?",
+			}).Attributes,
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The friend answers that they're not online.
+	header, body, err := codec.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.GetServiceId() != 1 || header.GetMethodId() != 1 {
+		t.Fatalf("expected OnNotificationReceived, got %s", header.String())
+	}
+	n := notification_service.Notification{}
+	if err = proto.Unmarshal(body, &n); err != nil {
+		t.Fatal(err)
+	}
+	if n.GetType() != NotifyWhisper || n.GetSenderAccountId().GetLow() != offline.ID ||
+		n.GetSenderBattleTag() != offline.BattleTag || n.GetTargetAccountId().GetLow() != account.ID {
+		t.Errorf("unexpected reply %s", n.String())
+	}
+	if len(n.Attribute) != 1 || n.Attribute[0].GetValue().GetStringValue() != whisperOfflineText {
+		t.Errorf("expected the reply %q, got %v", whisperOfflineText, n.Attribute)
+	}
+}
@@ -46,4 +46,16 @@ echo "Initializing database"
 echo "Creating default user"
 "$BASEDIR/scripts/create_default_user.py" "$PEGASUS_DB" "$BNET_DB"
 
+if [ -z "$STOVE_PASSWORD" ] && [ -t 0 ]; then
+	echo "Setting the login page password of test@hearthsim.info"
+	read -s -p "Password: " STOVE_PASSWORD
+	echo
+fi
+if [ -n "$STOVE_PASSWORD" ]; then
+	echo "$STOVE_PASSWORD" | go run "$BASEDIR/stove.go" -setpassword test@hearthsim.info
+else
+	echo >&2 "STOVE_PASSWORD is not set, so test@hearthsim.info has no login page password."
+	echo >&2 "Set one later with: go run stove.go -setpassword test@hearthsim.info"
+fi
+
 echo "Done."
@@ -0,0 +1,71 @@
+// Command gamehost runs Hearthstone games for a stove server in a process of
+// its own.  It registers with stove as a game host, giving the -password flag,
+// which must match Bnet.GameHostPassword in stove's configuration, and
+// reconnects whenever the link is lost.  When stopped, it unregisters and
+// waits a while for its games to end.
+package main
+
+import (
+	"context"
+	"flag"
+	"github.com/HearthSim/stove/pegasus/game"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// How long to wait before linking up with stove again.
+const relinkDelay = 5 * time.Second
+
+// How long games get to end when the host is stopped.
+const shutdownTimeout = time.Minute
+
+func main() {
+	listenAddr := flag.String("bind", ":1120",
+		"Address on which players connect to games")
+	advertisedAddr := flag.String("advertise", "",
+		"Host name or IP address players are sent to, if not the host of -bind")
+	stoveAddr := flag.String("stove", "localhost:1119",
+		"Address of the stove server to register with")
+	password := flag.String("password", "",
+		"Game host password of the stove server")
+	program := flag.String("program", "WTCG",
+		"FourCC of the program whose games are run")
+	flag.Parse()
+	if len(*password) == 0 {
+		log.Fatalln("a -password is needed to register with stove")
+	}
+
+	host, err := game.NewHost(*listenAddr, *advertisedAddr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	go func() {
+		for {
+			err := host.Link(*stoveAddr, *program, *password)
+			if err == game.ErrUnregistered {
+				return
+			}
+			log.Printf("lost the link to %s: %v", *stoveAddr, err)
+			time.Sleep(relinkDelay)
+		}
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	log.Println("Shutting down ...")
+	// Stop stove from sending new games before waiting for the running ones.
+	err = host.Unregister()
+	if err != nil {
+		log.Println(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err = host.Shutdown(ctx)
+	if err != nil {
+		log.Println(err)
+	}
+}
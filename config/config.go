@@ -8,6 +8,7 @@ import (
 	"log"
 	"os"
 	path "path/filepath"
+	"time"
 )
 
 type Stove struct {
@@ -16,13 +17,35 @@ type Stove struct {
 	LogFile            string
 	DebugListenAddress string
 
+	// Moderation commands, which act on the bnet db and exit
+	Suspend         string
+	SuspendReason   string
+	SuspendDuration time.Duration
+	Unban           string
+	ListSuspensions bool
+	// Sets the password of the account with this email, read from stdin
+	SetPassword string
+
 	Bnet struct {
 		Database DB
+		Auth     Auth
+		WebAuth  WebAuth
+		// Name of the stream cipher used for encrypted sessions
+		Cipher string
+		// Size limits, in bytes, for packets received from clients
+		MaxHeaderSize int
+		MaxBodySize   int
+		// Number of players who may be logged on at once; 0 for no limit
+		MaxPlayers int
+		// Password game hosts register with; empty to only run games
+		// in-process
+		GameHostPassword string
 	}
 
 	Pegasus struct {
 		Database      DB
 		Matchmaking   Server
+		GameHost      GameHost
 		ListenAddress string
 	}
 }
@@ -32,10 +55,36 @@ type DB struct {
 	DataSource string
 }
 
+type Auth struct {
+	// One of "token", "bcrypt" or "htpasswd"
+	Backend string
+	// htpasswd file of email:bcrypt hash lines
+	PasswordFile string
+}
+
+type WebAuth struct {
+	// Address on which the login page is served; empty to disable it
+	ListenAddress string
+	// URL of the login page sent to clients, if not http://ListenAddress/
+	URL string
+	// Seconds for which an issued WebCredential may be used to log on
+	CredentialLifetime int
+}
+
 type Server struct {
 	Address string
 }
 
+type GameHost struct {
+	// Address on which the in-process game host accepts players
+	ListenAddress string
+	// Host name or IP address players are sent to, if not the host of
+	// ListenAddress
+	AdvertisedAddress string
+	// If true, games only run on game hosts in other processes
+	RemoteOnly bool
+}
+
 var Config = &Stove{}
 
 func init() {
@@ -49,6 +98,18 @@ func init() {
 		"Location of the server log file")
 	flag.StringVar(&Config.DebugListenAddress, "debugbind", "",
 		"Address on which the debug HTTP server will listen")
+	flag.StringVar(&Config.Suspend, "suspend", "",
+		"Suspend the account with this email and exit")
+	flag.StringVar(&Config.SuspendReason, "reason", "",
+		"Reason given for -suspend")
+	flag.DurationVar(&Config.SuspendDuration, "duration", 0,
+		"How long -suspend lasts, e.g. 72h; 0 bans the account")
+	flag.StringVar(&Config.Unban, "unban", "",
+		"Lift the suspensions of the account with this email and exit")
+	flag.BoolVar(&Config.ListSuspensions, "suspensions", false,
+		"List the suspensions in force and exit")
+	flag.StringVar(&Config.SetPassword, "setpassword", "",
+		"Set the password of the account with this email, read from stdin, and exit")
 	flag.Parse()
 	configPath := *configPathVar
 	cwd, err := os.Getwd()
@@ -92,6 +153,9 @@ func init() {
 	configDir := path.Dir(configPath)
 	makeAbsPath(configDir, &Config.LogFile)
 	makeAbsPath(configDir, &Config.Bnet.Database.DataSource)
+	if len(Config.Bnet.Auth.PasswordFile) != 0 {
+		makeAbsPath(configDir, &Config.Bnet.Auth.PasswordFile)
+	}
 	makeAbsPath(configDir, &Config.Pegasus.Database.DataSource)
 
 	if len(Config.LogFile) != 0 {
@@ -5,13 +5,66 @@ import (
 	"github.com/HearthSim/hs-proto-go/pegasus/util"
 	"github.com/golang/protobuf/proto"
 	"log"
+	"strings"
 	"time"
 )
 
+// The gold and dust new accounts start out with.
+const (
+	startingGold = 2000
+	startingDust = 100000
+)
+
+// newAccount creates the pegasus account of a game account which hasn't played
+// before.  Like the default user made by scripts/create_default_user.py, it
+// has every achievement completed and the basic heroes as favorites.
+func newAccount(id, bnetID int64) Account {
+	now := time.Now()
+	res := Account{
+		ID:        id,
+		BnetID:    bnetID,
+		Gold:      startingGold,
+		Dust:      startingDust,
+		UpdatedAt: now,
+	}
+	db.Create(&res)
+
+	dbfAchieves := []DbfAchieve{}
+	db.Find(&dbfAchieves)
+	for _, dbfAchieve := range dbfAchieves {
+		db.Create(&Achieve{
+			AccountID:       id,
+			AchieveID:       dbfAchieve.ID,
+			Progress:        1,
+			AckProgress:     1,
+			CompletionCount: 1,
+			DateGiven:       now,
+			DateCompleted:   now,
+		})
+	}
+
+	heroes := []DbfCard{}
+	db.Joins("join dbf_hero on dbf_card.note_mini_guid = dbf_hero.card_id").
+		Where("not dbf_hero.store_bought").
+		Find(&heroes)
+	for _, hero := range heroes {
+		db.Create(&FavoriteHero{
+			AccountID: id,
+			ClassID:   hero.ClassID,
+			CardID:    hero.ID,
+		})
+	}
+	return res
+}
+
 func (v *Account) Init(sess *Session) {
-	// TODO: fetch the account using the bnet session
-	db.Find(v)
-	v.displayName = "FIXME"
+	// The pegasus account shares its id with the bnet game account, and is
+	// created the first time the game account plays.
+	id := int64(sess.host.GameAccountID())
+	if db.Where("id = ?", id).First(v).RecordNotFound() {
+		*v = newAccount(id, int64(sess.host.AccountID()))
+	}
+	v.displayName = strings.SplitN(sess.host.BattleTag(), "#", 2)[0]
 
 	sess.RegisterPacket(util.GetAccountInfo_ID, OnGetAccountInfo)
 	sess.RegisterPacket(util.UpdateLogin_ID, OnUpdateLogin)
@@ -49,6 +49,23 @@ type PlayerInfo struct {
 	Premium       []bool
 }
 
+// Reasons a game ended, which hosts report to stove.
+const (
+	// A player won, or the players drew.
+	EndComplete uint32 = iota
+	// The host closed the game before it was complete, such as when it
+	// was shut down.
+	EndClosed
+	// The game failed.
+	EndError
+)
+
+// The STATE tag of the game entity, and its value once the game is over.
+const (
+	tagState      = 204
+	stateComplete = 3
+)
+
 // A game account id that signals the player is an AI.
 // For some reason AIs don't have 'WTCG' in their GameAccountID
 var AIGameAccountID = bnet.EntityId(0x200007A00000000, 0)
@@ -71,6 +88,11 @@ type Game struct {
 	server  *server
 	kettle  *KettleClient
 
+	// Whether the game was played to the end, and why it ended once quit
+	// is closed.  Protected by mutex.
+	complete  bool
+	endReason uint32
+
 	// all game state is protected by mutex
 	history             []*game.PowerHistoryData
 	currentPlayer       int
@@ -92,9 +114,15 @@ type GamePlayer struct {
 	histIndex int
 }
 
+// IsAI returns whether the player is played by the AI rather than a client.
+func (p *GamePlayer) IsAI() bool {
+	return p.GameAccountId.GetLo() == 0
+}
+
 type GameResult struct{}
 
-func CreateGame(params *GameStartInfo) *Game {
+// createGame starts a game on the server, unless it's shutting down.
+func (s *server) createGame(params *GameStartInfo) (*Game, error) {
 	res := &Game{}
 	mrand.Seed(time.Now().UnixNano())
 	res.Players = make([]*GamePlayer, 2)
@@ -110,17 +138,21 @@ func CreateGame(params *GameStartInfo) *Game {
 	res.GameHandle = mrand.Int31()
 	res.GameId = fmt.Sprintf("Test %d", res.GameHandle)
 	res.SpectatorPassword = GenPassword()
-	res.server = gameServer
+	res.quit = make(chan struct{})
+	res.server = s
 	res.Address = *(res.server.sock.Addr().(*net.TCPAddr))
-	res.server.gameHandles[res.GameHandle] = res
+	err := res.server.addGame(res)
+	if err != nil {
+		return nil, err
+	}
 	res.kettle = NewKettleClient(res)
 
-	return res
+	return res, nil
 }
 
 func (g *Game) OnTagChange(entity, tag, value int) {
 	// hack for making AI end turn
-	if entity == 3 {
+	if entity == 3 && g.Players[1].IsAI() {
 		// CURRENT_PLAYER => 1
 		if tag == 23 && value == 1 {
 			go func() {
@@ -133,6 +165,11 @@ func (g *Game) OnTagChange(entity, tag, value int) {
 		log.Printf("--- OnTagChange --- Set current player to %d", entity-1)
 		g.currentPlayer = entity - 1
 	}
+	if tag == tagState && value == stateComplete {
+		g.Lock()
+		g.complete = true
+		g.Unlock()
+	}
 }
 
 func (g *Game) OnEntityChoices(choices *game.EntityChoices) {
@@ -176,8 +213,8 @@ func (g *Game) OnHistory(histData []*game.PowerHistoryData) {
 		}
 		g.history = append(g.history, hist)
 	}
-	for i, client := range g.clients {
-		p := g.Players[i]
+	for _, client := range g.clients {
+		p := client.player
 		histUpdate := g.history[p.histIndex:]
 		histBuf, err := proto.Marshal(&game.PowerHistory{
 			List: histUpdate,
@@ -227,7 +264,14 @@ func (g *Game) PlayerFromHandle(clientHandle int64) *GamePlayer {
 	return nil
 }
 
+// Close ends the game, closing its clients' connections.
 func (g *Game) Close() {
+	g.close(EndClosed)
+}
+
+// close ends the game for a reason, unless it already ended.  Games which were
+// played to the end are complete whatever closed them.
+func (g *Game) close(reason uint32) {
 	for _, client := range g.clients {
 		client.Close()
 	}
@@ -239,15 +283,33 @@ func (g *Game) Close() {
 	select {
 	case <-g.quit:
 	default:
+		g.endReason = reason
+		if g.complete {
+			g.endReason = EndComplete
+		}
 		close(g.quit)
 	}
 }
 
+func (g *Game) isComplete() bool {
+	g.Lock()
+	defer g.Unlock()
+	return g.complete
+}
+
+// EndReason returns why the game ended.  It must only be called once the game
+// has ended.
+func (g *Game) EndReason() uint32 {
+	g.Lock()
+	defer g.Unlock()
+	return g.endReason
+}
+
 func (g *Game) CloseOnError() {
 	if err := recover(); err != nil {
 		log.Printf("game server error: %v\n=== STACK TRACE ===\n%s",
 			err, string(debug.Stack()))
-		g.Close()
+		g.close(EndError)
 	}
 }
 
@@ -0,0 +1,198 @@
+package game
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/HearthSim/hs-proto-go/bnet/attribute"
+	"github.com/HearthSim/hs-proto-go/bnet/game_master_types"
+	"github.com/HearthSim/hs-proto-go/bnet/server_pool_types"
+	"github.com/HearthSim/stove/bnet"
+	"github.com/golang/protobuf/proto"
+	"net"
+	"sync"
+)
+
+// Attributes which game hosts are sent, and answer with.
+const (
+	startInfoAttribute = "start_info"
+	gameInfoAttribute  = "game_info"
+)
+
+// GameInfo tells clients how to join a game a host created.
+type GameInfo struct {
+	Host              string
+	Port              int
+	GameHandle        int32
+	SpectatorPassword string
+	Players           []JoinInfo
+}
+
+// JoinInfo is what a player hands the game server to join as that player.
+type JoinInfo struct {
+	ClientHandle int64
+	Password     string
+}
+
+// StartInfoAttributes returns the attributes asking a game host to create a
+// game.
+func StartInfoAttributes(params *GameStartInfo) []*attribute.Attribute {
+	buf, err := json.Marshal(params)
+	if err != nil {
+		panic(err)
+	}
+	return bnet.NewNotification("", map[string]interface{}{
+		startInfoAttribute: buf,
+	}).Attributes
+}
+
+// ParseGameInfo reads the attributes a game host answered with.
+func ParseGameInfo(attrs []*attribute.Attribute) (*GameInfo, error) {
+	buf, ok := (&bnet.Notification{Attributes: attrs}).Map()[gameInfoAttribute].([]byte)
+	if !ok {
+		return nil, errors.New("game host didn't send game info")
+	}
+	res := &GameInfo{}
+	err := json.Unmarshal(buf, res)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// A Host runs games for stove.  Stove reaches it in-process through Local, or
+// over a bnet connection set up by Link.
+type Host struct {
+	server *server
+	// The address players are sent to join games.
+	address string
+
+	// mutex protects onGameEnded, link and unregistered.
+	mutex       sync.Mutex
+	onGameEnded func(handle int32, reason uint32)
+	// The connection Link registered the host over, while it lasts.
+	link *bnet.Client
+	// Set by Unregister.
+	unregistered bool
+}
+
+// NewHost starts a game host accepting players on listenAddr.  Players are
+// sent to advertisedAddr, the host name or IP address they reach it at, to join
+// games.  If it's empty, they're sent to the host listenAddr names, or to
+// 127.0.0.1 if it listens on every interface.
+func NewHost(listenAddr, advertisedAddr string) (*Host, error) {
+	res := &Host{}
+	host, _, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); len(host) == 0 || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	if len(advertisedAddr) != 0 {
+		host = advertisedAddr
+	}
+	res.address = host
+	res.server, err = newServer(listenAddr, res.gameEnded)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// OnGameEnded sets the function called with the handle of each game which
+// ends and the End reason it ended for, replacing the previous one.  It's
+// called on a goroutine of its own.
+func (h *Host) OnGameEnded(f func(handle int32, reason uint32)) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.onGameEnded = f
+}
+
+func (h *Host) gameEnded(g *Game) {
+	h.mutex.Lock()
+	f := h.onGameEnded
+	h.mutex.Unlock()
+	if f != nil {
+		f(g.GameHandle, g.EndReason())
+	}
+}
+
+// Load reports the games running on the host.
+func (h *Host) Load() *server_pool_types.ServerState {
+	games, players := h.server.load()
+	return &server_pool_types.ServerState{
+		GameCount:   proto.Int32(int32(games)),
+		PlayerCount: proto.Int32(int32(players)),
+	}
+}
+
+// CreateGame starts the game described by the attributes StartInfoAttributes
+// returned, and answers with the attributes ParseGameInfo reads.
+func (h *Host) CreateGame(attrs []*attribute.Attribute) ([]*attribute.Attribute, error) {
+	buf, ok := (&bnet.Notification{Attributes: attrs}).Map()[startInfoAttribute].([]byte)
+	if !ok {
+		return nil, errors.New("game host wasn't sent start info")
+	}
+	params := &GameStartInfo{}
+	err := json.Unmarshal(buf, params)
+	if err != nil {
+		return nil, err
+	}
+	if len(params.Players) != 2 {
+		return nil, errors.New("games need 2 players")
+	}
+	g, err := h.server.createGame(params)
+	if err != nil {
+		return nil, err
+	}
+	info := &GameInfo{
+		Host:              h.address,
+		Port:              g.Address.Port,
+		GameHandle:        g.GameHandle,
+		SpectatorPassword: g.SpectatorPassword,
+	}
+	for _, p := range g.Players {
+		info.Players = append(info.Players, JoinInfo{p.ClientHandle, p.Password})
+	}
+	buf, err = json.Marshal(info)
+	if err != nil {
+		panic(err)
+	}
+	return bnet.NewNotification("", map[string]interface{}{
+		gameInfoAttribute: buf,
+	}).Attributes, nil
+}
+
+// Shutdown waits for the running games to end, closing any which are still
+// running once ctx is done, and stops accepting players.
+func (h *Host) Shutdown(ctx context.Context) error {
+	return h.server.shutdown(ctx)
+}
+
+// Local returns the host as a bnet.GameHost, for stove to run games on in the
+// same process.
+func (h *Host) Local() bnet.GameHost {
+	return localHost{h}
+}
+
+// GameHandle returns the bnet handle of a game a program's host runs.
+func GameHandle(program string, handle int32) *game_master_types.GameHandle {
+	return &game_master_types.GameHandle{
+		FactoryId: proto.Uint64(uint64(bnet.FourCC(program))),
+		GameId:    bnet.EntityId(0, uint64(handle)),
+	}
+}
+
+// A localHost hands stove's requests straight to a Host.
+type localHost struct {
+	host *Host
+}
+
+func (h localHost) Load(ctx context.Context) (*server_pool_types.ServerState, error) {
+	return h.host.Load(), nil
+}
+
+func (h localHost) CreateGame(ctx context.Context, attrs []*attribute.Attribute) ([]*attribute.Attribute, error) {
+	return h.host.CreateGame(attrs)
+}
@@ -113,6 +113,10 @@ func (c *KettleClient) closeOnError() {
 
 		c.Close()
 		close(c.quit)
+		// The game can't go on without the simulator, unless it's over.
+		if !c.g.isComplete() {
+			c.g.close(EndError)
+		}
 	}
 }
 
@@ -0,0 +1,138 @@
+package game
+
+import (
+	"context"
+	"errors"
+	"github.com/HearthSim/hs-proto-go/bnet/game_master_service"
+	"github.com/HearthSim/hs-proto-go/bnet/game_utilities_service"
+	"github.com/HearthSim/stove/bnet"
+	"github.com/golang/protobuf/proto"
+	"log"
+)
+
+const (
+	gameMasterService    = "bnet.protocol.game_master.GameMaster"
+	gameUtilitiesService = "bnet.protocol.game_utilities.GameUtilities"
+)
+
+// ErrUnregistered is returned by Link once the host has unregistered.
+var ErrUnregistered = errors.New("game host unregistered")
+
+// Link registers the host with the stove server at address as a game host of
+// program, giving stove's game host password.  Stove then asks the host for
+// its load and to create games through the GameUtilities service the host
+// exports, and the host tells stove through GameMaster.GameEnded when each
+// game ends, and why.  Link returns once the connection is lost, or right away
+// with ErrUnregistered if Unregister was called.
+func (h *Host) Link(address, program, password string) error {
+	h.mutex.Lock()
+	unregistered := h.unregistered
+	h.mutex.Unlock()
+	if unregistered {
+		return ErrUnregistered
+	}
+	exports := []*bnet.ClientExport{{
+		Name: gameUtilitiesService,
+		Invoke: func(method int, body []byte) ([]byte, error) {
+			return h.invokeUtilities(program, method, body)
+		},
+	}}
+	c, err := bnet.Dial(address, []string{gameMasterService}, exports)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	h.OnGameEnded(func(handle int32, reason uint32) {
+		err := c.Notify(gameMasterService, 5, &game_master_service.GameEndedNotification{
+			GameHandle: GameHandle(program, handle),
+			Reason:     proto.Uint32(reason),
+		})
+		if err != nil {
+			log.Printf("game host: couldn't report the end of game %d: %v", handle, err)
+		}
+	})
+	defer h.OnGameEnded(nil)
+
+	req := &game_master_service.RegisterServerRequest{}
+	req.Attribute = bnet.NewNotification("", map[string]interface{}{
+		"password": password,
+	}).Attributes
+	req.ProgramId = proto.Uint32(bnet.FourCC(program))
+	req.State = h.Load()
+	ctx, cancel := context.WithTimeout(context.Background(), bnet.DefaultCallTimeout)
+	_, err = c.Call(ctx, gameMasterService, 7, req)
+	cancel()
+	if err != nil {
+		return err
+	}
+	log.Printf("game host: registered with %s as a %s host", address, program)
+
+	h.mutex.Lock()
+	unregistered = h.unregistered
+	if !unregistered {
+		h.link = c
+	}
+	h.mutex.Unlock()
+	if unregistered {
+		// Unregister was called while registering.
+		err = unregister(c)
+		if err != nil {
+			log.Printf("game host: couldn't unregister: %v", err)
+		}
+	}
+	<-c.Done()
+	h.mutex.Lock()
+	h.link = nil
+	h.mutex.Unlock()
+	return c.Err()
+}
+
+// Unregister tells stove to stop sending the host new games, and keeps Link
+// from registering it again.  The link stays up, so that the games still
+// running report their ends to stove.
+func (h *Host) Unregister() error {
+	h.mutex.Lock()
+	h.unregistered = true
+	c := h.link
+	h.mutex.Unlock()
+	if c == nil {
+		return nil
+	}
+	return unregister(c)
+}
+
+func unregister(c *bnet.Client) error {
+	return c.Notify(gameMasterService, 8, &game_master_service.UnregisterServerRequest{})
+}
+
+// invokeUtilities answers stove's calls to the GameUtilities service.
+func (h *Host) invokeUtilities(program string, method int, body []byte) ([]byte, error) {
+	var res proto.Message
+	switch method {
+	case 5:
+		res = h.Load()
+	case 6:
+		req := &game_utilities_service.ServerRequest{}
+		err := proto.Unmarshal(body, req)
+		if err != nil {
+			return nil, err
+		}
+		if req.GetProgram() != bnet.FourCC(program) {
+			return nil, bnet.Errorf(bnet.ErrorNotExists, "game host doesn't run %s games",
+				bnet.FourCCString(req.GetProgram()))
+		}
+		attrs, err := h.CreateGame(req.Attribute)
+		if err != nil {
+			return nil, err
+		}
+		res = &game_utilities_service.ServerResponse{Attribute: attrs}
+	default:
+		return nil, bnet.Errorf(bnet.ErrorRPCInvalidMethod, "GameUtilities method %d isn't exported", method)
+	}
+	buf, err := proto.Marshal(res)
+	if err != nil {
+		log.Panicf("error: Host.invokeUtilities: marshal: %v", err)
+	}
+	return buf, nil
+}
@@ -1,36 +1,56 @@
 package game
 
 import (
+	"context"
+	"errors"
 	"log"
 	"net"
+	"sync"
 )
 
 // Handles client connections and hands them off to the appropriate game
 // instance
 type server struct {
-	games       []*Game
-	sock        net.Listener
+	games []*Game
+	sock  net.Listener
+
+	// mutex protects gameHandles, closing and closed.
+	mutex       sync.Mutex
 	gameHandles map[int32]*Game
+	// Set once the server is shutting down and takes no new games.
+	closing bool
+	// Set once the listener is closed.
+	closed bool
+
+	// ended is called with each game once it ends.
+	ended func(g *Game)
 }
 
-func NewServer(listenAddr string) *server {
-	log.Printf("game server listening on %s", listenAddr)
+func newServer(listenAddr string, ended func(g *Game)) (*server, error) {
 	res := &server{}
 	res.games = []*Game{}
 	res.gameHandles = map[int32]*Game{}
+	res.ended = ended
 	var err error
 	res.sock, err = net.Listen("tcp", listenAddr)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	log.Printf("game server listening on %s", res.sock.Addr())
 	go res.serve()
-	return res
+	return res, nil
 }
 
 func (s *server) serve() {
 	for {
 		c, err := s.sock.Accept()
 		if err != nil {
+			s.mutex.Lock()
+			closed := s.closed
+			s.mutex.Unlock()
+			if closed {
+				return
+			}
 			log.Printf("game server: error in accept: %v", err)
 			continue
 		}
@@ -39,13 +59,79 @@ func (s *server) serve() {
 	}
 }
 
+// addGame makes a game joinable until it ends.  Once the server is shutting
+// down, no more games are added.
+func (s *server) addGame(g *Game) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closing {
+		return errors.New("game server is shutting down")
+	}
+	s.gameHandles[g.GameHandle] = g
+	go func() {
+		<-g.quit
+		s.mutex.Lock()
+		delete(s.gameHandles, g.GameHandle)
+		s.mutex.Unlock()
+		if s.ended != nil {
+			s.ended(g)
+		}
+	}()
+	return nil
+}
+
+// load returns the number of games running, and of the players in them who
+// aren't AI.
+func (s *server) load() (games, players int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, g := range s.gameHandles {
+		games++
+		for _, p := range g.Players {
+			if !p.IsAI() {
+				players++
+			}
+		}
+	}
+	return
+}
+
 func (s *server) GameFromHandle(h int32) *Game {
-	if game, ok := s.gameHandles[h]; ok {
-		return game
-	} else {
+	s.mutex.Lock()
+	game, ok := s.gameHandles[h]
+	s.mutex.Unlock()
+	if !ok {
 		log.Panicf("handshake game handle %d not found", h)
-		return nil
 	}
+	return game
 }
 
-var gameServer = NewServer(":1120")
+// shutdown stops taking new games, waits for every game to end, closing the
+// games still running once ctx is done, and then stops accepting connections.
+func (s *server) shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+	s.closing = true
+	games := make([]*Game, 0, len(s.gameHandles))
+	for _, g := range s.gameHandles {
+		games = append(games, g)
+	}
+	s.mutex.Unlock()
+	log.Printf("game server: waiting for %d games to end", len(games))
+
+	var res error
+	for _, g := range games {
+		select {
+		case <-g.quit:
+		case <-ctx.Done():
+			log.Printf("game server: closing game %s", g.GameId)
+			g.Close()
+			res = ctx.Err()
+		}
+	}
+
+	s.mutex.Lock()
+	s.closed = true
+	s.mutex.Unlock()
+	s.sock.Close()
+	return res
+}
@@ -217,7 +217,12 @@ func (s *session) Close() {
 			}
 		}
 		s.g.clients = clients
+		// A game played to the end is over once every player has left.
+		ended := s.g.complete && len(clients) == 0
 		s.g.Unlock()
+		if ended {
+			s.g.close(EndComplete)
+		}
 	}
 
 	close(s.quit)
@@ -0,0 +1,292 @@
+package pegasus
+
+import (
+	"github.com/HearthSim/hs-proto-go/pegasus/shared"
+	"github.com/HearthSim/stove/bnet"
+	"github.com/HearthSim/stove/pegasus/matchmaking"
+	"log"
+	"sync"
+)
+
+// Reasons sent with GQ_EXIT notifications.
+const (
+	queueExitMatched = iota
+	queueExitCancelled
+)
+
+// A queueEntry is a player waiting to be matched with an opponent.
+type queueEntry struct {
+	// The requestId sent to the client in its FindGame response, and to
+	// the matchmaking backend.
+	id       uint64
+	sess     *Session
+	gameType shared.BnetGameType
+	scenario int
+	deck     Deck
+	// Set while the client waits for the answer to its cancel request.
+	cancelling bool
+}
+
+// A matchmaker hands queued players to a matchmaking backend, and relays what
+// the backend decides to the players' clients.  The backend chooses whether an
+// entry is matched or cancelled, so it's never both.
+type matchmaker struct {
+	backend matchmaking.Matchmaker
+
+	// mutex protects the fields below.  It's never held while talking to the
+	// backend.
+	mutex         sync.Mutex
+	lastRequestID uint64
+	pending       map[uint64]*queueEntry
+}
+
+// newMatchmaker returns a matchmaker using backend, which it closes once
+// stopped.
+func newMatchmaker(backend matchmaking.Matchmaker) *matchmaker {
+	m := &matchmaker{
+		backend: backend,
+		pending: map[uint64]*queueEntry{},
+	}
+	go m.receive()
+	return m
+}
+
+// nextRequestID returns a requestId which hasn't been used by any FindGame
+// response.
+func (m *matchmaker) nextRequestID() uint64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.lastRequestID++
+	return m.lastRequestID
+}
+
+// enqueue returns a new entry for a player, which is queued once it's passed
+// to find.  A session only waits in one queue at a time, so its previous entry
+// is cancelled.
+func (m *matchmaker) enqueue(sess *Session, gameType shared.BnetGameType, scenario int, deck Deck) *queueEntry {
+	m.mutex.Lock()
+	m.lastRequestID++
+	entry := &queueEntry{
+		id:       m.lastRequestID,
+		sess:     sess,
+		gameType: gameType,
+		scenario: scenario,
+		deck:     deck,
+	}
+	previous := m.remove(sess)
+	m.pending[entry.id] = entry
+	m.mutex.Unlock()
+	m.cancelEntries(previous)
+	return entry
+}
+
+// find asks the backend to queue an entry.  It's called once the client knows
+// the entry's requestId, since the backend's answers refer to it.
+func (m *matchmaker) find(entry *queueEntry) {
+	err := m.backend.Send(&matchmaking.Message{
+		Type:          matchmaking.MessageFind,
+		RequestID:     entry.id,
+		GameAccountID: entry.sess.Account.ID,
+		GameType:      int32(entry.gameType),
+		Scenario:      entry.scenario,
+	})
+	if err != nil {
+		log.Printf("matchmaker: can't queue %d: %v", entry.id, err)
+		m.mutex.Lock()
+		delete(m.pending, entry.id)
+		m.mutex.Unlock()
+		entry.sess.sendQueueNotification(bnet.NotifyQueueExit, map[string]interface{}{
+			"requestId": entry.id,
+			"reason":    queueExitCancelled,
+		})
+	}
+}
+
+// cancel asks the backend to take a session's entry out of its queue.  The
+// client is answered with GS_CG_RES once the backend has decided.
+func (m *matchmaker) cancel(sess *Session, requestID uint64) {
+	m.mutex.Lock()
+	entry := m.pending[requestID]
+	if entry == nil || entry.sess != sess || entry.cancelling {
+		m.mutex.Unlock()
+		sess.sendCancelResponse(false)
+		return
+	}
+	entry.cancelling = true
+	m.mutex.Unlock()
+	err := m.backend.Send(&matchmaking.Message{
+		Type:      matchmaking.MessageCancel,
+		RequestID: requestID,
+	})
+	if err != nil {
+		log.Printf("matchmaker: can't cancel %d: %v", requestID, err)
+		m.mutex.Lock()
+		entry.cancelling = false
+		m.mutex.Unlock()
+		sess.sendCancelResponse(false)
+	}
+}
+
+// leave takes a session out of whichever queue it's waiting in.
+func (m *matchmaker) leave(sess *Session) {
+	m.mutex.Lock()
+	entries := m.remove(sess)
+	m.mutex.Unlock()
+	m.cancelEntries(entries)
+}
+
+// remove forgets a session's pending entries and returns them.  The mutex
+// must be held.
+func (m *matchmaker) remove(sess *Session) []*queueEntry {
+	entries := []*queueEntry{}
+	for id, entry := range m.pending {
+		if entry.sess == sess {
+			delete(m.pending, id)
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// cancelEntries asks the backend to cancel entries which were forgotten.  Its
+// answers are ignored.
+func (m *matchmaker) cancelEntries(entries []*queueEntry) {
+	for _, entry := range entries {
+		err := m.backend.Send(&matchmaking.Message{
+			Type:      matchmaking.MessageCancel,
+			RequestID: entry.id,
+		})
+		if err != nil {
+			log.Printf("matchmaker: can't cancel %d: %v", entry.id, err)
+		}
+	}
+}
+
+// receive handles the backend's messages until it's closed.  If the backend
+// fails, every queued player is told it left the queue.
+func (m *matchmaker) receive() {
+	for {
+		msg, err := m.backend.Receive()
+		if err != nil {
+			if err != matchmaking.ErrClosed {
+				log.Printf("matchmaker: backend failed: %v", err)
+			}
+			m.mutex.Lock()
+			pending := m.pending
+			m.pending = map[uint64]*queueEntry{}
+			m.mutex.Unlock()
+			for _, entry := range pending {
+				m.exit(entry, queueExitCancelled)
+			}
+			return
+		}
+		m.handle(msg)
+	}
+}
+
+func (m *matchmaker) handle(msg *matchmaking.Message) {
+	m.mutex.Lock()
+	entry := m.pending[msg.RequestID]
+	var opponent *queueEntry
+	refused := false
+	switch msg.Type {
+	case matchmaking.MessageMatch:
+		opponent = m.pending[msg.Opponent]
+		delete(m.pending, msg.RequestID)
+		delete(m.pending, msg.Opponent)
+	case matchmaking.MessageCancelled:
+		if msg.Cancelled {
+			delete(m.pending, msg.RequestID)
+		} else if entry != nil && entry.cancelling {
+			// The entry stays queued, and the client may try again.
+			entry.cancelling = false
+			refused = true
+		}
+	}
+	m.mutex.Unlock()
+
+	switch msg.Type {
+	case matchmaking.MessageEntry:
+		if entry != nil {
+			entry.sess.sendQueueNotification(bnet.NotifyQueueEntry, map[string]interface{}{
+				"requestId": entry.id,
+			})
+		}
+	case matchmaking.MessageUpdate:
+		if entry != nil {
+			entry.sess.sendQueueNotification(bnet.NotifyQueueUpdate, map[string]interface{}{
+				"requestId":    entry.id,
+				"min_wait":     msg.MinWait,
+				"max_wait":     msg.MaxWait,
+				"avg_wait":     msg.AvgWait,
+				"std_dev_wait": msg.StdDevWait,
+			})
+		}
+	case matchmaking.MessageMatch:
+		if entry == nil || opponent == nil {
+			// One of them left, so neither can play.
+			log.Printf("matchmaker: match of %d and %d is missing a player",
+				msg.RequestID, msg.Opponent)
+			for _, e := range []*queueEntry{entry, opponent} {
+				if e != nil {
+					m.exit(e, queueExitCancelled)
+				}
+			}
+			return
+		}
+		// Creating the game may take a while, which mustn't hold up the
+		// backend's other messages.
+		go m.startMatch(entry, opponent)
+	case matchmaking.MessageCancelled:
+		if entry != nil && msg.Cancelled {
+			m.exit(entry, queueExitCancelled)
+		} else if refused {
+			entry.sess.sendCancelResponse(false)
+		}
+	default:
+		log.Printf("matchmaker: unexpected %s message", msg.Type)
+	}
+}
+
+// exit tells a client its entry left the queue, answering its cancel request
+// if it made one.
+func (m *matchmaker) exit(entry *queueEntry, reason int) {
+	if entry.cancelling {
+		entry.sess.sendCancelResponse(reason == queueExitCancelled)
+	}
+	entry.sess.sendQueueNotification(bnet.NotifyQueueExit, map[string]interface{}{
+		"requestId": entry.id,
+		"reason":    reason,
+	})
+}
+
+// stop closes the backend.
+func (m *matchmaker) stop() {
+	m.backend.Close()
+}
+
+// sendQueueNotification forwards a queue notification to the session's
+// client, unless it has disconnected.
+func (s *Session) sendQueueNotification(ty string, attributes map[string]interface{}) {
+	attributes["targetId"] = *bnet.EntityId(0, 0)
+	attributes["forwardToClient"] = true
+	s.sendGameNotification(bnet.NewNotification(ty, attributes))
+}
+
+// sendCancelResponse answers the session's CancelGameEntry request.
+func (s *Session) sendCancelResponse(cancelled bool) {
+	s.sendGameNotification(bnet.NewNotification(bnet.NotifyCancelGameResponse,
+		map[string]interface{}{
+			"cancelled": cancelled,
+		}))
+}
+
+// sendGameNotification sends a notification to bnet from outside the
+// session's own goroutine, unless the session has disconnected.
+func (s *Session) sendGameNotification(n *bnet.Notification) {
+	select {
+	case s.gameNotifications <- n:
+	case <-s.host.Done():
+		log.Printf("dropping %s notification for disconnected session", n.Type)
+	}
+}
@@ -0,0 +1,201 @@
+package pegasus
+
+import (
+	"github.com/HearthSim/hs-proto-go/pegasus/shared"
+	"github.com/HearthSim/stove/bnet"
+	"github.com/HearthSim/stove/pegasus/matchmaking"
+	"net"
+	"testing"
+	"time"
+)
+
+// newQueueSession returns a session whose notifications to bnet are buffered
+// in the returned channel.
+func newQueueSession(id int64) (*Session, chan *bnet.Notification) {
+	c, _ := net.Pipe()
+	notifications := make(chan *bnet.Notification, 10)
+	sess := &Session{}
+	sess.Account.ID = id
+	sess.host = bnet.NewSession(bnet.NewServer(), c)
+	sess.gameNotifications = notifications
+	return sess, notifications
+}
+
+func expectNotification(t *testing.T, notifications chan *bnet.Notification, ty string) map[string]interface{} {
+	select {
+	case n := <-notifications:
+		if n.Type != ty {
+			t.Fatalf("expected %s notification, got %s", ty, n.Type)
+		}
+		return n.Map()
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for %s notification", ty)
+	}
+	return nil
+}
+
+func expectQueueExit(t *testing.T, notifications chan *bnet.Notification, reason int) {
+	m := expectNotification(t, notifications, bnet.NotifyQueueExit)
+	if m["reason"] != int64(reason) {
+		t.Errorf("expected exit reason %d, got %v", reason, m["reason"])
+	}
+}
+
+// A scriptedBackend passes the messages it's sent to the test, and receives
+// the messages the test gives it.
+type scriptedBackend struct {
+	sent     chan *matchmaking.Message
+	received chan *matchmaking.Message
+	// Returned by Send in place of sending, if set.
+	sendErr error
+}
+
+func newScriptedBackend() *scriptedBackend {
+	return &scriptedBackend{
+		sent:     make(chan *matchmaking.Message, 10),
+		received: make(chan *matchmaking.Message),
+	}
+}
+
+func (b *scriptedBackend) Send(m *matchmaking.Message) error {
+	if b.sendErr != nil {
+		return b.sendErr
+	}
+	b.sent <- m
+	return nil
+}
+
+func (b *scriptedBackend) Receive() (*matchmaking.Message, error) {
+	m, ok := <-b.received
+	if !ok {
+		return nil, matchmaking.ErrClosed
+	}
+	return m, nil
+}
+
+func (b *scriptedBackend) Close() error {
+	close(b.received)
+	return nil
+}
+
+func (b *scriptedBackend) expectSent(t *testing.T, ty string) {
+	select {
+	case m := <-b.sent:
+		if m.Type != ty {
+			t.Fatalf("expected a %s message, got %s", ty, m.Type)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for a %s message", ty)
+	}
+}
+
+func TestMatchmaker(t *testing.T) {
+	m := newMatchmaker(matchmaking.NewLocal())
+	a, notifyA := newQueueSession(1)
+	b, notifyB := newQueueSession(2)
+	ranked := shared.BnetGameType_BGT_RANKED
+
+	entry := m.enqueue(a, ranked, 2, Deck{ID: 1})
+	m.find(entry)
+	if expectNotification(t, notifyA, bnet.NotifyQueueEntry)["requestId"] != entry.id {
+		t.Errorf("GQ_ENTRY doesn't have the entry's requestId")
+	}
+
+	// Only the session which queued may cancel.
+	m.cancel(b, entry.id)
+	if expectNotification(t, notifyB, bnet.NotifyCancelGameResponse)["cancelled"] != false {
+		t.Errorf("cancelled another session's entry")
+	}
+	m.cancel(a, entry.id)
+	if expectNotification(t, notifyA, bnet.NotifyCancelGameResponse)["cancelled"] != true {
+		t.Errorf("couldn't cancel a queued entry")
+	}
+	expectQueueExit(t, notifyA, queueExitCancelled)
+	m.cancel(a, entry.id)
+	if expectNotification(t, notifyA, bnet.NotifyCancelGameResponse)["cancelled"] != false {
+		t.Errorf("cancelled an entry twice")
+	}
+
+	// Queueing again replaces the previous entry without telling the client.
+	first := m.enqueue(a, ranked, 2, Deck{ID: 1})
+	m.find(first)
+	expectNotification(t, notifyA, bnet.NotifyQueueEntry)
+	second := m.enqueue(a, ranked, 4, Deck{ID: 1})
+	m.find(second)
+	if expectNotification(t, notifyA, bnet.NotifyQueueEntry)["requestId"] != second.id {
+		t.Errorf("expected GQ_ENTRY for the second entry")
+	}
+
+	// Players still queued when the backend goes away leave the queue.
+	m.stop()
+	if expectNotification(t, notifyA, bnet.NotifyQueueExit)["requestId"] != second.id {
+		t.Errorf("expected GQ_EXIT for the second entry")
+	}
+	select {
+	case n := <-notifyA:
+		t.Errorf("unexpected %s notification", n.Type)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+// A cancel the backend refuses leaves the entry queued, and is answered right
+// away.
+func TestMatchmakerCancelRefused(t *testing.T) {
+	backend := newScriptedBackend()
+	m := newMatchmaker(backend)
+	defer m.stop()
+	a, notifyA := newQueueSession(1)
+	entry := m.enqueue(a, shared.BnetGameType_BGT_RANKED, 2, Deck{ID: 1})
+	m.find(entry)
+	backend.expectSent(t, matchmaking.MessageFind)
+
+	m.cancel(a, entry.id)
+	backend.expectSent(t, matchmaking.MessageCancel)
+	backend.received <- &matchmaking.Message{
+		Type:      matchmaking.MessageCancelled,
+		RequestID: entry.id,
+	}
+	if expectNotification(t, notifyA, bnet.NotifyCancelGameResponse)["cancelled"] != false {
+		t.Errorf("expected the cancel to be refused")
+	}
+	m.mutex.Lock()
+	queued := m.pending[entry.id] == entry
+	m.mutex.Unlock()
+	if !queued {
+		t.Errorf("the entry left the queue when its cancel was refused")
+	}
+
+	// The client may ask again.
+	m.cancel(a, entry.id)
+	backend.expectSent(t, matchmaking.MessageCancel)
+	backend.received <- &matchmaking.Message{
+		Type:      matchmaking.MessageCancelled,
+		RequestID: entry.id,
+		Cancelled: true,
+	}
+	if expectNotification(t, notifyA, bnet.NotifyCancelGameResponse)["cancelled"] != true {
+		t.Errorf("couldn't cancel the entry once the backend agreed")
+	}
+	expectQueueExit(t, notifyA, queueExitCancelled)
+}
+
+// A cancel which can't reach the backend is refused, and may be tried again.
+func TestMatchmakerCancelUnsent(t *testing.T) {
+	backend := newScriptedBackend()
+	m := newMatchmaker(backend)
+	defer m.stop()
+	a, notifyA := newQueueSession(1)
+	entry := m.enqueue(a, shared.BnetGameType_BGT_RANKED, 2, Deck{ID: 1})
+	m.find(entry)
+	backend.expectSent(t, matchmaking.MessageFind)
+
+	backend.sendErr = matchmaking.ErrClosed
+	m.cancel(a, entry.id)
+	if expectNotification(t, notifyA, bnet.NotifyCancelGameResponse)["cancelled"] != false {
+		t.Errorf("expected the cancel to be refused")
+	}
+
+	backend.sendErr = nil
+	m.cancel(a, entry.id)
+	backend.expectSent(t, matchmaking.MessageCancel)
+}
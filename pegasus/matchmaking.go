@@ -22,87 +22,190 @@ func (s *Session) HandleFindGame(req map[string]interface{}) {
 	db.Preload("Cards").First(&deck, deckID)
 	log.Printf("handling queue for scenario %v with type %s and deck %d\n",
 		*scenario, gameType.String(), deckID)
-	aiDeck := Deck{}
-	db.Preload("Cards").Where(&Deck{
-		DeckType: int(shared.DeckType_PRECON_DECK),
-		HeroID:   int32(scenario.Player2HeroCardID),
-	}).First(&aiDeck)
+	var requestID uint64
 	if scenario.Players == 1 {
-		player1Cards := []string{}
-		player1Premium := []bool{}
-		for _, deckCard := range deck.Cards {
-			for i := int32(0); i < deckCard.Num; i++ {
-				player1Cards = append(player1Cards,
-					cardAssetIdToMiniGuid[deckCard.CardID])
-				player1Premium = append(player1Premium, false)
-			}
-		}
-		player2Cards := []string{}
-		player2Premium := []bool{}
-		for _, deckCard := range aiDeck.Cards {
-			for i := int32(0); i < deckCard.Num; i++ {
-				player2Cards = append(player2Cards,
-					cardAssetIdToMiniGuid[deckCard.CardID])
-				player2Premium = append(player2Premium, false)
-			}
-		}
+		aiDeck := Deck{}
+		db.Preload("Cards").Where(&Deck{
+			DeckType: int(shared.DeckType_PRECON_DECK),
+			HeroID:   int32(scenario.Player2HeroCardID),
+		}).First(&aiDeck)
 		params := &game.GameStartInfo{}
-		params.Players = append(params.Players, game.PlayerInfo{
-			DisplayName: s.Account.displayName,
-			GameAccountId: &shared.BnetId{
-				Hi: proto.Uint64(GameAccountEntityIDHi),
-				Lo: proto.Uint64(uint64(s.Account.ID)),
-			},
-			HeroCardId: cardAssetIdToMiniGuid[deck.HeroID],
-			CardIds:    player1Cards,
-			Premium:    player1Premium,
-		})
-		params.Players = append(params.Players, game.PlayerInfo{
-			DisplayName: "The Innkeeper",
-			GameAccountId: &shared.BnetId{
-				Hi: proto.Uint64(GameAccountEntityIDHi),
-				Lo: proto.Uint64(0),
-			},
-			HeroCardId: cardAssetIdToMiniGuid[aiDeck.HeroID],
-			CardIds:    player2Cards,
-			Premium:    player2Premium,
-		})
-		g := game.CreateGame(params)
-		connectInfo := &game_master_types.ConnectInfo{}
-		// TODO: figure out the right host
-		connectInfo.Host = proto.String("127.0.0.1")
-		connectInfo.Port = proto.Int32(int32(g.Address.Port))
-		connectInfo.Token = []byte(g.Players[0].Password)
-		connectInfo.MemberId = &entity.EntityId{}
-		connectInfo.MemberId.High = proto.Uint64(0)
-		connectInfo.MemberId.Low = proto.Uint64(0)
-
-		connectInfo.Attribute = bnet.NewNotification("", map[string]interface{}{
-			"id":                 g.Players[0].ClientHandle,
-			"game":               g.GameHandle,
-			"resumable":          false,
-			"spectator_password": g.SpectatorPassword,
-			"version":            "3.0.0.10604",
-		}).Attributes
-		buf, err := proto.Marshal(connectInfo)
+		params.Players = append(params.Players,
+			playerInfo(s.Account.displayName, s.Account.ID, &deck))
+		params.Players = append(params.Players,
+			playerInfo("The Innkeeper", 0, &aiDeck))
+		g, err := s.server.createGame(params)
+		requestID = s.server.matchmaker.nextRequestID()
 		if err != nil {
-			panic(err)
-		}
-		defer func() {
-			s.gameNotifications <- bnet.NewNotification(
-				bnet.NotifyQueueResult,
+			log.Printf("can't create game for %d: %v", s.Account.ID, err)
+			s.gameNotifications <- bnet.NewNotification(bnet.NotifyFindGameResponse,
 				map[string]interface{}{
-					"connection_info": bnet.MessageValue{buf},
-					"targetId":        *bnet.EntityId(0, 0),
-					"forwardToClient": true,
+					"queued":    false,
+					"requestId": requestID,
 				})
-		}()
+			return
+		}
+		defer s.sendGameResult(g, 0)
 	} else {
-		panic(nyi)
+		if deck.ID == 0 || deck.AccountID != s.Account.ID {
+			log.Printf("can't queue %d: bad deck ID %d", s.Account.ID, deckID)
+			s.gameNotifications <- bnet.NewNotification(bnet.NotifyFindGameResponse,
+				map[string]interface{}{
+					"queued":    false,
+					"requestId": s.server.matchmaker.nextRequestID(),
+				})
+			return
+		}
+		entry := s.server.matchmaker.enqueue(s, gameType, scenario.ID, deck)
+		requestID = entry.id
+		// The client must know the requestId before it's queued.
+		defer s.server.matchmaker.find(entry)
 	}
 	s.gameNotifications <- bnet.NewNotification(bnet.NotifyFindGameResponse,
 		map[string]interface{}{
 			"queued":    true,
-			"requestId": uint(1),
+			"requestId": requestID,
 		})
 }
+
+// HandleCancelGame takes the client out of the matchmaking queue, unless it
+// has already been matched.  The matchmaker answers once it knows which.
+func (s *Session) HandleCancelGame(req map[string]interface{}) {
+	requestID := req["requestId"].(uint64)
+	log.Printf("cancelling queue entry %d of %d", requestID, s.Account.ID)
+	s.server.matchmaker.cancel(s, requestID)
+}
+
+// startMatch creates a game between two players the matchmaker paired, and
+// only then tells them they left the queue and how to join the game.  If the
+// game can't be created, they're told their entries were cancelled instead.
+// The player who queued first goes first.
+func (m *matchmaker) startMatch(first, second *queueEntry) {
+	log.Printf("matched %d and %d for %s", first.sess.Account.ID,
+		second.sess.Account.ID, first.gameType.String())
+	params := &game.GameStartInfo{}
+	params.Players = append(params.Players,
+		playerInfo(first.sess.Account.displayName, first.sess.Account.ID, &first.deck))
+	params.Players = append(params.Players,
+		playerInfo(second.sess.Account.displayName, second.sess.Account.ID, &second.deck))
+	g, err := first.sess.server.createGame(params)
+	if err != nil {
+		log.Printf("can't create game for %d and %d: %v", first.sess.Account.ID,
+			second.sess.Account.ID, err)
+		m.exit(first, queueExitCancelled)
+		m.exit(second, queueExitCancelled)
+		return
+	}
+	m.exit(first, queueExitMatched)
+	m.exit(second, queueExitMatched)
+	first.sess.sendGameResult(g, 0)
+	second.sess.sendGameResult(g, 1)
+}
+
+// HandleFriendlyChallenge starts a game between two friends who agreed to
+// play, each with their own deck.  The challenger's client asks for the game
+// on behalf of both of them, and bnet only passes the challenge on once the
+// opponent accepted it by joining the challenger's channel, or the other way
+// around.
+func (s *Session) HandleFriendlyChallenge(req map[string]interface{}) {
+	deckID := req["deck"].(int64)
+	opponentID := int64(req["opponent"].(uint64))
+	opponentDeckID := req["opponent_deck"].(int64)
+	log.Printf("handling friendly challenge of %d with deck %d against %d with deck %d",
+		s.Account.ID, deckID, opponentID, opponentDeckID)
+
+	opponent := s.server.sessionForGameAccount(opponentID)
+	deck := Deck{}
+	db.Preload("Cards").Where("id = ? and account_id = ?", deckID, s.Account.ID).First(&deck)
+	opponentDeck := Deck{}
+	db.Preload("Cards").Where("id = ? and account_id = ?", opponentDeckID, opponentID).First(&opponentDeck)
+	if opponent == nil || deck.ID == 0 || opponentDeck.ID == 0 {
+		log.Printf("friendly challenge of %d against %d failed: opponent or deck not found",
+			s.Account.ID, opponentID)
+		s.gameNotifications <- bnet.NewNotification(bnet.NotifyFindGameResponse,
+			map[string]interface{}{
+				"queued":    false,
+				"requestId": s.server.matchmaker.nextRequestID(),
+			})
+		return
+	}
+
+	params := &game.GameStartInfo{}
+	params.Players = append(params.Players,
+		playerInfo(s.Account.displayName, s.Account.ID, &deck))
+	params.Players = append(params.Players,
+		playerInfo(opponent.Account.displayName, opponentID, &opponentDeck))
+	g, err := s.server.createGame(params)
+	if err != nil {
+		log.Printf("can't create game for %d and %d: %v", s.Account.ID, opponentID, err)
+	}
+	s.gameNotifications <- bnet.NewNotification(bnet.NotifyFindGameResponse,
+		map[string]interface{}{
+			"queued":    err == nil,
+			"requestId": s.server.matchmaker.nextRequestID(),
+		})
+	if err != nil {
+		return
+	}
+	s.sendGameResult(g, 0)
+	opponent.sendGameResult(g, 1)
+}
+
+// playerInfo returns the game start info of a player with a deck.  AI players
+// have game account 0.
+func playerInfo(displayName string, gameAccountID int64, deck *Deck) game.PlayerInfo {
+	cards := []string{}
+	premium := []bool{}
+	for _, deckCard := range deck.Cards {
+		for i := int32(0); i < deckCard.Num; i++ {
+			cards = append(cards, cardAssetIdToMiniGuid[deckCard.CardID])
+			premium = append(premium, false)
+		}
+	}
+	return game.PlayerInfo{
+		DisplayName: displayName,
+		GameAccountId: &shared.BnetId{
+			Hi: proto.Uint64(GameAccountEntityIDHi),
+			Lo: proto.Uint64(uint64(gameAccountID)),
+		},
+		HeroCardId: cardAssetIdToMiniGuid[deck.HeroID],
+		CardIds:    cards,
+		Premium:    premium,
+	}
+}
+
+// sendGameResult tells the session's client how to connect to a game as the
+// player with the given index.
+func (s *Session) sendGameResult(g *game.GameInfo, player int) {
+	connectInfo := &game_master_types.ConnectInfo{}
+	connectInfo.Host = proto.String(g.Host)
+	connectInfo.Port = proto.Int32(int32(g.Port))
+	connectInfo.Token = []byte(g.Players[player].Password)
+	connectInfo.MemberId = &entity.EntityId{}
+	connectInfo.MemberId.High = proto.Uint64(0)
+	connectInfo.MemberId.Low = proto.Uint64(0)
+
+	connectInfo.Attribute = bnet.NewNotification("", map[string]interface{}{
+		"id":                 g.Players[player].ClientHandle,
+		"game":               g.GameHandle,
+		"resumable":          false,
+		"spectator_password": g.SpectatorPassword,
+		"version":            "3.0.0.10604",
+	}).Attributes
+	buf, err := proto.Marshal(connectInfo)
+	if err != nil {
+		panic(err)
+	}
+	n := bnet.NewNotification(
+		bnet.NotifyQueueResult,
+		map[string]interface{}{
+			"connection_info": bnet.MessageValue{buf},
+			"targetId":        *bnet.EntityId(0, 0),
+			"forwardToClient": true,
+		})
+	// Matched players may have disconnected since they queued.
+	select {
+	case s.gameNotifications <- n:
+	case <-s.host.Done():
+	}
+}
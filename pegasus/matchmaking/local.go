@@ -0,0 +1,246 @@
+package matchmaking
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// How often the local matchmaker tells queued players their estimated wait.
+const updateInterval = 10 * time.Second
+
+// How many of the latest waits for each game type and scenario the estimate is
+// made from.
+const waitSamples = 20
+
+// A local matchmaker pairs the players queued for each game type and scenario
+// in the order they queued.  Entries are only ever taken out of a queue with
+// the matchmaker locked, so a player is either matched or cancelled, never
+// both.
+type local struct {
+	sync.Mutex
+	queues map[int32][]*localEntry
+	// The latest waits of matched players, for each game type and scenario.
+	waits map[waitKey][]time.Duration
+
+	// outbox holds the messages not yet received.  It's never full, so
+	// Send doesn't wait for Receive.
+	outbox []*Message
+	wake   chan struct{}
+
+	closeOnce sync.Once
+	quit      chan struct{}
+}
+
+// A waitKey is the game type and scenario players are matched within.
+type waitKey struct {
+	gameType int32
+	scenario int
+}
+
+type localEntry struct {
+	id       uint64
+	gameType int32
+	scenario int
+	queued   time.Time
+}
+
+// NewLocal returns a matchmaker which runs in-process.
+func NewLocal() Matchmaker {
+	return newLocal(updateInterval)
+}
+
+func newLocal(interval time.Duration) *local {
+	l := &local{
+		queues: map[int32][]*localEntry{},
+		waits:  map[waitKey][]time.Duration{},
+		wake:   make(chan struct{}, 1),
+		quit:   make(chan struct{}),
+	}
+	go l.sendUpdates(interval)
+	return l
+}
+
+func (l *local) Send(m *Message) error {
+	l.Lock()
+	defer l.Unlock()
+	if l.isClosed() {
+		return ErrClosed
+	}
+	switch m.Type {
+	case MessageFind:
+		return l.find(m)
+	case MessageCancel:
+		l.push(&Message{
+			Type:      MessageCancelled,
+			RequestID: m.RequestID,
+			Cancelled: l.take(m.RequestID) != nil,
+		})
+	default:
+		return fmt.Errorf("matchmaking: unexpected %s message", m.Type)
+	}
+	return nil
+}
+
+func (l *local) Receive() (*Message, error) {
+	for {
+		l.Lock()
+		if len(l.outbox) != 0 {
+			m := l.outbox[0]
+			l.outbox = l.outbox[1:]
+			l.Unlock()
+			return m, nil
+		}
+		l.Unlock()
+		select {
+		case <-l.wake:
+		case <-l.quit:
+			return nil, ErrClosed
+		}
+	}
+}
+
+func (l *local) Close() error {
+	err := ErrClosed
+	l.closeOnce.Do(func() {
+		close(l.quit)
+		err = nil
+	})
+	return err
+}
+
+func (l *local) isClosed() bool {
+	select {
+	case <-l.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// push queues a message to be received.  The matchmaker must be locked.
+func (l *local) push(m *Message) {
+	l.outbox = append(l.outbox, m)
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+// find queues a player, and matches it with the first player waiting for the
+// same scenario.  A request which is already queued is refused.  The
+// matchmaker must be locked.
+func (l *local) find(m *Message) error {
+	for _, queue := range l.queues {
+		for _, entry := range queue {
+			if entry.id == m.RequestID {
+				return fmt.Errorf("matchmaking: request %d is already queued", m.RequestID)
+			}
+		}
+	}
+	entry := &localEntry{
+		id:       m.RequestID,
+		gameType: m.GameType,
+		scenario: m.Scenario,
+		queued:   time.Now(),
+	}
+	l.push(&Message{Type: MessageEntry, RequestID: entry.id})
+	for _, waiting := range l.queues[entry.gameType] {
+		if waiting.scenario == entry.scenario {
+			l.take(waiting.id)
+			l.recordWait(waiting)
+			l.recordWait(entry)
+			l.push(&Message{
+				Type:      MessageMatch,
+				RequestID: waiting.id,
+				Opponent:  entry.id,
+			})
+			return nil
+		}
+	}
+	l.queues[entry.gameType] = append(l.queues[entry.gameType], entry)
+	return nil
+}
+
+// take removes an entry from its queue and returns it, or returns nil if it
+// isn't queued.  The matchmaker must be locked.
+func (l *local) take(requestID uint64) *localEntry {
+	for gameType, queue := range l.queues {
+		for i, entry := range queue {
+			if entry.id == requestID {
+				l.queues[gameType] = append(queue[:i:i], queue[i+1:]...)
+				return entry
+			}
+		}
+	}
+	return nil
+}
+
+// recordWait keeps how long a matched player waited.  The matchmaker must be
+// locked.
+func (l *local) recordWait(entry *localEntry) {
+	key := waitKey{entry.gameType, entry.scenario}
+	waits := append(l.waits[key], time.Since(entry.queued))
+	if len(waits) > waitSamples {
+		waits = waits[len(waits)-waitSamples:]
+	}
+	l.waits[key] = waits
+}
+
+// estimate returns the shortest, longest and mean recent wait for a game type
+// and scenario, and their standard deviation.  The matchmaker must be locked.
+func (l *local) estimate(key waitKey) (min, max, avg, stdDev time.Duration) {
+	waits := l.waits[key]
+	if len(waits) == 0 {
+		return
+	}
+	min, max = waits[0], waits[0]
+	var sum time.Duration
+	for _, wait := range waits {
+		if wait < min {
+			min = wait
+		}
+		if wait > max {
+			max = wait
+		}
+		sum += wait
+	}
+	avg = sum / time.Duration(len(waits))
+	var variance float64
+	for _, wait := range waits {
+		d := float64(wait - avg)
+		variance += d * d
+	}
+	stdDev = time.Duration(math.Sqrt(variance / float64(len(waits))))
+	return
+}
+
+// sendUpdates periodically tells every queued player its estimated wait, until
+// the matchmaker is closed.
+func (l *local) sendUpdates(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.Lock()
+			for gameType, queue := range l.queues {
+				for _, entry := range queue {
+					min, max, avg, stdDev := l.estimate(waitKey{gameType, entry.scenario})
+					l.push(&Message{
+						Type:       MessageUpdate,
+						RequestID:  entry.id,
+						MinWait:    int64(min / time.Second),
+						MaxWait:    int64(max / time.Second),
+						AvgWait:    int64(avg / time.Second),
+						StdDevWait: int64(stdDev / time.Second),
+					})
+				}
+			}
+			l.Unlock()
+		case <-l.quit:
+			return
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package matchmaking
+
+import (
+	"testing"
+	"time"
+)
+
+const (
+	ranked = 2
+	normal = 3
+)
+
+// expectMessage receives the next message from m, and checks its type and
+// request.
+func expectMessage(t *testing.T, m Matchmaker, ty string, requestID uint64) *Message {
+	received := make(chan *Message, 1)
+	go func() {
+		msg, err := m.Receive()
+		if err != nil {
+			t.Errorf("receiving %s message: %v", ty, err)
+		}
+		received <- msg
+	}()
+	select {
+	case msg := <-received:
+		if msg == nil {
+			t.FailNow()
+		}
+		if msg.Type != ty || msg.RequestID != requestID {
+			t.Fatalf("expected %s message for %d, got %+v", ty, requestID, msg)
+		}
+		return msg
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for %s message for %d", ty, requestID)
+	}
+	return nil
+}
+
+func find(requestID uint64, gameType int32, scenario int) *Message {
+	return &Message{
+		Type:          MessageFind,
+		RequestID:     requestID,
+		GameAccountID: int64(requestID),
+		GameType:      gameType,
+		Scenario:      scenario,
+	}
+}
+
+// testMatchmaker checks the messages of a matchmaker which pairs players the
+// way the local one does.
+func testMatchmaker(t *testing.T, m Matchmaker) {
+	m.Send(find(1, ranked, 2))
+	expectMessage(t, m, MessageEntry, 1)
+	// Players only meet others queued for the same game type and scenario.
+	m.Send(find(2, normal, 2))
+	expectMessage(t, m, MessageEntry, 2)
+	m.Send(find(3, ranked, 4))
+	expectMessage(t, m, MessageEntry, 3)
+	m.Send(find(4, ranked, 2))
+	expectMessage(t, m, MessageEntry, 4)
+	match := expectMessage(t, m, MessageMatch, 1)
+	if match.Opponent != 4 {
+		t.Errorf("expected 1 to be matched with 4, got %d", match.Opponent)
+	}
+
+	// A matched player can no longer cancel.
+	m.Send(&Message{Type: MessageCancel, RequestID: 1})
+	if expectMessage(t, m, MessageCancelled, 1).Cancelled {
+		t.Errorf("cancelled an entry which was already matched")
+	}
+	m.Send(&Message{Type: MessageCancel, RequestID: 2})
+	if !expectMessage(t, m, MessageCancelled, 2).Cancelled {
+		t.Errorf("couldn't cancel a queued entry")
+	}
+	m.Send(find(5, normal, 2))
+	expectMessage(t, m, MessageEntry, 5)
+	m.Send(&Message{Type: MessageCancel, RequestID: 5})
+	if !expectMessage(t, m, MessageCancelled, 5).Cancelled {
+		t.Errorf("matched with a player who cancelled")
+	}
+}
+
+func TestLocal(t *testing.T) {
+	m := NewLocal()
+	testMatchmaker(t, m)
+	m.Send(find(6, normal, 2))
+	expectMessage(t, m, MessageEntry, 6)
+	if err := m.Send(find(6, normal, 4)); err == nil {
+		t.Errorf("queued a request twice")
+	}
+	if err := m.Send(&Message{Type: MessageMatch}); err == nil {
+		t.Errorf("accepted a message meant for stove")
+	}
+	m.Close()
+	if _, err := m.Receive(); err != ErrClosed {
+		t.Errorf("expected ErrClosed from Receive, got %v", err)
+	}
+	if err := m.Send(find(7, ranked, 2)); err != ErrClosed {
+		t.Errorf("expected ErrClosed from Send, got %v", err)
+	}
+}
+
+func TestLocalUpdates(t *testing.T) {
+	m := newLocal(10 * time.Millisecond)
+	defer m.Close()
+	m.Send(find(1, ranked, 2))
+	expectMessage(t, m, MessageEntry, 1)
+	expectMessage(t, m, MessageUpdate, 1)
+	m.Send(&Message{Type: MessageCancel, RequestID: 1})
+	// Updates may have been sent before the cancel was handled.
+	for {
+		msg, err := m.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == MessageCancelled {
+			break
+		}
+	}
+}
+
+func TestLocalEstimate(t *testing.T) {
+	m := newLocal(time.Hour)
+	defer m.Close()
+	key := waitKey{ranked, 2}
+	min, max, avg, stdDev := m.estimate(key)
+	if min != 0 || max != 0 || avg != 0 || stdDev != 0 {
+		t.Errorf("expected no estimate without waits")
+	}
+	// Only the latest waits are kept, so these don't count.
+	for i := 0; i < waitSamples; i++ {
+		m.waits[key] = append(m.waits[key], time.Hour)
+	}
+	for i := 0; i < waitSamples/2; i++ {
+		m.recordWait(&localEntry{gameType: ranked, scenario: 2, queued: time.Now().Add(-2 * time.Second)})
+		m.recordWait(&localEntry{gameType: ranked, scenario: 2, queued: time.Now().Add(-4 * time.Second)})
+	}
+	if n := len(m.waits[key]); n != waitSamples {
+		t.Fatalf("expected %d waits, got %d", waitSamples, n)
+	}
+	// The waits are a little longer than the entries were given.
+	seconds := func(d time.Duration) time.Duration {
+		return (d + time.Second/2) / time.Second
+	}
+	min, max, avg, stdDev = m.estimate(key)
+	if seconds(min) != 2 || seconds(max) != 4 || seconds(avg) != 3 || seconds(stdDev) != 1 {
+		t.Errorf("bad estimate: min %v max %v avg %v stdDev %v", min, max, avg, stdDev)
+	}
+	// Other scenarios of the game type wait on their own.
+	if _, max, _, _ := m.estimate(waitKey{ranked, 4}); max != 0 {
+		t.Errorf("estimated another scenario's wait from these: max %v", max)
+	}
+}
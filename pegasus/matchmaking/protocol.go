@@ -0,0 +1,72 @@
+// Package matchmaking defines the protocol stove uses to hand queued players
+// to a matchmaker and receive their games back, and a matchmaker which
+// implements it in-process.
+//
+// Messages are JSON objects sent one after another over a stream connection.
+// Stove sends find and cancel messages; the matchmaker answers with entry,
+// update, match and cancelled messages.  Request IDs are chosen by stove, and
+// each find is answered with an entry message, then updates, until it's either
+// matched or cancelled.  The matchmaker decides which of those happened, so a
+// queued player is never both.
+package matchmaking
+
+import (
+	"errors"
+)
+
+// Message types.
+const (
+	// Stove asks for a player to be queued.
+	MessageFind = "find"
+	// Stove asks for a queued player to be taken out of the queue.
+	MessageCancel = "cancel"
+	// The matchmaker has queued a player.
+	MessageEntry = "entry"
+	// The matchmaker estimates how long a queued player will wait.
+	MessageUpdate = "update"
+	// The matchmaker has paired two queued players.  RequestID goes first,
+	// and Opponent second.
+	MessageMatch = "match"
+	// The matchmaker answers a cancel message.  Cancelled is false if the
+	// player was already matched, or wasn't queued.
+	MessageCancelled = "cancelled"
+)
+
+// A Message is sent between stove and a matchmaker.  Only the fields used by
+// its type are set.
+type Message struct {
+	Type      string `json:"type"`
+	RequestID uint64 `json:"requestId"`
+
+	// find
+	GameAccountID int64 `json:"gameAccountId,omitempty"`
+	GameType      int32 `json:"gameType,omitempty"`
+	Scenario      int   `json:"scenario,omitempty"`
+
+	// update, in seconds
+	MinWait    int64 `json:"minWait,omitempty"`
+	MaxWait    int64 `json:"maxWait,omitempty"`
+	AvgWait    int64 `json:"avgWait,omitempty"`
+	StdDevWait int64 `json:"stdDevWait,omitempty"`
+
+	// match
+	Opponent uint64 `json:"opponent,omitempty"`
+
+	// cancelled
+	Cancelled bool `json:"cancelled,omitempty"`
+}
+
+// ErrClosed is returned by a Matchmaker once it has been closed.
+var ErrClosed = errors.New("matchmaking: matchmaker closed")
+
+// A Matchmaker queues players and pairs them into games.  Send and Receive may
+// be called concurrently.
+type Matchmaker interface {
+	// Send passes a find or cancel message to the matchmaker.
+	Send(m *Message) error
+	// Receive waits for the next message from the matchmaker.
+	Receive() (*Message, error)
+	// Close disconnects from the matchmaker.  Pending calls to Receive
+	// return an error.
+	Close() error
+}
@@ -0,0 +1,124 @@
+package matchmaking
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"sync"
+)
+
+// A remote exchanges messages over a stream connection.  Stove uses one to
+// talk to an external matchmaker, and Serve uses one to talk to stove.
+type remote struct {
+	conn net.Conn
+	dec  *json.Decoder
+
+	// sendMutex protects enc, so messages aren't interleaved.
+	sendMutex sync.Mutex
+	enc       *json.Encoder
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newRemote(conn net.Conn) *remote {
+	return &remote{
+		conn:   conn,
+		dec:    json.NewDecoder(conn),
+		enc:    json.NewEncoder(conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// Dial connects to the matchmaker listening on address.
+func Dial(address string) (Matchmaker, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return newRemote(conn), nil
+}
+
+func (r *remote) Send(m *Message) error {
+	r.sendMutex.Lock()
+	defer r.sendMutex.Unlock()
+	err := r.enc.Encode(m)
+	if err != nil && r.isClosed() {
+		return ErrClosed
+	}
+	return err
+}
+
+func (r *remote) Receive() (*Message, error) {
+	m := &Message{}
+	err := r.dec.Decode(m)
+	if err != nil {
+		if r.isClosed() {
+			return nil, ErrClosed
+		}
+		return nil, err
+	}
+	return m, nil
+}
+
+func (r *remote) Close() error {
+	err := ErrClosed
+	r.closeOnce.Do(func() {
+		close(r.closed)
+		err = r.conn.Close()
+	})
+	return err
+}
+
+func (r *remote) isClosed() bool {
+	select {
+	case <-r.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Serve accepts connections from stove on l, and hands each one's messages to
+// a matchmaker returned by newMatchmaker.  The matchmaker is closed when the
+// connection ends.  Serve returns once l stops accepting connections.
+func Serve(l net.Listener, newMatchmaker func() Matchmaker) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go serveConn(newRemote(conn), newMatchmaker())
+	}
+}
+
+func serveConn(stove *remote, m Matchmaker) {
+	defer m.Close()
+	defer stove.Close()
+	log.Printf("matchmaking: serving %s", stove.conn.RemoteAddr())
+	go func() {
+		defer stove.Close()
+		for {
+			msg, err := m.Receive()
+			if err != nil {
+				return
+			}
+			err = stove.Send(msg)
+			if err != nil {
+				return
+			}
+		}
+	}()
+	for {
+		msg, err := stove.Receive()
+		if err != nil {
+			log.Printf("matchmaking: %s disconnected: %v", stove.conn.RemoteAddr(), err)
+			return
+		}
+		err = m.Send(msg)
+		if err != nil {
+			log.Printf("matchmaking: %s: %v", stove.conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package matchmaking
+
+import (
+	"net"
+	"testing"
+)
+
+func TestRemote(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	local := make(chan Matchmaker, 1)
+	go Serve(l, func() Matchmaker {
+		m := NewLocal()
+		local <- m
+		return m
+	})
+
+	m, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testMatchmaker(t, m)
+
+	// Disconnecting from the matchmaker closes the one serving it.
+	m.Close()
+	if _, err := m.Receive(); err != ErrClosed {
+		t.Errorf("expected ErrClosed from Receive, got %v", err)
+	}
+	if _, err := (<-local).Receive(); err != ErrClosed {
+		t.Errorf("served matchmaker wasn't closed: %v", err)
+	}
+}
@@ -1,18 +1,142 @@
 package pegasus
 
 import (
+	"context"
+	"errors"
+	"github.com/HearthSim/hs-proto-go/bnet/game_master_types"
 	"github.com/HearthSim/stove/bnet"
+	"github.com/HearthSim/stove/pegasus/game"
+	"github.com/HearthSim/stove/pegasus/matchmaking"
+	"log"
+	"sync"
+	"time"
 )
 
+// The FourCC the Hearthstone client logs on with.
+const Program = "WTCG"
+
+// How long a game host gets to create a game.
+const createGameTimeout = 10 * time.Second
+
 type Server struct {
 	host *bnet.Server
+
+	// sessionsMutex protects sessions.
+	sessionsMutex sync.Mutex
+	sessions      map[*Session]struct{}
+
+	matchmaker *matchmaker
+
+	// The game hosts running in this process, shut down with the server.
+	localHosts []*game.Host
 }
 
 func NewServer(serv *bnet.Server) *Server {
 	res := &Server{}
+	res.host = serv
+	res.sessions = map[*Session]struct{}{}
+	res.matchmaker = newMatchmaker(matchmaking.NewLocal())
 	return res
 }
 
+// AddLocalGameHost runs games on a game host in this process.  It must be
+// called before clients connect.
+func (s *Server) AddLocalGameHost(h *game.Host) {
+	h.OnGameEnded(func(handle int32, reason uint32) {
+		s.GameEnded(game.GameHandle(Program, handle), reason)
+	})
+	s.host.RegisterGameHost(Program, h.Local())
+	s.localHosts = append(s.localHosts, h)
+}
+
+// SetMatchmaker replaces the in-process matchmaker with another, such as one
+// returned by matchmaking.Dial.  It must be called before clients connect.
+func (s *Server) SetMatchmaker(backend matchmaking.Matchmaker) {
+	s.matchmaker.stop()
+	s.matchmaker = newMatchmaker(backend)
+}
+
 func (s *Server) Connect(sess *bnet.Session) {
 	BindSession(s, sess)
 }
+
+// Shutdown waits for every session to finish the request it's handling, so
+// that purchases and drafts in progress are saved, and then for the games of
+// the local game hosts to end.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.matchmaker.stop()
+	s.sessionsMutex.Lock()
+	sessions := make([]*Session, 0, len(s.sessions))
+	for sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	s.sessionsMutex.Unlock()
+	for _, sess := range sessions {
+		err := sess.drain(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	for _, h := range s.localHosts {
+		err := h.Shutdown(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GameEnded is told when a game on one of the game hosts ends, and why, as
+// one of the game.End reasons.  Games are only logged for now.
+func (s *Server) GameEnded(handle *game_master_types.GameHandle, reason uint32) {
+	how := "ended"
+	switch reason {
+	case game.EndComplete:
+		how = "was played to the end"
+	case game.EndClosed:
+		how = "was closed by its host"
+	case game.EndError:
+		how = "failed"
+	}
+	log.Printf("game %d %s", handle.GetGameId().GetLow(), how)
+}
+
+// createGame starts a game on the least loaded game host.
+func (s *Server) createGame(params *game.GameStartInfo) (*game.GameInfo, error) {
+	host := s.host.GameHostFor(Program)
+	if host == nil {
+		return nil, errors.New("no game hosts are registered")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), createGameTimeout)
+	defer cancel()
+	attrs, err := host.CreateGame(ctx, game.StartInfoAttributes(params))
+	if err != nil {
+		return nil, err
+	}
+	return game.ParseGameInfo(attrs)
+}
+
+func (s *Server) addSession(sess *Session) {
+	s.sessionsMutex.Lock()
+	defer s.sessionsMutex.Unlock()
+	s.sessions[sess] = struct{}{}
+}
+
+// sessionForGameAccount returns the session playing as a game account, or nil
+// if it isn't online.
+func (s *Server) sessionForGameAccount(id int64) *Session {
+	s.sessionsMutex.Lock()
+	defer s.sessionsMutex.Unlock()
+	for sess := range s.sessions {
+		if sess.Account.ID == id {
+			return sess
+		}
+	}
+	return nil
+}
+
+func (s *Server) removeSession(sess *Session) {
+	s.sessionsMutex.Lock()
+	defer s.sessionsMutex.Unlock()
+	delete(s.sessions, sess)
+}
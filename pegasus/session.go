@@ -1,11 +1,13 @@
 package pegasus
 
 import (
+	"context"
 	"errors"
 	"github.com/HearthSim/hs-proto-go/bnet/attribute"
 	"github.com/HearthSim/stove/bnet"
 	"github.com/golang/protobuf/proto"
 	"log"
+	"sync"
 )
 
 type Session struct {
@@ -18,6 +20,11 @@ type Session struct {
 	// gameNotifications are notifications sent by pegasus to bnet
 	gameNotifications chan<- *bnet.Notification
 
+	// handling is held while a notification from bnet is handled.  Once the
+	// session is draining for shutdown, no more notifications are handled.
+	handling sync.Mutex
+	draining bool
+
 	Account
 	Draft
 	Store
@@ -49,28 +56,62 @@ func BindSession(s *Server, hostSess *bnet.Session) {
 	sess.host.ServerNotifications = notifyRx
 	sess.gameNotifications = notifyTx
 	sess.host.ClientNotifications = notifyTx
+	s.addSession(sess)
 	go sess.HandleNotifications()
 }
 
 func (s *Session) HandleNotifications() {
-	quit := s.host.ChanForTransition(bnet.StateDisconnected)
+	defer s.server.removeSession(s)
+	defer s.server.matchmaker.leave(s)
 	defer s.host.DisconnectOnPanic()
 	for {
 		select {
 		case notify := <-s.hostNotifications:
-			s.handleNotification(notify)
-		case <-quit:
+			s.handleNotificationUnlessDraining(notify)
+		case <-s.host.Done():
 			return
 		}
 	}
 }
 
+func (s *Session) handleNotificationUnlessDraining(n *bnet.Notification) {
+	s.handling.Lock()
+	defer s.handling.Unlock()
+	if s.draining {
+		log.Printf("dropping %s notification during shutdown", n.Type)
+		return
+	}
+	s.handleNotification(n)
+}
+
+// drain waits for the notification being handled, if any, and stops the
+// session from handling any more.
+func (s *Session) drain(ctx context.Context) error {
+	drained := make(chan struct{})
+	go func() {
+		s.handling.Lock()
+		s.draining = true
+		s.handling.Unlock()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (s *Session) handleNotification(n *bnet.Notification) {
 	switch n.Type {
 	case bnet.NotifyClientRequest:
 		s.HandleUtilRequest(n.Attributes)
 	case bnet.NotifyFindGameRequest:
 		s.HandleFindGame(n.Map())
+	case bnet.NotifyFriendlyChallengeRequest:
+		s.HandleFriendlyChallenge(n.Map())
+	case bnet.NotifyCancelGameRequest:
+		s.HandleCancelGame(n.Map())
 	default:
 		log.Panicf("unhandled notification type: %s", n.Type)
 	}
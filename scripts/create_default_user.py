@@ -71,14 +71,17 @@ def main():
 	connection.commit()
 	connection.close()
 
-	# create bnet.db with default account (based on stove/wiki)
+	# create bnet.db with default account (based on stove/wiki).  Its password
+	# for the login page is set with stove -setpassword.
 	connection_bnet = sqlite3.connect(dbfile_bnet)
 	cursor_bnet = connection_bnet.cursor()
-	cursor_bnet.execute("INSERT INTO account VALUES (?, ?, ?, ?, ?)", (
-		None,
+	cursor_bnet.execute("INSERT INTO account (email, web_credential, battle_tag, country, preferred_region, flags) " + \
+		"VALUES (?, ?, ?, ?, ?, ?)", (
 		"test@hearthsim.info",
 		"0123456789abcdef0123456789abcdef",
 		"Test#1234",
+		"United States",
+		1,
 		flags
 	))
 	account_bnet_id = cursor_bnet.lastrowid
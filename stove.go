@@ -1,16 +1,28 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"fmt"
 	"github.com/HearthSim/stove/bnet"
 	"github.com/HearthSim/stove/config"
 	"github.com/HearthSim/stove/pegasus"
+	"github.com/HearthSim/stove/pegasus/game"
+	"github.com/HearthSim/stove/pegasus/matchmaking"
 	_ "github.com/rakyll/gom/http"
+	"io"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 )
 
+// How long clients and games get to finish up when the server is stopped.
+const shutdownTimeout = time.Minute
+
 func main() {
 	addr := config.Config.ListenAddress
 	if !strings.Contains(addr, ":") {
@@ -23,6 +35,9 @@ func main() {
 		pegasus.Migrate()
 		return
 	}
+	if moderate() {
+		return
+	}
 
 	debugListen := config.Config.DebugListenAddress
 	if len(debugListen) != 0 {
@@ -33,11 +48,123 @@ func main() {
 	}
 
 	serv := bnet.NewServer()
-	serv.RegisterGameServer("WTCG", pegasus.NewServer(serv))
+	if len(config.Config.Bnet.Cipher) != 0 {
+		err := serv.SetCipher(config.Config.Bnet.Cipher)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if config.Config.Bnet.MaxHeaderSize != 0 && config.Config.Bnet.MaxBodySize != 0 {
+		serv.SetPacketLimits(config.Config.Bnet.MaxHeaderSize,
+			config.Config.Bnet.MaxBodySize)
+	}
+	serv.SetMaxPlayers(config.Config.Bnet.MaxPlayers)
+	serv.SetGameHostPassword(config.Config.Bnet.GameHostPassword)
+	auth, err := bnet.NewAuthenticator(config.Config.Bnet.Auth.Backend,
+		config.Config.Bnet.Auth.PasswordFile)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	webAuth := config.Config.Bnet.WebAuth
+	if len(webAuth.ListenAddress) != 0 {
+		passwords := bnet.LoginPagePasswords(config.Config.Bnet.Auth.Backend, auth)
+		lifetime := bnet.DefaultWebCredentialLifetime
+		if webAuth.CredentialLifetime != 0 {
+			lifetime = time.Duration(webAuth.CredentialLifetime) * time.Second
+		}
+		webAuthServer := bnet.NewWebAuthServer(passwords, auth, lifetime)
+		auth = webAuthServer
+		webAuthURL := webAuth.URL
+		if len(webAuthURL) == 0 {
+			webAuthURL = fmt.Sprintf("http://%s/", webAuth.ListenAddress)
+		}
+		serv.SetWebAuthURL(webAuthURL)
+		go func() {
+			log.Printf("Login page listening on %s ...\n", webAuth.ListenAddress)
+			log.Println(http.ListenAndServe(webAuth.ListenAddress, webAuthServer))
+		}()
+	}
+	serv.SetAuthenticator(auth)
+	pegasusServ := pegasus.NewServer(serv)
+	if matchmakingAddr := config.Config.Pegasus.Matchmaking.Address; len(matchmakingAddr) != 0 {
+		matchmaker, err := matchmaking.Dial(matchmakingAddr)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		log.Printf("Using the matchmaker at %s\n", matchmakingAddr)
+		pegasusServ.SetMatchmaker(matchmaker)
+	}
+	if !config.Config.Pegasus.GameHost.RemoteOnly {
+		gameHostAddr := config.Config.Pegasus.GameHost.ListenAddress
+		if len(gameHostAddr) == 0 {
+			gameHostAddr = ":1120"
+		}
+		gameHost, err := game.NewHost(gameHostAddr,
+			config.Config.Pegasus.GameHost.AdvertisedAddress)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		pegasusServ.AddLocalGameHost(gameHost)
+	}
+	serv.RegisterGameServer(pegasus.Program, pegasusServ)
+
+	shutdown := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		log.Println("Shutting down ...")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		err := serv.Shutdown(ctx)
+		if err != nil {
+			log.Println(err)
+		}
+		close(shutdown)
+	}()
 
 	log.Printf("Listening on %s ...\n", addr)
-	err := serv.ListenAndServe(addr)
-	if err != nil {
+	err = serv.ListenAndServe(addr)
+	if err != bnet.ErrServerClosed {
 		log.Println(err)
+		return
+	}
+	<-shutdown
+}
+
+// moderate runs the moderation or account command given on the command line,
+// if any, and returns whether there was one.
+func moderate() bool {
+	switch {
+	case len(config.Config.Suspend) != 0:
+		suspension, err := bnet.Suspend(config.Config.Suspend,
+			config.Config.SuspendReason, config.Config.SuspendDuration)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		fmt.Printf("%s\n", suspension)
+	case len(config.Config.Unban) != 0:
+		n, err := bnet.Unban(config.Config.Unban)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		fmt.Printf("Lifted %d suspensions of %s\n", n, config.Config.Unban)
+	case config.Config.ListSuspensions:
+		for _, suspension := range bnet.ActiveSuspensions() {
+			fmt.Printf("%s\n", &suspension)
+		}
+	case len(config.Config.SetPassword) != 0:
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			log.Fatalln(err)
+		}
+		err = bnet.SetPassword(config.Config.SetPassword, strings.TrimRight(password, "\r\n"))
+		if err != nil {
+			log.Fatalln(err)
+		}
+		fmt.Printf("Set the password of %s\n", config.Config.SetPassword)
+	default:
+		return false
 	}
+	return true
 }